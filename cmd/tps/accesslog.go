@@ -0,0 +1,81 @@
+package main
+
+import (
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Outcomes recorded in the access log for each request handled by the proxy
+const (
+	outcomeProxy        = "proxy"         // public path or valid token, sent upstream
+	outcomeTrusted      = "trusted"       // client IP in a trusted range, sent upstream
+	outcomeChallenge    = "challenge"     // challenge page (or JSON) served
+	outcomeVerified     = "verified"      // challenge passed, original request replayed
+	outcomeVerifyFailed = "verify_failed" // challenge failed or verification rejected
+	outcomeExpired      = "expired"       // held request expired and couldn't be rebuilt
+	outcomeMaintenance  = "maintenance"   // maintenance page served
+	outcomeBlocked      = "blocked"       // client IP in a blocked range
+	outcomeUnavailable  = "unavailable"   // upstream's circuit breaker is open, or the provider is unreachable
+	outcomeRejected     = "rejected"      // refused before any of the above
+)
+
+// accessEntryKey is where a request's [accessEntry] lives in the gin context
+const accessEntryKey = "tps.access"
+
+// accessEntry collects what happened to a request so it can be logged as a
+// single line once the request is done
+type accessEntry struct {
+	outcome         string
+	template        string
+	requestID       string
+	upstreamStatus  int
+	upstreamLatency time.Duration
+}
+
+// accessFor returns the request's access entry, creating it if need be
+func accessFor(c *gin.Context) *accessEntry {
+	var v, ok = c.Get(accessEntryKey)
+	if ok {
+		return v.(*accessEntry)
+	}
+	var e = &accessEntry{outcome: outcomeRejected}
+	c.Set(accessEntryKey, e)
+	return e
+}
+
+// html renders the best template for the request with the given short name
+// (see [Server.getTemplate]) in the client's language (see [Server.localize]),
+// noting which template was used in the access log
+func (s *Server) html(c *gin.Context, status int, shortname string, data any) {
+	var name = s.getTemplate(c.Request, shortname)
+	accessFor(c).template = name
+	c.HTML(status, name, s.localize(c, data))
+}
+
+// logAccess writes the access log line for a request that started at start
+func (s *Server) logAccess(c *gin.Context, start time.Time) {
+	var e = accessFor(c)
+	var attrs = []any{
+		"outcome", e.outcome,
+		"method", c.Request.Method,
+		"host", requestHost(c.Request),
+		"path", c.Request.URL.Path,
+		"clientIP", c.ClientIP(),
+		"status", c.Writer.Status(),
+		"latency", time.Since(start),
+	}
+	if e.requestID != "" {
+		attrs = append(attrs, "requestID", e.requestID)
+	}
+	if e.template != "" {
+		attrs = append(attrs, "template", e.template)
+	}
+	if e.upstreamStatus != 0 {
+		attrs = append(attrs, "upstreamStatus", e.upstreamStatus)
+	}
+	if e.upstreamLatency != 0 {
+		attrs = append(attrs, "upstreamLatency", e.upstreamLatency)
+	}
+	s.logger.Info("Request handled", attrs...)
+}
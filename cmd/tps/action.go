@@ -0,0 +1,54 @@
+package main
+
+import (
+	"errors"
+	"strings"
+
+	"turnstile-proxy-server/internal/verifier"
+)
+
+// maxActionLength is the longest action Turnstile accepts
+const maxActionLength = 32
+
+var (
+	errActionMismatch = errors.New("verified action doesn't match the request")
+	errCDataMismatch  = errors.New("verified cData doesn't match the request ID")
+	errNoEcho         = errors.New("provider echoed neither action nor cData")
+)
+
+// challengeAction derives the widget's action from the request path. Turnstile
+// only allows up to 32 letters, digits, underscores, and dashes, so anything
+// else becomes an underscore and long paths are cut short. It only has to be
+// stable, since it's compared against what we'd derive again at verification.
+func challengeAction(p string) string {
+	var action = strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || r == '-' {
+			return r
+		}
+		return '_'
+	}, p)
+
+	if len(action) > maxActionLength {
+		action = action[:maxActionLength]
+	}
+	return action
+}
+
+// checkEcho makes sure the provider echoed back the action and cData the
+// widget was rendered with, so a response solved for one request can't be
+// used to verify another. Only values the provider actually echoed are
+// compared, since widgets in custom templates which predate action and cData
+// don't send them; if neither was echoed, checkEcho returns [errNoEcho] so the
+// caller can warn about it rather than fail every verification.
+func checkEcho(result verifier.Result, action, requestID string) error {
+	if result.Action == "" && result.CData == "" {
+		return errNoEcho
+	}
+	if result.Action != "" && result.Action != action {
+		return errActionMismatch
+	}
+	if result.CData != "" && result.CData != requestID {
+		return errCDataMismatch
+	}
+	return nil
+}
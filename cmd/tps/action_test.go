@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"turnstile-proxy-server/internal/verifier"
+)
+
+func TestCheckEcho(t *testing.T) {
+	var tests = map[string]struct {
+		action string
+		cData  string
+		want   error
+	}{
+		"match":           {"_page", "abc", nil},
+		"tampered action": {"_other", "abc", errActionMismatch},
+		"tampered cData":  {"_page", "xyz", errCDataMismatch},
+		"action only":     {"_page", "", nil},
+		"cData only":      {"", "abc", nil},
+		"nothing echoed":  {"", "", errNoEcho},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var got = checkEcho(verifier.Result{Success: true, Action: tc.action, CData: tc.cData}, "_page", "abc")
+			if !errors.Is(got, tc.want) {
+				t.Errorf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestVerifyChecksEcho(t *testing.T) {
+	var tests = map[string]struct {
+		action string
+		cData  func(requestID string) string
+		want   int
+	}{
+		"match":          {challengeAction("/page"), func(id string) string { return id }, http.StatusOK},
+		"tampered cData": {challengeAction("/page"), func(string) string { return "0123456789abcdef0123456789abcdef" }, http.StatusUnauthorized},
+		"wrong action":   {challengeAction("/other"), func(id string) string { return id }, http.StatusUnauthorized},
+		"nothing echoed": {"", func(string) string { return "" }, http.StatusOK},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var up = newUpstream(t, nil)
+			var s = newTestServer(up.URL)
+			var ts = startServer(t, s)
+			var client = newClient(t)
+
+			var action, form = challengeForm(t, client, ts.URL+"/page")
+			var sv = newSiteverify(t, map[string]any{
+				"success": true,
+				"action":  tc.action,
+				"cdata":   tc.cData(form.Get("request_id")),
+			})
+			s.SetVerifier(sv.verifier())
+			form.Set("cf-turnstile-response", "response-token")
+
+			var resp = postForm(t, client, action, form)
+			readBody(t, resp)
+			if resp.StatusCode != tc.want {
+				t.Errorf("got status %d, want %d", resp.StatusCode, tc.want)
+			}
+		})
+	}
+}
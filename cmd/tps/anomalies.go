@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// singletonHeaders are headers which must never appear more than once in a
+// legitimate request. Proxies disagreeing on which copy "wins" is a classic
+// smuggling and cache-poisoning vector.
+var singletonHeaders = []string{
+	"Authorization",
+	"Content-Type",
+	"Origin",
+	"Referer",
+	"User-Agent",
+	"X-Forwarded-Host",
+}
+
+// headerAnomaly inspects r for the header anomalies we reject in strict mode,
+// returning a short description of the first one found, or an empty string if
+// the request looks sane.
+//
+// Go's HTTP server already rejects multiple Host headers, conflicting
+// Content-Length values, and unsupported Transfer-Encodings before a handler
+// ever sees a request. It also strips Content-Length when chunked encoding is
+// used, and ignores Transfer-Encoding on HTTP/1.0 requests. The checks here
+// cover what's left:
+//
+//   - A GET or HEAD request carrying a body, whether via Content-Length or
+//     Transfer-Encoding
+//   - More than one copy of any header in [singletonHeaders]
+func headerAnomaly(r *http.Request) string {
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		if r.ContentLength > 0 {
+			return r.Method + " request with a Content-Length body"
+		}
+		if len(r.TransferEncoding) > 0 {
+			return r.Method + " request with a Transfer-Encoding body"
+		}
+	}
+
+	for _, h := range singletonHeaders {
+		if len(r.Header.Values(h)) > 1 {
+			return "duplicate " + strings.ToLower(h) + " header"
+		}
+	}
+
+	return ""
+}
+
+// refuseAnomalous responds with a 400 if strict header checks are on and the
+// request has a header anomaly (see [headerAnomaly]), returning true if it
+// did. Trusted clients and verification POSTs aren't exempt: a smuggled
+// request is just as dangerous coming from a trusted range.
+func (s *Server) refuseAnomalous(c *gin.Context) bool {
+	if !s.strictHeaders {
+		return false
+	}
+	var anomaly = headerAnomaly(c.Request)
+	if anomaly == "" {
+		return false
+	}
+
+	s.logger.Warn("Rejecting request with header anomaly", "anomaly", anomaly, "clientIP", c.ClientIP(), "URL", c.Request.URL.String())
+	c.String(http.StatusBadRequest, "Bad request")
+	return true
+}
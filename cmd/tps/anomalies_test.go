@@ -0,0 +1,111 @@
+package main
+
+import (
+	"net/http"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func TestStrictHeaders(t *testing.T) {
+	var up = newUpstream(t, nil)
+	var trusted = []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")}
+
+	// Trusted clients skip every other check, so anything that isn't
+	// rejected is proxied
+	var tests = map[string]struct {
+		method    string
+		body      string
+		chunked   bool
+		header    http.Header
+		anomalous bool
+	}{
+		"plain GET":                {method: http.MethodGet},
+		"GET with a body":          {method: http.MethodGet, body: "x=1", anomalous: true},
+		"chunked GET":              {method: http.MethodGet, body: "x=1", chunked: true, anomalous: true},
+		"HEAD with a body":         {method: http.MethodHead, body: "x=1", anomalous: true},
+		"POST with a body":         {method: http.MethodPost, body: "x=1"},
+		"chunked POST":             {method: http.MethodPost, body: "x=1", chunked: true},
+		"repeated non-singleton":   {method: http.MethodGet, header: http.Header{"Accept": {"text/html", "text/plain"}}},
+		"duplicate referer":        {method: http.MethodGet, header: http.Header{"Referer": {"http://a.example/", "http://b.example/"}}, anomalous: true},
+		"duplicate content type":   {method: http.MethodPost, body: "x=1", header: http.Header{"Content-Type": {"text/plain", "application/x-www-form-urlencoded"}}, anomalous: true},
+		"duplicate origin":         {method: http.MethodPost, header: http.Header{"Origin": {"http://a.example", "http://b.example"}}, anomalous: true},
+		"duplicate forwarded host": {method: http.MethodGet, header: http.Header{"X-Forwarded-Host": {"a.example", "b.example"}}, anomalous: true},
+	}
+
+	var send = func(t *testing.T, method, rawURL, body string, chunked bool, header http.Header) int {
+		t.Helper()
+		var req, err = http.NewRequest(method, rawURL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if body != "" {
+			req, _ = http.NewRequest(method, rawURL, strings.NewReader(body))
+			if chunked {
+				req.ContentLength = -1
+			}
+		}
+		for k, vals := range header {
+			for _, v := range vals {
+				req.Header.Add(k, v)
+			}
+		}
+
+		var resp *http.Response
+		resp, err = http.DefaultTransport.RoundTrip(req)
+		if err != nil {
+			t.Fatalf("%s %s: %s", method, rawURL, err)
+		}
+		readBody(t, resp)
+		return resp.StatusCode
+	}
+
+	for _, strict := range []bool{false, true} {
+		var proxy = startServer(t, newTestServer(up.URL).SetTrustedCIDRs(trusted).SetStrictHeaders(strict))
+		for name, tc := range tests {
+			var rejected = strict && tc.anomalous
+			var mode = "lenient"
+			if strict {
+				mode = "strict"
+			}
+
+			t.Run(mode+"/trusted/"+name, func(t *testing.T) {
+				var got = send(t, tc.method, proxy.URL+"/page", tc.body, tc.chunked, tc.header)
+				if rejected && got != http.StatusBadRequest {
+					t.Errorf("got status %d, want 400", got)
+				}
+				if !rejected && got != http.StatusOK {
+					t.Errorf("got status %d, want the request proxied", got)
+				}
+			})
+		}
+	}
+}
+
+func TestStrictHeadersOnVerifyEndpoint(t *testing.T) {
+	for _, strict := range []bool{false, true} {
+		var up = newUpstream(t, nil)
+		var s = newTestServer(up.URL).SetBypass(true).SetVerifyEndpoint(true).SetStrictHeaders(strict)
+		var ts = startServer(t, s)
+		var client = newClient(t)
+		var action, form = challengeForm(t, client, ts.URL+"/page")
+
+		var req, _ = http.NewRequest(http.MethodPost, action, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Add("Referer", ts.URL+"/page")
+		req.Header.Add("Referer", ts.URL+"/other")
+		var resp, err = client.Do(req)
+		if err != nil {
+			t.Fatalf("POST %s: %s", action, err)
+		}
+		readBody(t, resp)
+
+		var want = http.StatusOK
+		if strict {
+			want = http.StatusBadRequest
+		}
+		if resp.StatusCode != want {
+			t.Errorf("strict=%t: got status %d, want %d", strict, resp.StatusCode, want)
+		}
+	}
+}
@@ -0,0 +1,13 @@
+package main
+
+import "github.com/gin-gonic/gin"
+
+// wantsJSON returns true if the request looks like it came from script (XHR
+// or fetch) rather than a browser navigation, in which case an HTML challenge
+// page is useless to the caller
+func wantsJSON(c *gin.Context) bool {
+	if c.GetHeader("X-Requested-With") == "XMLHttpRequest" {
+		return true
+	}
+	return c.NegotiateFormat(gin.MIMEHTML, gin.MIMEJSON) == gin.MIMEJSON
+}
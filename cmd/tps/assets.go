@@ -0,0 +1,59 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// assetBase is the URL path under which static assets are served. Templates
+// get it as "AssetBase", e.g., "{{ .AssetBase }}/style.css".
+const assetBase = reservedPrefix + "assets"
+
+// layeredFS looks for files in each of its filesystems in order, returning
+// the first one found
+type layeredFS []fs.FS
+
+// Open implements [fs.FS]
+func (l layeredFS) Open(name string) (fs.File, error) {
+	for _, fsys := range l {
+		var f, err = fsys.Open(name)
+		if !errors.Is(err, fs.ErrNotExist) {
+			return f, err
+		}
+	}
+	return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+}
+
+// SetAssets sets where static assets are served from and returns s for
+// chaining. Files in assetsPath take precedence over the defaults in fallback.
+// An empty assetsPath serves only the defaults.
+func (s *Server) SetAssets(assetsPath string, fallback fs.FS) *Server {
+	if assetsPath == "" {
+		s.assets = fallback
+		return s
+	}
+	s.assets = layeredFS{os.DirFS(assetsPath), fallback}
+	return s
+}
+
+// handleAsset serves a single static file. Directories aren't listed.
+func (s *Server) handleAsset(c *gin.Context) {
+	var name = strings.TrimPrefix(path.Clean(c.Param("filepath")), "/")
+	if s.assets == nil || !fs.ValidPath(name) {
+		c.String(http.StatusNotFound, "Not found")
+		return
+	}
+
+	var info, err = fs.Stat(s.assets, name)
+	if err != nil || info.IsDir() {
+		c.String(http.StatusNotFound, "Not found")
+		return
+	}
+	c.FileFromFS(name, http.FS(s.assets))
+}
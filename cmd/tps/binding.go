@@ -0,0 +1,65 @@
+package main
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// defaultBindingCookieName prefixes the binding cookies' names when the
+// session cookie has its default name (see [Server.bindingCookieName])
+const defaultBindingCookieName = "tps-challenge"
+
+var (
+	errNoBindingCookie = errors.New("no challenge binding cookie")
+	errBindingMismatch = errors.New("challenge binding cookie doesn't match request ID")
+)
+
+// bindingCookiePrefixLen is how much of a request ID goes into its binding
+// cookie's name: enough that a browser's challenges never share a cookie, but
+// not so much that a few open tabs bloat every request's headers
+const bindingCookiePrefixLen = 16
+
+// bindingCookieName returns the name of the cookie holding requestID, signed
+// so it can't be forged. Requiring it to match the request ID in the
+// verification form (a "double-submit" check) stops a verification POST from
+// being forged cross-site, and stops one client from replaying a request that
+// was cached for somebody else.
+//
+// Each challenge gets its own cookie, named after its request ID, so a
+// browser with several challenges open at once (e.g., in multiple tabs) can
+// answer any of them, not just the last one served. With a custom session
+// cookie name, the binding cookies are named after it, so instances sharing a
+// domain don't trample each other's challenges.
+func (s *Server) bindingCookieName(requestID string) string {
+	var base = defaultBindingCookieName
+	if s.cookieName != defaultCookieName {
+		base = s.cookieName + "-challenge"
+	}
+	return base + "-" + requestID[:min(len(requestID), bindingCookiePrefixLen)]
+}
+
+// setBindingCookie binds the browser to the given request ID for as long as
+// the cached request lives. The cookie expires along with the request, so
+// abandoned challenges don't pile up in the browser.
+func (s *Server) setBindingCookie(c *gin.Context, requestID string) {
+	var val = requestID + "." + s.sign("tps-challenge", requestID)
+	c.SetSameSite(s.cookieSameSite)
+	c.SetCookie(s.bindingCookieName(requestID), val, int(s.cacheTTL.Seconds()), "/", s.cookieDomain, s.cookieSecure, true)
+}
+
+// checkBinding verifies the binding cookie is present, properly signed, and
+// bound to requestID
+func (s *Server) checkBinding(c *gin.Context, requestID string) error {
+	var val, err = c.Cookie(s.bindingCookieName(requestID))
+	if err != nil || val == "" {
+		return errNoBindingCookie
+	}
+
+	var boundID, sig, ok = strings.Cut(val, ".")
+	if !ok || !s.validSignature("tps-challenge", boundID, sig) || boundID != requestID {
+		return errBindingMismatch
+	}
+	return nil
+}
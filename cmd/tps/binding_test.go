@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestBindingCookiePerChallenge(t *testing.T) {
+	var up = newUpstream(t, nil)
+	var s = newTestServer(up.URL).SetBypass(true).SetBindChallenge(true)
+	var ts = startServer(t, s)
+
+	// Two tabs in one browser, each challenged before either is answered
+	var client = newClient(t)
+	var action1, form1 = challengeForm(t, client, ts.URL+"/one")
+	var action2, form2 = challengeForm(t, client, ts.URL+"/two")
+
+	// Another browser can't answer either challenge
+	var resp = postForm(t, newClient(t), action1, form1)
+	readBody(t, resp)
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("other browser: got status %d, want 403", resp.StatusCode)
+	}
+
+	// Answering the second tab first must leave the first one answerable
+	resp = postForm(t, client, action2, form2)
+	readBody(t, resp)
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("second tab: got status %d, want 200", resp.StatusCode)
+	}
+
+	// Answer the first tab from a fresh jar holding only the binding cookies,
+	// so a session from the second tab can't let it skip verification
+	var tab1 = newClient(t)
+	var u, _ = url.Parse(ts.URL)
+	for _, c := range client.Jar.Cookies(u) {
+		if c.Name != s.cookieName {
+			tab1.Jar.SetCookies(u, []*http.Cookie{c})
+		}
+	}
+	resp = postForm(t, tab1, action1, form1)
+	readBody(t, resp)
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("first tab: got status %d, want 200", resp.StatusCode)
+	}
+
+	if got := up.hits.Load(); got != 2 {
+		t.Errorf("upstream got %d requests, want 2", got)
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"net/http"
+	"net/netip"
+	"net/url"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestBlockedClient(t *testing.T) {
+	var sv = newSiteverify(t, map[string]any{"success": true})
+	var up = newUpstream(t, nil)
+	var loopback = []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")}
+
+	// Blocking wins even over trusting the same range
+	var s = newTestServer(up.URL).
+		SetVerifier(sv.verifier()).
+		SetVerifyEndpoint(true).
+		SetBlockedCIDRs(loopback).
+		SetTrustedCIDRs(loopback)
+	var ts = startServer(t, s)
+
+	var form = url.Values{"request_id": {"0123456789abcdef0123456789abcdef"}, "cf-turnstile-response": {"token"}}
+	var requests = map[string]func() *http.Response{
+		"GET": func() *http.Response {
+			var resp, err = http.Get(ts.URL + "/page")
+			if err != nil {
+				t.Fatalf("GET: %s", err)
+			}
+			return resp
+		},
+		"verification": func() *http.Response {
+			return postForm(t, newClient(t), ts.URL+"/page", form)
+		},
+		"verify endpoint": func() *http.Response {
+			return postForm(t, newClient(t), ts.URL+verifyPath, form)
+		},
+	}
+	for name, do := range requests {
+		t.Run(name, func(t *testing.T) {
+			var resp = do()
+			readBody(t, resp)
+			if resp.StatusCode != http.StatusForbidden {
+				t.Errorf("got status %d, want 403", resp.StatusCode)
+			}
+		})
+	}
+
+	if got := sv.calls.Load(); got != 0 {
+		t.Errorf("siteverify got %d calls, want 0", got)
+	}
+	if got := up.hits.Load(); got != 0 {
+		t.Errorf("upstream got %d hits, want 0", got)
+	}
+}
+
+func TestBlockedClientBehindProxy(t *testing.T) {
+	var up = newUpstream(t, nil)
+	var blocked = []netip.Prefix{netip.MustParsePrefix("203.0.113.0/24")}
+
+	var tests = map[string]struct {
+		trustedProxies []string
+		forwardedFor   string
+		want           int
+	}{
+		"blocked client via a trusted proxy": {
+			trustedProxies: []string{"127.0.0.0/8"},
+			forwardedFor:   "203.0.113.5",
+			want:           http.StatusForbidden,
+		},
+		"other client via a trusted proxy": {
+			trustedProxies: []string{"127.0.0.0/8"},
+			forwardedFor:   "198.51.100.1",
+			want:           http.StatusOK,
+		},
+		"spoofed header without trusted proxies": {
+			forwardedFor: "203.0.113.5",
+			want:         http.StatusOK,
+		},
+		"spoofed header from an untrusted proxy": {
+			trustedProxies: []string{"10.0.0.0/8"},
+			forwardedFor:   "203.0.113.5",
+			want:           http.StatusOK,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var router = gin.New()
+			var err = router.SetTrustedProxies(tc.trustedProxies)
+			if err != nil {
+				t.Fatalf("SetTrustedProxies: %s", err)
+			}
+			var ts = startServer(t, newTestServerOn(router, up.URL).SetBlockedCIDRs(blocked))
+
+			var req, _ = http.NewRequest(http.MethodGet, ts.URL+"/page", nil)
+			req.Header.Set("X-Forwarded-For", tc.forwardedFor)
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("GET: %s", err)
+			}
+			readBody(t, resp)
+
+			// Clients that aren't blocked are challenged
+			if resp.StatusCode != tc.want {
+				t.Errorf("got status %d, want %d", resp.StatusCode, tc.want)
+			}
+		})
+	}
+}
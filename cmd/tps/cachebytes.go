@@ -0,0 +1,53 @@
+package main
+
+// minBodyReadLimit is how much of a request body TPS will read however small
+// the cache cap is, so verification forms, whose provider response alone can
+// run to a couple of kilobytes, always get through
+const minBodyReadLimit = 64 << 10
+
+// bodyReadLimit returns how much of a request body TPS will read before
+// refusing it, or zero for no limit. A body past the cache cap could never be
+// cached, so there's no reason to hold more than that in memory.
+func (s *Server) bodyReadLimit() int64 {
+	if s.maxCachedBytes <= 0 {
+		return 0
+	}
+	return max(s.maxCachedBytes, minBodyReadLimit)
+}
+
+// reserveCacheBytes accounts for n more bytes of cached request bodies,
+// returning false (and reserving nothing) if that would push the total over
+// the configured cap. A cap of zero means there is no limit.
+//
+// Expired requests keep their bytes until they leave the cache, which can be
+// well after they expire if nobody comes back for them, so they're swept out
+// before a request is turned away.
+func (s *Server) reserveCacheBytes(n int64) bool {
+	if s.tryReserveCacheBytes(n) {
+		return true
+	}
+	s.requestCache.DeleteExpired()
+	return s.tryReserveCacheBytes(n)
+}
+
+// tryReserveCacheBytes is [Server.reserveCacheBytes] without the sweep
+func (s *Server) tryReserveCacheBytes(n int64) bool {
+	for {
+		var cur = s.cachedBytes.Load()
+		if s.maxCachedBytes > 0 && cur+n > s.maxCachedBytes {
+			return false
+		}
+		if s.cachedBytes.CompareAndSwap(cur, cur+n) {
+			return true
+		}
+	}
+}
+
+// releaseCachedRequest is the request cache's removal hook, returning a cached
+// request's body bytes to the pool whenever it's taken, expires, or is evicted
+func (s *Server) releaseCachedRequest(v any) {
+	var req, ok = v.(*cachedRequest)
+	if ok {
+		s.cachedBytes.Add(-int64(len(req.Body)))
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExpiredRequestsReleaseTheirBytes(t *testing.T) {
+	// The request cache's janitor only sweeps every 2×TTL, so anything seen
+	// here before then was released by the request path itself
+	const ttl = 100 * time.Millisecond
+	var s = newTestServer(newUpstream(t, nil).URL).SetBypass(true).SetMaxCachedBytes(100).SetCacheTTL(ttl)
+	var ts = startServer(t, s)
+	var client = newClient(t)
+
+	var post = func() (status int, body string) {
+		t.Helper()
+		var resp, err = client.Post(ts.URL+"/form", "text/plain", strings.NewReader(strings.Repeat("x", 80)))
+		if err != nil {
+			t.Fatalf("POST: %s", err)
+		}
+		return resp.StatusCode, readBody(t, resp)
+	}
+
+	var status, body = post()
+	if status != http.StatusOK {
+		t.Fatalf("first POST: got status %d, want a challenge", status)
+	}
+	var form = hiddenFields(body)
+	if status, _ = post(); status != http.StatusServiceUnavailable {
+		t.Fatalf("second POST: got status %d, want 503 with the cache full", status)
+	}
+
+	time.Sleep(ttl + ttl/5)
+
+	// Verifying the expired request releases its bytes
+	var resp = postForm(t, client, ts.URL+"/form", form)
+	readBody(t, resp)
+	if resp.StatusCode != http.StatusGone {
+		t.Errorf("verifying expired request: got status %d, want 410", resp.StatusCode)
+	}
+	if got := s.cachedBytes.Load(); got != 0 {
+		t.Errorf("%d bytes still reserved after verifying an expired request", got)
+	}
+
+	// A request nobody comes back for is swept out when its bytes are needed
+	if status, _ = post(); status != http.StatusOK {
+		t.Fatalf("third POST: got status %d, want a challenge", status)
+	}
+	time.Sleep(ttl + ttl/5)
+	if status, _ = post(); status != http.StatusOK {
+		t.Errorf("POST after the last one expired: got status %d, want a challenge", status)
+	}
+}
+
+func TestBodyLargerThanCacheIsRefused(t *testing.T) {
+	var up = newUpstream(t, nil)
+	var s = newTestServer(up.URL).SetMaxCachedBytes(100)
+	var ts = startServer(t, s)
+
+	var tests = map[string]struct {
+		size int
+		want int
+	}{
+		"fits": {100, http.StatusOK},
+		// Too big for the cap, but small enough to be a verification form
+		"over the cap":        {101, http.StatusServiceUnavailable},
+		"over the read limit": {minBodyReadLimit + 1, http.StatusRequestEntityTooLarge},
+		"far over":            {1 << 20, http.StatusRequestEntityTooLarge},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var resp, err = newClient(t).Post(ts.URL+"/form", "text/plain", strings.NewReader(strings.Repeat("x", tc.size)))
+			if err != nil {
+				t.Fatalf("POST: %s", err)
+			}
+			readBody(t, resp)
+			if resp.StatusCode != tc.want {
+				t.Errorf("got status %d, want %d", resp.StatusCode, tc.want)
+			}
+		})
+	}
+
+	if got := s.cachedBytes.Load(); got != 100 {
+		t.Errorf("%d bytes reserved, want only the body that fit", got)
+	}
+	if got := up.hits.Load(); got != 0 {
+		t.Errorf("upstream got %d requests, want none", got)
+	}
+}
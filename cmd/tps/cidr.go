@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// parseCIDRs splits a comma-separated list of IPs and CIDRs from the named
+// setting into prefixes. A bare IP is treated as a single-address prefix.
+func parseCIDRs(name, val string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, p := range strings.Split(val, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+
+		var prefix, err = netip.ParsePrefix(p)
+		if err != nil {
+			var addr, addrErr = netip.ParseAddr(p)
+			if addrErr != nil {
+				return nil, fmt.Errorf("%s: %q is not a valid IP or CIDR", name, p)
+			}
+			prefix = netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen())
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// clientInPrefixes returns true if the client's IP, as resolved through any
+// trusted proxies, falls in one of prefixes
+func clientInPrefixes(c *gin.Context, prefixes []netip.Prefix) bool {
+	if len(prefixes) == 0 {
+		return false
+	}
+
+	var addr, err = netip.ParseAddr(c.ClientIP())
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, p := range prefixes {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/patrickmn/go-cache"
+)
+
+var (
+	errRequestIDUsed    = errors.New("request ID has already been submitted")
+	errRequestIDExpired = errors.New("request ID is unknown or expired")
+)
+
+// peekRequest returns the cached request for requestID without claiming it,
+// so the provider can be asked about it first. It returns [errRequestIDUsed]
+// if the request ID was already submitted, and [errRequestIDExpired] if the
+// request is no longer cached.
+func (s *Server) peekRequest(requestID string) (*cachedRequest, error) {
+	var _, used = s.usedRequestIDs.Get(requestID)
+	if used {
+		return nil, errRequestIDUsed
+	}
+
+	var cached, found = s.requestCache.Peek(requestID)
+	if !found {
+		return nil, errRequestIDExpired
+	}
+	return cached.(*cachedRequest), nil
+}
+
+// claimRequest takes the cached request for requestID out of the cache so it
+// can be replayed exactly once. Claims are atomic: if a request ID is
+// submitted twice, even concurrently, only the first submission gets the
+// cached request, and every later one gets [errRequestIDUsed].
+//
+// A request is only claimed once the provider has given a definitive answer,
+// passed or failed, so nothing is left behind to be replayed later, while a
+// provider outage leaves it cached for the client to try again. Even the
+// double-submit handling in [Server.reuseVerification] only redirects the
+// client; it never sends the request upstream a second time.
+func (s *Server) claimRequest(requestID string) (*cachedRequest, error) {
+	var err = s.usedRequestIDs.Add(requestID, true, cache.DefaultExpiration)
+	if err != nil {
+		return nil, errRequestIDUsed
+	}
+
+	var cached, found = s.requestCache.Take(requestID)
+	if !found {
+		return nil, errRequestIDExpired
+	}
+	return cached.(*cachedRequest), nil
+}
+
+// resubmittedChallenge returns true if c is a challenge form POST whose
+// request ID was already submitted. A client that passed its challenge has a
+// session by the time it resubmits the form (from the back button, say), and
+// without this the resubmission would be proxied upstream like any other
+// request from a verified client. The body is buffered and put back, so the
+// request can still be proxied if it isn't a resubmission.
+func (s *Server) resubmittedChallenge(c *gin.Context) bool {
+	if c.Request.Method != http.MethodPost || c.ContentType() != binding.MIMEPOSTForm {
+		return false
+	}
+
+	var body, err = io.ReadAll(c.Request.Body)
+	c.Request.Body = io.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return false
+	}
+	var form, _ = url.ParseQuery(string(body))
+	var requestID = form.Get("request_id")
+	if requestID == "" {
+		return false
+	}
+	var _, used = s.usedRequestIDs.Get(requestID)
+	return used
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestRequestIDIsSingleUse(t *testing.T) {
+	var up = newUpstream(t, nil)
+	var s = newTestServer(up.URL).SetBypass(true)
+	var ts = startServer(t, s)
+	var client = newClient(t)
+
+	var action, form = challengeForm(t, client, ts.URL+"/page")
+	var resp = postForm(t, client, action, form)
+	readBody(t, resp)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("first submission: got status %d, want 200", resp.StatusCode)
+	}
+
+	// The client has a session now, which mustn't let the resubmitted form
+	// through to the upstream
+	resp = postForm(t, client, action, form)
+	readBody(t, resp)
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("second submission: got status %d, want 403", resp.StatusCode)
+	}
+	if got := up.hits.Load(); got != 1 {
+		t.Errorf("upstream got %d requests, want 1", got)
+	}
+}
+
+func TestResubmittedResponseIsNotReplayed(t *testing.T) {
+	var up = newUpstream(t, nil)
+	var s = newTestServer(up.URL)
+	var ts = startServer(t, s)
+	var client = newClient(t)
+
+	var action, form = challengeForm(t, client, ts.URL+"/page")
+	var sv = newSiteverify(t, map[string]any{
+		"success": true,
+		"action":  challengeAction("/page"),
+		"cdata":   form.Get("request_id"),
+	})
+	s.SetVerifier(sv.verifier())
+	form.Set("cf-turnstile-response", "response-token")
+
+	for i, want := range []int{http.StatusOK, http.StatusSeeOther, http.StatusSeeOther} {
+		var resp = postForm(t, client, action, form)
+		readBody(t, resp)
+		if resp.StatusCode != want {
+			t.Errorf("submission %d: got status %d, want %d", i+1, resp.StatusCode, want)
+		}
+	}
+	if got := up.hits.Load(); got != 1 {
+		t.Errorf("upstream got %d requests, want 1", got)
+	}
+	if got := sv.calls.Load(); got != 1 {
+		t.Errorf("siteverify was called %d times, want 1", got)
+	}
+}
+
+func TestProviderOutageKeepsRequest(t *testing.T) {
+	var up = newUpstream(t, nil)
+	var s = newTestServer(up.URL)
+	var ts = startServer(t, s)
+	var client = newClient(t)
+
+	var action, form = challengeForm(t, client, ts.URL+"/page")
+	var sv = newSiteverify(t, map[string]any{
+		"success": true,
+		"action":  challengeAction("/page"),
+		"cdata":   form.Get("request_id"),
+	})
+	s.SetVerifier(sv.verifier())
+	form.Set("cf-turnstile-response", "response-token")
+
+	// Siteverify fails every retry, so the client is asked to try again
+	sv.failing.Store(true)
+	var resp = postForm(t, client, action, form)
+	var body = readBody(t, resp)
+	if resp.StatusCode != http.StatusServiceUnavailable || !strings.Contains(body, "try again") {
+		t.Errorf("provider outage: got status %d and body %q, want 503 and the unavailable page", resp.StatusCode, body)
+	}
+	var failedCalls = sv.calls.Load()
+	if failedCalls < 2 {
+		t.Errorf("siteverify was called %d times, want it retried", failedCalls)
+	}
+	if got := up.hits.Load(); got != 0 {
+		t.Errorf("upstream got %d requests during the outage, want none", got)
+	}
+
+	// Once it's back, resubmitting the same form replays the request
+	sv.failing.Store(false)
+	resp = postForm(t, client, action, form)
+	body = readBody(t, resp)
+	if resp.StatusCode != http.StatusOK || body != "upstream ok" {
+		t.Errorf("retry: got status %d and body %q, want the replayed request", resp.StatusCode, body)
+	}
+	if got := sv.calls.Load() - failedCalls; got != 1 {
+		t.Errorf("siteverify was called %d times on retry, want 1", got)
+	}
+	if got := up.hits.Load(); got != 1 {
+		t.Errorf("upstream got %d requests, want 1", got)
+	}
+}
+
+func TestEvictedRequestSkipsProvider(t *testing.T) {
+	var up = newUpstream(t, nil)
+	var s = newTestServer(up.URL).SetMaxCachedRequests(1)
+	var sv = newSiteverify(t, map[string]any{"success": true})
+	s.SetVerifier(sv.verifier())
+	var ts = startServer(t, s)
+	var client = newClient(t)
+
+	// The second challenge evicts the first one's request
+	var action, form = challengeForm(t, client, ts.URL+"/first?x=1")
+	challengeForm(t, client, ts.URL+"/second")
+	form.Set("cf-turnstile-response", "response-token")
+
+	var resp = postForm(t, client, action, form)
+	var body = readBody(t, resp)
+	if resp.StatusCode != http.StatusOK || !strings.Contains(body, "Your session expired") {
+		t.Fatalf("got status %d and body %q, want a fresh challenge saying the session expired", resp.StatusCode, body)
+	}
+	var retry = hiddenFields(body)
+	if id := retry.Get("request_id"); id == "" || id == form.Get("request_id") {
+		t.Errorf("fresh challenge has request ID %q, want a new one", id)
+	}
+	if got := retry.Get("original_url"); got != "/first?x=1" {
+		t.Errorf("fresh challenge is for %q, want /first?x=1", got)
+	}
+
+	if got := sv.calls.Load(); got != 0 {
+		t.Errorf("siteverify was called %d times for an evicted request, want 0", got)
+	}
+	if got := up.hits.Load(); got != 0 {
+		t.Errorf("upstream got %d requests, want none", got)
+	}
+}
@@ -1,27 +1,338 @@
 package main
 
 import (
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/netip"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
+	"turnstile-proxy-server/internal/db"
+	"turnstile-proxy-server/internal/i18n"
+	"turnstile-proxy-server/internal/verifier"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/net/http/httpguts"
 )
 
+// getenvBool reads a boolean setting (see [setting]), treating an unset or
+// empty value as false
+func getenvBool(key string) (bool, error) {
+	var val = setting(key)
+	if val == "" {
+		return false, nil
+	}
+
+	var b, err = strconv.ParseBool(val)
+	if err != nil {
+		return false, fmt.Errorf("%s must be a boolean value, got %q", key, val)
+	}
+	return b, nil
+}
+
+// newLogger builds the root logger from LOG_FORMAT and LOG_LEVEL, defaulting
+// to text output at debug level
+func newLogger() (*slog.Logger, error) {
+	var level slog.Level
+	var lvl = setting("LOG_LEVEL")
+	if lvl == "" {
+		lvl = "debug"
+	}
+	var err = level.UnmarshalText([]byte(lvl))
+	if err != nil {
+		return nil, fmt.Errorf(`LOG_LEVEL must be "debug", "info", "warn", or "error", got %q`, lvl)
+	}
+
+	var opts = &slog.HandlerOptions{Level: level, AddSource: level <= slog.LevelDebug}
+	switch setting("LOG_FORMAT") {
+	case "", "text":
+		return slog.New(slog.NewTextHandler(os.Stdout, opts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(os.Stdout, opts)), nil
+	default:
+		return nil, fmt.Errorf(`LOG_FORMAT must be "text" or "json", got %q`, setting("LOG_FORMAT"))
+	}
+}
+
+// parseSameSite converts a COOKIE_SAMESITE value to its [http.SameSite] mode
+func parseSameSite(val string) (http.SameSite, error) {
+	switch strings.ToLower(val) {
+	case "", "lax":
+		return http.SameSiteLaxMode, nil
+	case "strict":
+		return http.SameSiteStrictMode, nil
+	case "none":
+		return http.SameSiteNoneMode, nil
+	}
+	return 0, fmt.Errorf(`COOKIE_SAMESITE must be "lax", "strict", or "none", got %q`, val)
+}
+
+// parseTrustedProxies splits a comma-separated list of IPs and CIDRs,
+// validating each one
+func parseTrustedProxies(val string) ([]string, error) {
+	var proxies []string
+	for _, p := range strings.Split(val, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		if _, err := netip.ParsePrefix(p); err != nil {
+			if _, err := netip.ParseAddr(p); err != nil {
+				return nil, fmt.Errorf("TRUSTED_PROXIES: %q is not a valid IP or CIDR", p)
+			}
+		}
+		proxies = append(proxies, p)
+	}
+	return proxies, nil
+}
+
+// getDatabaseEnv reads and validates the database settings, returning any
+// problems found
+func getDatabaseEnv() []string {
+	databaseDSN = setting("DATABASE_DSN")
+	databaseDriver = setting("DATABASE_DRIVER")
+
+	var errs []string
+	if databaseDriver == "" {
+		databaseDriver = db.DriverMySQL
+	}
+	if !db.ValidDriver(databaseDriver) {
+		errs = append(errs, fmt.Sprintf("DATABASE_DRIVER must be %q or %q", db.DriverMySQL, db.DriverPostgres))
+	}
+	if databaseDSN == "" {
+		errs = append(errs, "DATABASE_DSN is not set")
+	} else if db.ValidDriver(databaseDriver) {
+		var err = db.ValidateDSN(databaseDriver, databaseDSN)
+		if err != nil {
+			errs = append(errs, "DATABASE_DSN: "+err.Error())
+		}
+	}
+	return errs
+}
+
+// getServerTimeoutsEnv reads and validates the listening server's timeouts,
+// returning any problems found
+func getServerTimeoutsEnv() []string {
+	var errs []string
+	readHeaderTimeout = defaultReadHeaderTimeout
+	readTimeout = 0
+	writeTimeout = 0
+	idleTimeout = defaultIdleTimeout
+	for _, t := range []struct {
+		key string
+		val *time.Duration
+	}{
+		{"READ_HEADER_TIMEOUT", &readHeaderTimeout},
+		{"READ_TIMEOUT", &readTimeout},
+		{"WRITE_TIMEOUT", &writeTimeout},
+		{"IDLE_TIMEOUT", &idleTimeout},
+	} {
+		var raw = setting(t.key)
+		if raw == "" {
+			continue
+		}
+		var err error
+		*t.val, err = time.ParseDuration(raw)
+		if err != nil || *t.val < 0 {
+			errs = append(errs, fmt.Sprintf(`%s must be a non-negative duration like "30s", got %q`, t.key, raw))
+		}
+	}
+	return errs
+}
+
+// getMessagesEnv loads the built-in pages' messages, plus any from
+// MESSAGES_PATH, falling back to DEFAULT_LANGUAGE, and returns any problems
+// found
+func getMessagesEnv() []string {
+	var errs []string
+	var defaultLanguage = setting("DEFAULT_LANGUAGE")
+	if defaultLanguage == "" {
+		defaultLanguage = "en"
+	}
+	var catalogs = []fs.FS{i18n.FS}
+	var messagesPath = setting("MESSAGES_PATH")
+	if messagesPath != "" {
+		var info, err = os.Stat(messagesPath)
+		if err != nil || !info.IsDir() {
+			errs = append(errs, fmt.Sprintf("MESSAGES_PATH %q is not a readable directory", messagesPath))
+		}
+		catalogs = append(catalogs, os.DirFS(messagesPath))
+	}
+	var err error
+	messages, err = i18n.Load(defaultLanguage, catalogs...)
+	if err != nil {
+		errs = append(errs, "Unable to load messages: "+err.Error())
+	}
+	return errs
+}
+
+// getenvMigrate reads only what the migrate command needs: logging and
+// database settings
+func getenvMigrate() {
+	var errs []string
+	var l, err = newLogger()
+	if err != nil {
+		errs = append(errs, err.Error())
+	} else {
+		logger = l
+	}
+	errs = append(errs, getDatabaseEnv()...)
+
+	if len(errs) != 0 {
+		logger.Error("Cannot run migrations", "error", strings.Join(errs, "; "))
+		os.Exit(1)
+	}
+}
+
 func getenv() {
-	bindAddr = os.Getenv("BIND_ADDR")
-	turnstileSecretKey = os.Getenv("TURNSTILE_SECRET_KEY")
-	turnstileSiteKey = os.Getenv("TURNSTILE_SITE_KEY")
-	jwtSigningKey = os.Getenv("JWT_SIGNING_KEY")
-	proxyTarget = os.Getenv("PROXY_TARGET")
-	databaseDSN = os.Getenv("DATABASE_DSN")
-	templatePath = os.Getenv("TEMPLATE_PATH")
+	bindAddr = setting("BIND_ADDR")
+	turnstileSecretKey = setting("TURNSTILE_SECRET_KEY")
+	turnstileSiteKey = setting("TURNSTILE_SITE_KEY")
+	verifyProvider = setting("VERIFY_PROVIDER")
+	turnstileKeysFile = setting("TURNSTILE_KEYS_FILE")
+	siteverifyURL = setting("TURNSTILE_SITEVERIFY_URL")
+	jwtSigningKey = setting("JWT_SIGNING_KEY")
+	proxyTarget = setting("PROXY_TARGET")
+	proxyRoutesFile = setting("PROXY_ROUTES_FILE")
+	templatePath = setting("TEMPLATE_PATH")
+	cookieName = setting("COOKIE_NAME")
+	cookieDomain = setting("COOKIE_DOMAIN")
+	allowedOrigins = parseAllowedOrigins(setting("ALLOWED_ORIGINS"))
+	verifiedHeader = setting("VERIFIED_HEADER")
+	adminUser = setting("ADMIN_USER")
+	adminPass = setting("ADMIN_PASS")
+	postVerifyMode = setting("POST_VERIFY_MODE")
+	expectMode = setting("EXPECT_CONTINUE_MODE")
+	widgetAppearance = setting("TURNSTILE_APPEARANCE")
+	widgetTheme = setting("TURNSTILE_THEME")
+	widgetFailureAppearance = setting("TURNSTILE_FAILURE_APPEARANCE")
 
 	var errs []string
+	var l, err = newLogger()
+	if err != nil {
+		errs = append(errs, err.Error())
+	} else {
+		logger = l
+	}
+
+	strictHeaders, err = getenvBool("STRICT_HEADERS")
+	if err != nil {
+		errs = append(errs, err.Error())
+	}
+	checkSecretKey, err = getenvBool("TURNSTILE_CHECK_SECRET")
+	if err != nil {
+		errs = append(errs, err.Error())
+	}
+	maintenance, err = getenvBool("MAINTENANCE")
+	if err != nil {
+		errs = append(errs, err.Error())
+	}
+	if (adminUser == "") != (adminPass == "") {
+		errs = append(errs, "ADMIN_USER and ADMIN_PASS must be set together")
+	}
+	bindChallenge, err = getenvBool("BIND_CHALLENGE_COOKIE")
+	if err != nil {
+		errs = append(errs, err.Error())
+	}
+	publicPaths, err = parsePublicPaths(setting("PUBLIC_PATHS"))
+	if err != nil {
+		errs = append(errs, err.Error())
+	}
+	trustedProxies, err = parseTrustedProxies(setting("TRUSTED_PROXIES"))
+	if err != nil {
+		errs = append(errs, err.Error())
+	}
+	blockedCIDRs, err = parseCIDRs("BLOCKED_CIDRS", setting("BLOCKED_CIDRS"))
+	if err != nil {
+		errs = append(errs, err.Error())
+	}
+	trustedCIDRs, err = parseCIDRs("TRUSTED_CIDRS", setting("TRUSTED_CIDRS"))
+	if err != nil {
+		errs = append(errs, err.Error())
+	}
+	switch setting("TURNSTILE_MODE") {
+	case "", "normal":
+	case "bypass":
+		bypassVerification = true
+	default:
+		errs = append(errs, fmt.Sprintf(`TURNSTILE_MODE must be "normal" or "bypass", got %q`, setting("TURNSTILE_MODE")))
+	}
+	var allowBypass bool
+	allowBypass, err = getenvBool("ALLOW_INSECURE_BYPASS")
+	if err != nil {
+		errs = append(errs, err.Error())
+	}
+	if bypassVerification && gin.Mode() == gin.ReleaseMode && !allowBypass {
+		errs = append(errs, `TURNSTILE_MODE "bypass" is not allowed in release mode unless ALLOW_INSECURE_BYPASS is "true"`)
+	}
+
+	bindSession, err = getenvBool("BIND_SESSION")
+	if err != nil {
+		errs = append(errs, err.Error())
+	}
+	verifyEndpoint, err = getenvBool("DEDICATED_VERIFY_ENDPOINT")
+	if err != nil {
+		errs = append(errs, err.Error())
+	}
+	cookieSameSite, err = parseSameSite(setting("COOKIE_SAMESITE"))
+	if err != nil {
+		errs = append(errs, err.Error())
+	}
+	cookieSecure = true
+	if setting("COOKIE_SECURE") != "" {
+		cookieSecure, err = getenvBool("COOKIE_SECURE")
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if cookieName == "" {
+		cookieName = defaultCookieName
+	}
+	if !validCookieName(cookieName) {
+		errs = append(errs, fmt.Sprintf("COOKIE_NAME must be a valid cookie name (letters, digits, and symbols like - or _), got %q", cookieName))
+	}
+	if cookieSameSite == http.SameSiteNoneMode && !cookieSecure {
+		errs = append(errs, `COOKIE_SAMESITE "none" requires COOKIE_SECURE to be true`)
+	}
+
 	if bindAddr == "" {
 		errs = append(errs, "BIND_ADDR is not set")
 	}
 	if turnstileSecretKey == "" {
 		errs = append(errs, "TURNSTILE_SECRET_KEY is not set")
 	}
+	if verifyProvider == "" {
+		verifyProvider = verifier.TurnstileName
+	}
+	if !verifier.Registered(verifyProvider) {
+		errs = append(errs, fmt.Sprintf("VERIFY_PROVIDER must be one of %q", verifier.Names()))
+	}
+	if verifyProvider == verifier.TurnstileName && turnstileSecretKey != "" && !verifier.ValidTurnstileSecret(turnstileSecretKey) {
+		errs = append(errs, "TURNSTILE_SECRET_KEY doesn't look like a Turnstile secret key; check for typos or truncation")
+	}
+	if siteverifyURL != "" {
+		var u, err = url.Parse(siteverifyURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, "TURNSTILE_SITEVERIFY_URL must be an absolute http or https URL")
+		}
+	}
+	if turnstileKeysFile != "" {
+		hostKeys, err = loadHostKeys(turnstileKeysFile)
+		if err != nil {
+			errs = append(errs, "Unable to read TURNSTILE_KEYS_FILE: "+err.Error())
+		}
+		for host, conf := range hostKeys {
+			if verifyProvider == verifier.TurnstileName && !verifier.ValidTurnstileSecret(conf.SecretKey) {
+				errs = append(errs, fmt.Sprintf("TURNSTILE_KEYS_FILE: secret key for %q doesn't look like a Turnstile secret key", host))
+			}
+		}
+	}
 	if turnstileSiteKey == "" {
 		errs = append(errs, "TURNSTILE_SITE_KEY is not set")
 	}
@@ -31,14 +342,247 @@ func getenv() {
 	if proxyTarget == "" {
 		errs = append(errs, "PROXY_TARGET is not set")
 	}
-	if databaseDSN == "" {
-		errs = append(errs, "DATABASE_DSN is not set")
+	if proxyRoutesFile != "" {
+		proxyRoutes, err = loadRoutes(proxyRoutesFile)
+		if err != nil {
+			errs = append(errs, "Unable to read PROXY_ROUTES_FILE: "+err.Error())
+		}
+	}
+	errs = append(errs, getDatabaseEnv()...)
+	var logBuffer = setting("REQUEST_LOG_BUFFER")
+	if logBuffer != "" {
+		requestLogBuffer, err = strconv.Atoi(logBuffer)
+		if err != nil || requestLogBuffer < 0 {
+			errs = append(errs, fmt.Sprintf("REQUEST_LOG_BUFFER must be a non-negative integer, got %q", logBuffer))
+		}
+	}
+
+	geoipPaths = nil
+	for p := range strings.SplitSeq(setting("GEOIP_DB"), ",") {
+		p = strings.TrimSpace(p)
+		if p != "" {
+			geoipPaths = append(geoipPaths, p)
+		}
+	}
+	logOutcomes, err = parseLogOutcomes(setting("LOG_OUTCOMES"))
+	if err != nil {
+		errs = append(errs, err.Error())
+	}
+	logQueryParams = parseLogQueryParams(setting("REQUEST_LOG_QUERY_PARAMS"))
+	var logURLMax = setting("REQUEST_LOG_URL_MAX_LENGTH")
+	if logURLMax != "" {
+		logURLMaxLength, err = strconv.Atoi(logURLMax)
+		if err != nil || logURLMaxLength < 1 || logURLMaxLength > db.MaxURLLength {
+			errs = append(errs, fmt.Sprintf("REQUEST_LOG_URL_MAX_LENGTH must be between 1 and %d, got %q", db.MaxURLLength, logURLMax))
+			logURLMaxLength = 0
+		}
+	}
+
+	var maxBytes = setting("REQUEST_CACHE_MAX_BYTES")
+	if maxBytes != "" {
+		maxCachedBytes, err = strconv.ParseInt(maxBytes, 10, 64)
+		if err != nil || maxCachedBytes < 0 {
+			errs = append(errs, fmt.Sprintf("REQUEST_CACHE_MAX_BYTES must be a non-negative integer, got %q", maxBytes))
+		}
+	}
+
+	var maxItems = setting("REQUEST_CACHE_MAX_ITEMS")
+	if maxItems != "" {
+		maxCachedRequests, err = strconv.Atoi(maxItems)
+		if err != nil || maxCachedRequests < 0 {
+			errs = append(errs, fmt.Sprintf("REQUEST_CACHE_MAX_ITEMS must be a non-negative integer, got %q", maxItems))
+			maxCachedRequests = 0
+		}
+	}
+
+	maxURLLength = 8192
+	var maxURL = setting("MAX_URL_LENGTH")
+	if maxURL != "" {
+		maxURLLength, err = strconv.Atoi(maxURL)
+		if err != nil || maxURLLength < 0 {
+			errs = append(errs, fmt.Sprintf("MAX_URL_LENGTH must be a non-negative integer, got %q", maxURL))
+		}
+	}
+
+	cacheTTL = 5 * time.Minute
+	var ttl = setting("CACHE_TTL")
+	if ttl != "" {
+		cacheTTL, err = time.ParseDuration(ttl)
+		if err != nil || cacheTTL <= 0 {
+			errs = append(errs, fmt.Sprintf(`CACHE_TTL must be a positive duration like "15m", got %q`, ttl))
+		}
+	}
+
+	sessionRefreshWindow = defaultRefreshWindow
+	var window = setting("SESSION_REFRESH_WINDOW")
+	if window != "" {
+		sessionRefreshWindow, err = time.ParseDuration(window)
+		if err != nil || sessionRefreshWindow < 0 || sessionRefreshWindow >= tokenLifetime {
+			errs = append(errs, fmt.Sprintf(`SESSION_REFRESH_WINDOW must be a non-negative duration under %s, like "6h", got %q`, tokenLifetime, window))
+		}
+	}
+
+	sessionMaxAge = defaultMaxSessionAge
+	var maxAge = setting("SESSION_MAX_AGE")
+	if maxAge != "" {
+		sessionMaxAge, err = time.ParseDuration(maxAge)
+		if err != nil || sessionMaxAge < 0 {
+			errs = append(errs, fmt.Sprintf(`SESSION_MAX_AGE must be a non-negative duration like "168h", got %q`, maxAge))
+		}
+	}
+
+	var flush = setting("PROXY_FLUSH_INTERVAL")
+	if flush != "" {
+		flushInterval, err = time.ParseDuration(flush)
+		if err != nil || flushInterval < 0 {
+			errs = append(errs, fmt.Sprintf(`PROXY_FLUSH_INTERVAL must be a non-negative duration like "100ms", got %q`, flush))
+		}
+	}
+
+	var upstream = setting("UPSTREAM_TIMEOUT")
+	if upstream != "" {
+		upstreamTimeout, err = time.ParseDuration(upstream)
+		if err != nil || upstreamTimeout < 0 {
+			errs = append(errs, fmt.Sprintf(`UPSTREAM_TIMEOUT must be a non-negative duration like "30s", got %q`, upstream))
+		}
+	}
+
+	upstreamMaxIdleConns = defaultUpstreamMaxIdleConns
+	upstreamMaxIdleConnsPerHost = defaultUpstreamMaxIdleConnsPerHost
+	for _, n := range []struct {
+		key string
+		val *int
+	}{
+		{"UPSTREAM_MAX_IDLE_CONNS", &upstreamMaxIdleConns},
+		{"UPSTREAM_MAX_IDLE_CONNS_PER_HOST", &upstreamMaxIdleConnsPerHost},
+	} {
+		var val = setting(n.key)
+		if val == "" {
+			continue
+		}
+		*n.val, err = strconv.Atoi(val)
+		if err != nil || *n.val < 0 {
+			errs = append(errs, fmt.Sprintf("%s must be a non-negative integer, got %q", n.key, val))
+			*n.val = 0
+		}
+	}
+
+	upstreamIdleConnTimeout = defaultUpstreamIdleConnTimeout
+	var idleConn = setting("UPSTREAM_IDLE_CONN_TIMEOUT")
+	if idleConn != "" {
+		upstreamIdleConnTimeout, err = time.ParseDuration(idleConn)
+		if err != nil || upstreamIdleConnTimeout < 0 {
+			errs = append(errs, fmt.Sprintf(`UPSTREAM_IDLE_CONN_TIMEOUT must be a non-negative duration like "90s", got %q`, idleConn))
+			upstreamIdleConnTimeout = 0
+		}
+	}
+
+	upstreamInsecureTLS, err = getenvBool("UPSTREAM_INSECURE_SKIP_VERIFY")
+	if err != nil {
+		errs = append(errs, err.Error())
+	}
+
+	errs = append(errs, getServerTimeoutsEnv()...)
+
+	var threshold = setting("BREAKER_THRESHOLD")
+	if threshold != "" {
+		breakerThreshold, err = strconv.Atoi(threshold)
+		if err != nil || breakerThreshold < 0 {
+			errs = append(errs, fmt.Sprintf("BREAKER_THRESHOLD must be a non-negative integer, got %q", threshold))
+		}
+	}
+
+	breakerCooldown = defaultBreakerCooldown
+	var cooldown = setting("BREAKER_COOLDOWN")
+	if cooldown != "" {
+		breakerCooldown, err = time.ParseDuration(cooldown)
+		if err != nil || breakerCooldown <= 0 {
+			errs = append(errs, fmt.Sprintf(`BREAKER_COOLDOWN must be a positive duration like "30s", got %q`, cooldown))
+		}
+	}
+
+	var rps = setting("RATELIMIT_RPS")
+	if rps != "" {
+		rateLimitRPS, err = strconv.ParseFloat(rps, 64)
+		if err != nil || rateLimitRPS < 0 || math.IsInf(rateLimitRPS, 0) || math.IsNaN(rateLimitRPS) {
+			errs = append(errs, fmt.Sprintf("RATELIMIT_RPS must be a non-negative number, got %q", rps))
+		}
+	}
+
+	rateLimitBurst = 10
+	var burst = setting("RATELIMIT_BURST")
+	if burst != "" {
+		rateLimitBurst, err = strconv.Atoi(burst)
+		if err != nil || rateLimitBurst < 1 {
+			errs = append(errs, fmt.Sprintf("RATELIMIT_BURST must be a positive integer, got %q", burst))
+		}
+	}
+
+	var retention = setting("RETENTION_DAYS")
+	if retention != "" {
+		retentionDays, err = strconv.Atoi(retention)
+		if err != nil || retentionDays < 0 {
+			errs = append(errs, fmt.Sprintf("RETENTION_DAYS must be a non-negative integer, got %q", retention))
+		}
+	}
+
+	if postVerifyMode == "" {
+		postVerifyMode = postVerifyReplay
+	}
+	if postVerifyMode != postVerifyReplay && postVerifyMode != postVerifyRedirect {
+		errs = append(errs, fmt.Sprintf("POST_VERIFY_MODE must be %q or %q", postVerifyReplay, postVerifyRedirect))
+	}
+	if expectMode == "" {
+		expectMode = expectContinue
+	}
+	if expectMode != expectContinue && expectMode != expectReject {
+		errs = append(errs, fmt.Sprintf("EXPECT_CONTINUE_MODE must be %q or %q", expectContinue, expectReject))
+	}
+	if widgetAppearance == "" {
+		widgetAppearance = "always"
+	}
+	if !validAppearance(widgetAppearance) {
+		errs = append(errs, fmt.Sprintf("TURNSTILE_APPEARANCE must be one of %q", validAppearances))
+	}
+	if widgetTheme == "" {
+		widgetTheme = "auto"
+	}
+	if !validTheme(widgetTheme) {
+		errs = append(errs, fmt.Sprintf("TURNSTILE_THEME must be one of %q", validThemes))
+	}
+	if widgetFailureAppearance != "" && !validAppearance(widgetFailureAppearance) {
+		errs = append(errs, fmt.Sprintf("TURNSTILE_FAILURE_APPEARANCE must be one of %q", validAppearances))
+	}
+	assetsPath = setting("ASSETS_PATH")
+	if assetsPath != "" {
+		var info, err = os.Stat(assetsPath)
+		if err != nil || !info.IsDir() {
+			errs = append(errs, fmt.Sprintf("ASSETS_PATH %q is not a readable directory", assetsPath))
+		}
+	}
+	errs = append(errs, getMessagesEnv()...)
+	contentSecurityPolicy = setting("CONTENT_SECURITY_POLICY")
+	switch contentSecurityPolicy {
+	case "":
+		contentSecurityPolicy = defaultCSP
+	case "off":
+		contentSecurityPolicy = ""
+	default:
+		var _, err = parseCSP(contentSecurityPolicy)
+		if err != nil {
+			errs = append(errs, "CONTENT_SECURITY_POLICY is not a valid template: "+err.Error())
+		}
+	}
+	if verifiedHeader == "" {
+		verifiedHeader = defaultVerifiedHeader
+	}
+	if !httpguts.ValidHeaderFieldName(verifiedHeader) {
+		errs = append(errs, fmt.Sprintf("VERIFIED_HEADER must be a valid header name, got %q", verifiedHeader))
 	}
 	if templatePath == "" {
 		templatePath = "/var/local/tps/templates"
 	}
 
-	var err error
 	templatePath, err = filepath.Abs(templatePath)
 	if err != nil {
 		errs = append(errs, "Unable to get absolute path to templates: "+err.Error())
@@ -48,4 +592,8 @@ func getenv() {
 		logger.Error("Cannot start server", "error", strings.Join(errs, "; "))
 		os.Exit(1)
 	}
+
+	if bypassVerification {
+		logger.Warn(`TURNSTILE_MODE is "bypass": challenges are NOT verified and anybody can get a session; never use this in production!`)
+	}
 }
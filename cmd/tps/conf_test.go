@@ -0,0 +1,85 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGetServerTimeoutsEnv(t *testing.T) {
+	var tests = map[string]struct {
+		env     map[string]string
+		want    [4]time.Duration
+		wantErr string
+	}{
+		"defaults": {
+			want: [4]time.Duration{defaultReadHeaderTimeout, 0, 0, defaultIdleTimeout},
+		},
+		"all set": {
+			env:  map[string]string{"READ_HEADER_TIMEOUT": "5s", "READ_TIMEOUT": "1m", "WRITE_TIMEOUT": "2m", "IDLE_TIMEOUT": "30s"},
+			want: [4]time.Duration{5 * time.Second, time.Minute, 2 * time.Minute, 30 * time.Second},
+		},
+		"zero turns a default off": {
+			env:  map[string]string{"READ_HEADER_TIMEOUT": "0", "IDLE_TIMEOUT": "0s"},
+			want: [4]time.Duration{0, 0, 0, 0},
+		},
+		"bad duration": {
+			env:     map[string]string{"READ_HEADER_TIMEOUT": "soon"},
+			wantErr: "READ_HEADER_TIMEOUT",
+		},
+		"missing unit": {
+			env:     map[string]string{"WRITE_TIMEOUT": "30"},
+			wantErr: "WRITE_TIMEOUT",
+		},
+		"negative": {
+			env:     map[string]string{"IDLE_TIMEOUT": "-1s"},
+			wantErr: "IDLE_TIMEOUT",
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			for _, key := range []string{"READ_HEADER_TIMEOUT", "READ_TIMEOUT", "WRITE_TIMEOUT", "IDLE_TIMEOUT"} {
+				t.Setenv(key, tc.env[key])
+			}
+
+			var errs = getServerTimeoutsEnv()
+			if tc.wantErr != "" {
+				if len(errs) != 1 || !strings.Contains(errs[0], tc.wantErr) {
+					t.Errorf("got errors %q, want one about %s", errs, tc.wantErr)
+				}
+				return
+			}
+			if len(errs) != 0 {
+				t.Fatalf("got errors %q", errs)
+			}
+			var got = [4]time.Duration{readHeaderTimeout, readTimeout, writeTimeout, idleTimeout}
+			if got != tc.want {
+				t.Errorf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	var got, err = parseTrustedProxies(" 10.0.0.0/8, 192.0.2.1 ,,::1 ")
+	if err != nil {
+		t.Fatalf("parseTrustedProxies: %s", err)
+	}
+	var want = []string{"10.0.0.0/8", "192.0.2.1", "::1"}
+	if !slices.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	// Unset trusts nothing, rather than gin's default of everything
+	got, err = parseTrustedProxies("")
+	if err != nil || got != nil {
+		t.Errorf("got %q and error %v for an empty setting, want nothing", got, err)
+	}
+
+	_, err = parseTrustedProxies("10.0.0.0/8,proxy.local")
+	if err == nil || !strings.Contains(err.Error(), "proxy.local") {
+		t.Errorf("got error %v, want one about proxy.local", err)
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/goccy/go-yaml"
+)
+
+// settingKeys lists every setting which may appear in a config file. Each is
+// named exactly as its environment variable.
+var settingKeys = []string{
+	"ADMIN_PASS", "ADMIN_USER", "ALLOWED_ORIGINS", "ALLOW_INSECURE_BYPASS",
+	"ASSETS_PATH", "BIND_ADDR", "BIND_CHALLENGE_COOKIE", "BIND_SESSION",
+	"BLOCKED_CIDRS", "BREAKER_COOLDOWN", "BREAKER_THRESHOLD", "CACHE_TTL",
+	"CONTENT_SECURITY_POLICY", "COOKIE_DOMAIN", "COOKIE_NAME",
+	"COOKIE_SAMESITE", "COOKIE_SECURE", "DATABASE_DRIVER", "DATABASE_DSN",
+	"DEDICATED_VERIFY_ENDPOINT", "DEFAULT_LANGUAGE", "EXPECT_CONTINUE_MODE", "GEOIP_DB", "GIN_MODE",
+	"IDLE_TIMEOUT", "JWT_SIGNING_KEY", "LOG_FORMAT", "LOG_LEVEL", "LOG_OUTCOMES",
+	"MAINTENANCE", "MAX_URL_LENGTH", "MESSAGES_PATH", "POST_VERIFY_MODE",
+	"PROXY_FLUSH_INTERVAL", "PROXY_ROUTES_FILE", "PROXY_TARGET",
+	"PUBLIC_PATHS", "RATELIMIT_BURST", "RATELIMIT_RPS", "READ_HEADER_TIMEOUT",
+	"READ_TIMEOUT", "REQUEST_CACHE_MAX_BYTES", "REQUEST_CACHE_MAX_ITEMS",
+	"REQUEST_LOG_BUFFER", "REQUEST_LOG_QUERY_PARAMS",
+	"REQUEST_LOG_URL_MAX_LENGTH", "RETENTION_DAYS", "SESSION_MAX_AGE",
+	"SESSION_REFRESH_WINDOW", "STRICT_HEADERS",
+	"TEMPLATE_PATH", "TRUSTED_CIDRS", "TRUSTED_PROXIES", "TURNSTILE_APPEARANCE",
+	"TURNSTILE_CHECK_SECRET", "TURNSTILE_FAILURE_APPEARANCE",
+	"TURNSTILE_KEYS_FILE", "TURNSTILE_MODE", "TURNSTILE_SECRET_KEY",
+	"TURNSTILE_SITEVERIFY_URL", "TURNSTILE_SITE_KEY", "TURNSTILE_THEME",
+	"UPSTREAM_IDLE_CONN_TIMEOUT", "UPSTREAM_INSECURE_SKIP_VERIFY",
+	"UPSTREAM_MAX_IDLE_CONNS", "UPSTREAM_MAX_IDLE_CONNS_PER_HOST",
+	"UPSTREAM_TIMEOUT", "VERIFIED_HEADER", "VERIFY_PROVIDER", "WRITE_TIMEOUT",
+}
+
+// fileSettings holds the settings read from the config file, if any
+var fileSettings = map[string]string{}
+
+// setting returns the value of a setting: its environment variable if that's
+// set and non-empty, or else its value from the config file
+func setting(key string) string {
+	var val = os.Getenv(key)
+	if val != "" {
+		return val
+	}
+	return fileSettings[key]
+}
+
+// loadConfig reads the config file named by the --config flag in args, or by
+// TPS_CONFIG, if either is set. A bad file is fatal.
+func loadConfig(command string, args []string) {
+	var flags = flag.NewFlagSet(command, flag.ExitOnError)
+	var path = flags.String("config", os.Getenv("TPS_CONFIG"), "path to a YAML config file")
+	flags.Parse(args)
+	if *path == "" {
+		return
+	}
+
+	var err = readConfigFile(*path)
+	if err != nil {
+		logger.Error("Cannot read config file", "path", *path, "error", err)
+		os.Exit(1)
+	}
+
+	// gin reads GIN_MODE when it starts up, long before we get here
+	if os.Getenv("GIN_MODE") == "" && fileSettings["GIN_MODE"] != "" {
+		switch fileSettings["GIN_MODE"] {
+		case gin.DebugMode, gin.ReleaseMode, gin.TestMode:
+			gin.SetMode(fileSettings["GIN_MODE"])
+		default:
+			logger.Error("Cannot read config file", "path", *path, "error", fmt.Sprintf("GIN_MODE must be %q or %q", gin.DebugMode, gin.ReleaseMode))
+			os.Exit(1)
+		}
+	}
+	logger.Info("Read config file", "path", *path, "settings", len(fileSettings))
+}
+
+// readConfigFile reads a YAML config file into [fileSettings]. The file is a
+// flat mapping of setting names, as listed in [settingKeys], to values. Names
+// may also be lowercase (e.g., "proxy_target"). Lists, such as a list of
+// CIDRs, may be given as YAML sequences rather than comma-separated strings.
+func readConfigFile(path string) error {
+	var data, err = os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var raw map[string]any
+	err = yaml.Unmarshal(data, &raw)
+	if err != nil {
+		return err
+	}
+
+	var settings = make(map[string]string, len(raw))
+	for name, val := range raw {
+		var key = strings.ToUpper(name)
+		if !slices.Contains(settingKeys, key) {
+			return fmt.Errorf("unknown setting %q", name)
+		}
+		settings[key], err = settingValue(val)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	fileSettings = settings
+	return nil
+}
+
+// settingValue flattens a YAML value into the string its environment variable
+// would hold
+func settingValue(val any) (string, error) {
+	switch v := val.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case bool, int, int64, uint64, float64:
+		return fmt.Sprint(v), nil
+	case []any:
+		var items = make([]string, len(v))
+		for i, item := range v {
+			var s, err = settingValue(item)
+			if err != nil {
+				return "", err
+			}
+			if strings.Contains(s, ",") {
+				return "", fmt.Errorf("list item %q contains a comma", s)
+			}
+			items[i] = s
+		}
+		return strings.Join(items, ","), nil
+	}
+	return "", fmt.Errorf("must be a single value or a list, not %T", val)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"maps"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeConfig writes a config file with the given contents, and resets
+// [fileSettings] once the test is done
+func writeConfig(t *testing.T, contents string) string {
+	t.Helper()
+	var path = filepath.Join(t.TempDir(), "tps.yml")
+	var err = os.WriteFile(path, []byte(contents), 0o600)
+	if err != nil {
+		t.Fatalf("writing config: %s", err)
+	}
+	t.Cleanup(func() { fileSettings = map[string]string{} })
+	return path
+}
+
+func TestReadConfigFile(t *testing.T) {
+	var tests = map[string]struct {
+		yaml    string
+		want    map[string]string
+		wantErr string
+	}{
+		"uppercase keys": {
+			yaml: "PROXY_TARGET: http://app:8080\n",
+			want: map[string]string{"PROXY_TARGET": "http://app:8080"},
+		},
+		"lowercase keys": {
+			yaml: "proxy_target: http://app:8080\ncookie_name: tps\n",
+			want: map[string]string{"PROXY_TARGET": "http://app:8080", "COOKIE_NAME": "tps"},
+		},
+		"scalars": {
+			yaml: "bind_session: true\nratelimit_burst: 5\nratelimit_rps: 0.5\ncookie_domain:\n",
+			want: map[string]string{"BIND_SESSION": "true", "RATELIMIT_BURST": "5", "RATELIMIT_RPS": "0.5", "COOKIE_DOMAIN": ""},
+		},
+		"lists are flattened": {
+			yaml: "trusted_cidrs:\n  - 10.0.0.0/8\n  - 192.168.0.0/16\npublic_paths: [/health, /static/*]\n",
+			want: map[string]string{"TRUSTED_CIDRS": "10.0.0.0/8,192.168.0.0/16", "PUBLIC_PATHS": "/health,/static/*"},
+		},
+		"unknown key": {
+			yaml:    "proxy_target: http://app:8080\nproxy_targte: oops\n",
+			wantErr: `unknown setting "proxy_targte"`,
+		},
+		"comma in a list item": {
+			yaml:    "allowed_origins:\n  - https://a.edu,https://b.edu\n",
+			wantErr: "contains a comma",
+		},
+		"nested mapping": {
+			yaml:    "proxy_target:\n  url: http://app:8080\n",
+			wantErr: "proxy_target: must be a single value or a list",
+		},
+		"not YAML": {
+			yaml:    "proxy_target: [unclosed\n",
+			wantErr: "",
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var err = readConfigFile(writeConfig(t, tc.yaml))
+			if tc.want == nil {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("got error %v, want one mentioning %q", err, tc.wantErr)
+				}
+				if len(fileSettings) != 0 {
+					t.Errorf("a bad file left settings behind: %v", fileSettings)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("readConfigFile: %s", err)
+			}
+			if !maps.Equal(fileSettings, tc.want) {
+				t.Errorf("got settings %v, want %v", fileSettings, tc.want)
+			}
+		})
+	}
+}
+
+func TestSettingPrecedence(t *testing.T) {
+	var err = readConfigFile(writeConfig(t, "proxy_target: http://file:8080\ncookie_name: file-cookie\n"))
+	if err != nil {
+		t.Fatalf("readConfigFile: %s", err)
+	}
+
+	// The environment wins, unless it's empty
+	t.Setenv("PROXY_TARGET", "http://env:8080")
+	t.Setenv("COOKIE_NAME", "")
+	if got := setting("PROXY_TARGET"); got != "http://env:8080" {
+		t.Errorf("PROXY_TARGET = %q, want the environment's value", got)
+	}
+	if got := setting("COOKIE_NAME"); got != "file-cookie" {
+		t.Errorf("COOKIE_NAME = %q, want the file's value", got)
+	}
+	if got := setting("COOKIE_DOMAIN"); got != "" {
+		t.Errorf("COOKIE_DOMAIN = %q, want it unset", got)
+	}
+}
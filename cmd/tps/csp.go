@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"text/template"
+)
+
+// defaultCSP is the Content-Security-Policy sent with challenge pages unless
+// [Server.SetCSP] says otherwise. Scripts need the per-response nonce, and
+// the widget needs its provider's origin for the script and its iframe.
+const defaultCSP = "default-src 'self'; " +
+	"script-src 'nonce-{{.Nonce}}' {{.WidgetOrigin}}; " +
+	"frame-src {{.WidgetOrigin}}; " +
+	"style-src 'self' 'nonce-{{.Nonce}}'; " +
+	"base-uri 'none'; " +
+	"object-src 'none'"
+
+// cspData is what a CSP template can use
+type cspData struct {
+	Nonce        string
+	WidgetOrigin string
+}
+
+// parseCSP parses a Content-Security-Policy template
+func parseCSP(policy string) (*template.Template, error) {
+	return template.New("csp").Option("missingkey=error").Parse(policy)
+}
+
+// SetCSP sets the template for the Content-Security-Policy header sent with
+// challenge pages, and returns s for chaining. The template can use
+// "{{.Nonce}}", the nonce given to the challenge template as ".Nonce", and
+// "{{.WidgetOrigin}}", the origin of the provider's widget script. An empty
+// policy sends no header. A policy that doesn't parse will panic.
+func (s *Server) SetCSP(policy string) *Server {
+	if policy == "" {
+		s.csp = nil
+		return s
+	}
+
+	var t, err = parseCSP(policy)
+	if err != nil {
+		panic("invalid CSP template: " + err.Error())
+	}
+	s.csp = t
+	return s
+}
+
+// contentSecurityPolicy renders the CSP header for a challenge page using the
+// given nonce and widget script URL
+func (s *Server) contentSecurityPolicy(nonce, widgetScriptURL string) (string, error) {
+	var data = cspData{Nonce: nonce}
+	var u, err = url.Parse(widgetScriptURL)
+	if err == nil {
+		data.WidgetOrigin = u.Scheme + "://" + u.Host
+	}
+
+	var sb strings.Builder
+	err = s.csp.Execute(&sb, data)
+	return sb.String(), err
+}
+
+// cspUsesNonce returns true if the CSP restricts scripts or styles to the
+// per-response nonce, i.e., a template not using it would be blocked
+func (s *Server) cspUsesNonce() bool {
+	if s.csp == nil {
+		return false
+	}
+	const probe = "tps-nonce-probe"
+	var policy, err = s.contentSecurityPolicy(probe, "")
+	return err == nil && strings.Contains(policy, probe)
+}
+
+// checkNonces returns an error if a custom challenge template in ts has
+// script or style tags but never uses the nonce. The CSP would block every
+// one of them, leaving a challenge nobody can solve, so such a template is
+// refused when it's loaded instead of failing in browsers.
+func checkNonces(ts *templateSet) error {
+	for name, pth := range ts.names {
+		if strings.HasPrefix(name, "core/") || path.Base(name) != "challenge" {
+			continue
+		}
+
+		var src, err = os.ReadFile(pth)
+		if err != nil {
+			return fmt.Errorf("reading custom template: %w", err)
+		}
+		var lower = strings.ToLower(string(src))
+		var inline = strings.Contains(lower, "<script") || strings.Contains(lower, "<style")
+		if inline && !strings.Contains(string(src), ".Nonce") {
+			return fmt.Errorf("custom template %q has <script> or <style> tags but never uses .Nonce, so the Content-Security-Policy would block them: "+
+				`add nonce="{{.Nonce}}" to each tag, or change CONTENT_SECURITY_POLICY`, pth)
+		}
+	}
+	return nil
+}
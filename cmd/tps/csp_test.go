@@ -0,0 +1,72 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestChallengeNonceMatchesCSP(t *testing.T) {
+	var ts = startServer(t, newTestServer(newUpstream(t, nil).URL))
+
+	var resp, err = newClient(t).Get(ts.URL + "/page")
+	if err != nil {
+		t.Fatalf("GET /page: %s", err)
+	}
+	var body = readBody(t, resp)
+
+	var m = regexp.MustCompile(`script-src 'nonce-([^']+)'`).FindStringSubmatch(resp.Header.Get("Content-Security-Policy"))
+	if m == nil {
+		t.Fatalf("no script nonce in Content-Security-Policy %q", resp.Header.Get("Content-Security-Policy"))
+	}
+
+	var tags = regexp.MustCompile(`<(?:script|style)[^>]*>`).FindAllString(body, -1)
+	if len(tags) == 0 {
+		t.Fatalf("challenge page has no script or style tags")
+	}
+	var want = `nonce="` + m[1] + `"`
+	for _, tag := range tags {
+		if !strings.Contains(tag, want) {
+			t.Errorf("tag %s doesn't carry the header's nonce %s", tag, want)
+		}
+	}
+}
+
+func TestCustomTemplateNonceCheck(t *testing.T) {
+	var tests = map[string]struct {
+		template string
+		csp      string
+		wantErr  bool
+	}{
+		"inline script with nonce":    {`<script nonce="{{.Nonce}}">go()</script>`, defaultCSP, false},
+		"inline script without nonce": {`<script>go()</script>`, defaultCSP, true},
+		"inline style without nonce":  {`<style>p { color: red }</style>`, defaultCSP, true},
+		"no scripts or styles":        {`<p>{{.RequestID}}</p>`, defaultCSP, false},
+		"CSP off":                     {`<script>go()</script>`, "", false},
+		"CSP without nonce":           {`<script>go()</script>`, "script-src 'self' 'unsafe-inline'", false},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var dir = t.TempDir()
+			var err = os.MkdirAll(filepath.Join(dir, "example.edu"), 0o755)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = os.WriteFile(filepath.Join(dir, "example.edu", "challenge.go.html"), []byte(tc.template), 0o644)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var s = newTestServer("http://127.0.0.1:1").SetCSP(tc.csp)
+			s.Handler()
+			s.customTemplatePath = dir
+			err = s.ReloadTemplates()
+			if (err != nil) != tc.wantErr {
+				t.Errorf("got error %v, want error: %t", err, tc.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/patrickmn/go-cache"
+)
+
+// dedupeWindow is how long we remember a verification by its response token,
+// so a double-clicked or retried submission reuses the first verification's
+// outcome instead of asking the provider again. The provider would reject the
+// second call as a duplicate ("timeout-or-duplicate" for Turnstile), failing
+// a user who actually passed.
+const dedupeWindow = 30 * time.Second
+
+// verification tracks one in-flight or finished verification of a response
+// token. Its fields are only written before done is closed, and must only be
+// read after.
+type verification struct {
+	done        chan struct{}
+	requestID   string
+	originalURI string
+	success     bool
+}
+
+// startVerification registers a verification of token for requestID. If
+// token is already being (or was recently) verified, that verification is
+// returned with dup set, and the caller must not verify it again. Otherwise
+// the caller owns the returned verification and must close its done channel
+// once the outcome is known.
+func (s *Server) startVerification(token, requestID string) (v *verification, dup bool) {
+	v = &verification{done: make(chan struct{}), requestID: requestID}
+	var err = s.verifications.Add(token, v, cache.DefaultExpiration)
+	if err == nil {
+		return v, false
+	}
+
+	var prior, found = s.verifications.Get(token)
+	if !found {
+		// It expired between the two calls, which means it's old enough that
+		// the provider has to decide
+		return v, false
+	}
+	return prior.(*verification), true
+}
+
+// reuseVerification answers a duplicate submission of a response token by
+// waiting for the original verification to finish and reusing its outcome.
+// Only the outcome is reused: the original request was already replayed, and
+// replaying it again would hand the app a second copy of, say, a form post.
+// The client gets a fresh session cookie and is redirected to the original
+// URL instead, or in redirect mode to returnTo. A duplicate whose original
+// failed, or which claims a different request ID, is rejected.
+func (s *Server) reuseVerification(c *gin.Context, ver *verification, requestID, returnTo string) {
+	select {
+	case <-ver.done:
+	case <-c.Request.Context().Done():
+		return
+	}
+
+	if !ver.success || ver.requestID != requestID || ver.originalURI == "" {
+		s.logger.Warn("Rejecting duplicate response that doesn't match a passed verification", "requestID", requestID, "originalRequestID", ver.requestID)
+		s.html(c, http.StatusForbidden, "failed", nil)
+		return
+	}
+
+	s.logger.Info("Duplicate submission of a verified response, reusing the verification", "requestID", requestID)
+	accessFor(c).outcome = outcomeVerified
+	var token, err = s.issueToken(c, time.Now(), requestID)
+	if err != nil {
+		s.logger.Error("Failed to sign JWT", "error", err)
+		c.String(http.StatusInternalServerError, "Failed to create session")
+		return
+	}
+
+	if s.postVerifyMode == postVerifyRedirect {
+		s.redirectWithToken(c, returnTo, token)
+		return
+	}
+	c.Redirect(http.StatusSeeOther, ver.originalURI)
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestDuplicateSubmissionReusesOutcome(t *testing.T) {
+	var up = newUpstream(t, nil)
+	var s = newTestServer(up.URL)
+	var ts = startServer(t, s)
+	var client = newClient(t)
+
+	var action, form = challengeForm(t, client, ts.URL+"/page?x=1")
+	var sv = newSiteverify(t, map[string]any{
+		"success": true,
+		"action":  challengeAction("/page"),
+		"cdata":   form.Get("request_id"),
+	})
+	s.SetVerifier(sv.verifier())
+	form.Set("cf-turnstile-response", "response-token")
+
+	var resp = postForm(t, client, action, form)
+	readBody(t, resp)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("first submission: got status %d, want 200", resp.StatusCode)
+	}
+
+	// A double-click's second submission is sent before the first one's
+	// session cookie arrives
+	resp = postForm(t, newClient(t), action, form)
+	readBody(t, resp)
+	if resp.StatusCode != http.StatusSeeOther {
+		t.Fatalf("duplicate submission: got status %d, want 303", resp.StatusCode)
+	}
+	if got := resp.Header.Get("Location"); got != "/page?x=1" {
+		t.Errorf("duplicate submission redirected to %q, want %q", got, "/page?x=1")
+	}
+	var gotCookie bool
+	for _, c := range resp.Cookies() {
+		gotCookie = gotCookie || c.Name == defaultCookieName && c.Value != ""
+	}
+	if !gotCookie {
+		t.Errorf("duplicate submission didn't get a session cookie")
+	}
+
+	if got := sv.calls.Load(); got != 1 {
+		t.Errorf("siteverify was called %d times, want 1", got)
+	}
+	if got := up.hits.Load(); got != 1 {
+		t.Errorf("upstream got %d requests, want 1", got)
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// expectClient sends a POST with "Expect: 100-continue" over a raw
+// connection, so the interim response can be seen. It writes the headers,
+// then reads the first status line; the body is only sent if that's a 100.
+// It returns the interim status (0 if there wasn't one) and the final
+// response.
+func expectClient(t *testing.T, rawURL, cookie, body string) (interim int, resp *http.Response) {
+	t.Helper()
+	var u, _ = url.Parse(rawURL)
+	var conn, err = net.Dial("tcp", u.Host)
+	if err != nil {
+		t.Fatalf("dialing %s: %s", u.Host, err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	var head = fmt.Sprintf("POST %s HTTP/1.1\r\nHost: %s\r\nContent-Type: text/plain\r\nContent-Length: %d\r\nExpect: 100-continue\r\n", u.RequestURI(), u.Host, len(body))
+	if cookie != "" {
+		head += "Cookie: " + cookie + "\r\n"
+	}
+	io.WriteString(conn, head+"\r\n")
+
+	var r = bufio.NewReader(conn)
+	resp, err = http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatalf("reading response: %s", err)
+	}
+	if resp.StatusCode != http.StatusContinue {
+		return 0, resp
+	}
+
+	io.WriteString(conn, body)
+	resp, err = http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatalf("reading final response: %s", err)
+	}
+	return http.StatusContinue, resp
+}
+
+func TestExpectContinue(t *testing.T) {
+	var up = newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		var b, _ = io.ReadAll(r.Body)
+		fmt.Fprintf(w, "got %q", b)
+	})
+
+	var tests = map[string]struct {
+		mode        string
+		verified    bool
+		wantInterim int
+		wantStatus  int
+		wantBody    string
+	}{
+		"continue mode, challenged": {
+			mode:        expectContinue,
+			wantInterim: http.StatusContinue,
+			wantStatus:  http.StatusOK,
+			wantBody:    `name="request_id"`,
+		},
+		"reject mode, challenged": {
+			mode:       expectReject,
+			wantStatus: http.StatusExpectationFailed,
+		},
+		"reject mode, verified": {
+			mode:        expectReject,
+			verified:    true,
+			wantInterim: http.StatusContinue,
+			wantStatus:  http.StatusOK,
+			wantBody:    `got "hello"`,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var s = newTestServer(up.URL).SetExpectMode(tc.mode)
+			var ts = startServer(t, s)
+			var hits = up.hits.Load()
+
+			var cookie string
+			if tc.verified {
+				cookie = s.cookieName + "=" + signSession(t, time.Now(), time.Now().Add(time.Hour))
+			}
+			var interim, resp = expectClient(t, ts.URL+"/upload", cookie, "hello")
+			var body = readBody(t, resp)
+
+			if interim != tc.wantInterim {
+				t.Errorf("got interim status %d, want %d", interim, tc.wantInterim)
+			}
+			if resp.StatusCode != tc.wantStatus {
+				t.Errorf("got status %d, want %d", resp.StatusCode, tc.wantStatus)
+			}
+			if !strings.Contains(body, tc.wantBody) {
+				t.Errorf("got body %q, want it to contain %q", body, tc.wantBody)
+			}
+			var proxied = up.hits.Load() > hits
+			if proxied != tc.verified {
+				t.Errorf("got proxied %t, want %t", proxied, tc.verified)
+			}
+		})
+	}
+}
+
+func TestExpectContinueReplaysBody(t *testing.T) {
+	var up = newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		var b, _ = io.ReadAll(r.Body)
+		fmt.Fprintf(w, "got %q", b)
+	})
+	var s = newTestServer(up.URL).SetBypass(true)
+	var ts = startServer(t, s)
+
+	// The body sent after the 100 is what's replayed once the challenge is
+	// passed
+	var _, resp = expectClient(t, ts.URL+"/upload", "", "hello")
+	var form = hiddenFields(readBody(t, resp))
+	resp = postForm(t, newClient(t), ts.URL+"/upload", form)
+	if body := readBody(t, resp); body != `got "hello"` {
+		t.Errorf("replay got body %q, want the original body", body)
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+
+	"github.com/gin-gonic/gin"
+)
+
+// signOriginal signs the original method and request URI given to the
+// challenge form, so we can trust them if the cached request expires
+func (s *Server) signOriginal(method, uri string) string {
+	return s.sign("tps-original", method+" "+uri)
+}
+
+// originalRequest returns the original method and request URI from the
+// challenge form, as long as they're properly signed and the URI is a local
+// path. Forms without them, e.g., from custom templates that predate them,
+// fall back to a GET of the URL the form was posted to, which is the original
+// URL in every template we ship. That fallback is useless for forms posted to
+// [verifyPath], so those get an empty method, which can't be rebuilt.
+func (s *Server) originalRequest(c *gin.Context) (method string, uri string) {
+	method = c.PostForm("original_method")
+	uri = c.PostForm("original_url")
+	var sig = c.PostForm("original_sig")
+	if method != "" && validLocalPath(uri) && s.validSignature("tps-original", method+" "+uri, sig) {
+		return method, uri
+	}
+	if isReserved(c.Request.URL.Path) {
+		return "", ""
+	}
+	return http.MethodGet, c.Request.URL.RequestURI()
+}
+
+// recoverExpired handles a verification POST whose cached request is gone.
+// Bodyless requests like GETs are rebuilt from the form's original method and
+// URL and challenged again under a fresh request ID, so the user just solves
+// another challenge. Requests with a body can't be rebuilt, so the user is
+// asked to go back and resubmit.
+func (s *Server) recoverExpired(c *gin.Context, requestID string) {
+	var method, uri = s.originalRequest(c)
+	if !bodylessMethods[method] {
+		s.logger.Warn("Cached request expired before verification, asking client to resubmit", "requestID", requestID, "method", method)
+		accessFor(c).outcome = outcomeExpired
+		s.html(c, http.StatusGone, "expired", nil)
+		return
+	}
+
+	var u, err = url.ParseRequestURI(uri)
+	if err != nil {
+		u = c.Request.URL
+	}
+
+	s.logger.Warn("Cached request expired before verification, re-serving challenge", "requestID", requestID, "method", method)
+	var retry = newCachedRequest(c.Request, nil)
+	retry.Method = method
+	retry.URL = u
+	retry.Headers.Del("Content-Type")
+	retry.Headers.Del("Content-Length")
+	s.presentChallenge(c, retry, "challenge.session_expired")
+}
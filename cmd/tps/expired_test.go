@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRecoverExpired(t *testing.T) {
+	const ttl = 50 * time.Millisecond
+	var up = newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Method + " " + r.URL.RequestURI()))
+	})
+	var s = newTestServer(up.URL).SetBypass(true).SetCacheTTL(ttl)
+	var ts = startServer(t, s)
+
+	t.Run("GET is challenged again", func(t *testing.T) {
+		var client = newClient(t)
+		var action, form = challengeForm(t, client, ts.URL+"/page?x=1")
+		time.Sleep(ttl + ttl/2)
+
+		var resp = postForm(t, client, action, form)
+		var body = readBody(t, resp)
+		if resp.StatusCode != http.StatusOK || !strings.Contains(body, "Your session expired") {
+			t.Fatalf("got status %d and body %q, want a fresh challenge saying the session expired", resp.StatusCode, body)
+		}
+		var retry = hiddenFields(body)
+		if id := retry.Get("request_id"); id == "" || id == form.Get("request_id") {
+			t.Errorf("fresh challenge has request ID %q, want a new one", id)
+		}
+
+		// Passing the new challenge gets the original request
+		resp = postForm(t, client, action, retry)
+		body = readBody(t, resp)
+		if resp.StatusCode != http.StatusOK || body != "GET /page?x=1" {
+			t.Errorf("after the fresh challenge: got status %d and body %q, want the original GET", resp.StatusCode, body)
+		}
+	})
+
+	t.Run("POST must be resubmitted", func(t *testing.T) {
+		var client = newClient(t)
+		var resp, err = client.Post(ts.URL+"/form", "application/x-www-form-urlencoded", strings.NewReader("name=value"))
+		if err != nil {
+			t.Fatalf("POST: %s", err)
+		}
+		var form = hiddenFields(readBody(t, resp))
+		time.Sleep(ttl + ttl/2)
+
+		var hits = up.hits.Load()
+		resp = postForm(t, client, ts.URL+"/form", form)
+		readBody(t, resp)
+		if resp.StatusCode != http.StatusGone {
+			t.Errorf("got status %d, want 410", resp.StatusCode)
+		}
+		if got := up.hits.Load() - hits; got != 0 {
+			t.Errorf("upstream got %d requests, want none", got)
+		}
+	})
+
+	t.Run("tampered original isn't trusted", func(t *testing.T) {
+		var client = newClient(t)
+		var action, form = challengeForm(t, client, ts.URL+"/page")
+		form.Set("original_url", "/elsewhere")
+		time.Sleep(ttl + ttl/2)
+
+		// The bad signature means the form's own URL is challenged instead
+		var resp = postForm(t, client, action, form)
+		var retry = hiddenFields(readBody(t, resp))
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("got status %d, want a fresh challenge", resp.StatusCode)
+		}
+		if got := retry.Get("original_url"); got != "/page" {
+			t.Errorf("fresh challenge is for %q, want /page", got)
+		}
+	})
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"net/netip"
+	"turnstile-proxy-server/internal/db"
+	"turnstile-proxy-server/internal/geoip"
+
+	"github.com/gin-gonic/gin"
+)
+
+// SetGeoIP sets the database used to record each logged request's country and
+// ASN, and returns s for chaining. nil (the default) skips the lookups.
+func (s *Server) SetGeoIP(g *geoip.DB) *Server {
+	s.geoip = g
+	return s
+}
+
+// logRequest writes log to the request log database, adding the client's
+// country and ASN if GeoIP is configured
+func (s *Server) logRequest(c *gin.Context, log db.RequestLog) {
+	if s.geoip != nil {
+		var ip, err = netip.ParseAddr(c.ClientIP())
+		if err == nil {
+			var info geoip.Info
+			info, err = s.geoip.Lookup(ip)
+			if err != nil {
+				s.logger.Warn("GeoIP lookup failed", "clientIP", ip, "error", err)
+			}
+			log.Country = info.Country
+			log.ASN = info.ASN
+		}
+	}
+	s.db.LogRequest(c.Request.Context(), log)
+}
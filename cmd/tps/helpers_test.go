@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/json"
+	"html"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"turnstile-proxy-server/internal/db"
+	"turnstile-proxy-server/internal/verifier"
+
+	"github.com/gin-gonic/gin"
+)
+
+// testSigningKey signs session tokens issued by test servers
+const testSigningKey = "0123456789abcdef0123456789abcdef"
+
+func TestMain(m *testing.M) {
+	gin.SetMode(gin.ReleaseMode)
+	os.Exit(m.Run())
+}
+
+// newTestServer returns a server proxying to target. It logs nothing to the
+// database, and its cookies aren't marked Secure so a test client will send
+// them back over plain HTTP.
+func newTestServer(target string) *Server {
+	return newTestServerOn(gin.New(), target)
+}
+
+// newTestServerOn is [newTestServer] with the given router, e.g., one with
+// trusted proxies set
+func newTestServerOn(router *gin.Engine, target string) *Server {
+	return NewServer(router, &db.Store{}).
+		SetLogger(slog.New(slog.DiscardHandler)).
+		SetProxyTarget(target).
+		SetJWTSigningKey(testSigningKey).
+		SetLogOutcomes([]string{}).
+		SetCookieOptions("", http.SameSiteLaxMode, false)
+}
+
+// startServer starts s on a test server which is closed when the test ends
+func startServer(t *testing.T, s *Server) *httptest.Server {
+	t.Helper()
+	var ts = httptest.NewServer(s.Handler())
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+// upstream is a test backend which counts the requests it gets
+type upstream struct {
+	*httptest.Server
+	hits atomic.Int64
+}
+
+// newUpstream starts a backend answering with h, or a plain 200 if h is nil
+func newUpstream(t *testing.T, h http.HandlerFunc) *upstream {
+	t.Helper()
+	var u = &upstream{}
+	u.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u.hits.Add(1)
+		if h == nil {
+			io.WriteString(w, "upstream ok")
+			return
+		}
+		h(w, r)
+	}))
+	t.Cleanup(u.Close)
+	return u
+}
+
+// siteverify is a stub of Turnstile's siteverify API which counts the calls
+// it gets. While failing is set, every call gets a 500.
+type siteverify struct {
+	*httptest.Server
+	calls   atomic.Int64
+	failing atomic.Bool
+}
+
+// newSiteverify starts a siteverify stub answering every call with the JSON
+// encoding of resp
+func newSiteverify(t *testing.T, resp map[string]any) *siteverify {
+	t.Helper()
+	var sv = &siteverify{}
+	sv.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		sv.calls.Add(1)
+		if sv.failing.Load() {
+			http.Error(w, "siteverify is down", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	}))
+	t.Cleanup(sv.Close)
+	return sv
+}
+
+// verifier returns a Turnstile verifier which asks the stub
+func (sv *siteverify) verifier() verifier.Verifier {
+	return verifier.NewTurnstile(verifier.Config{
+		SiteKey:   "test-site-key",
+		SecretKey: "test-secret-key",
+		Endpoint:  sv.URL,
+		Logger:    slog.New(slog.DiscardHandler),
+	})
+}
+
+// newClient returns a client which keeps cookies and doesn't follow redirects
+func newClient(t *testing.T) *http.Client {
+	t.Helper()
+	var jar, err = cookiejar.New(nil)
+	if err != nil {
+		t.Fatalf("cookiejar.New: %s", err)
+	}
+	return &http.Client{
+		Jar: jar,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+var (
+	formActionRE  = regexp.MustCompile(`<form action="([^"]*)"`)
+	hiddenInputRE = regexp.MustCompile(`<input type="hidden" name="([^"]+)" value="([^"]*)"`)
+)
+
+// challengeForm gets rawURL, which must be challenged, and returns the
+// absolute URL the challenge form posts to and its hidden fields
+func challengeForm(t *testing.T, client *http.Client, rawURL string) (action string, form url.Values) {
+	t.Helper()
+	var resp, err = client.Get(rawURL)
+	if err != nil {
+		t.Fatalf("GET %s: %s", rawURL, err)
+	}
+	var body = readBody(t, resp)
+	var m = formActionRE.FindStringSubmatch(body)
+	if resp.StatusCode != http.StatusOK || m == nil {
+		t.Fatalf("GET %s: got status %d and body %q, want a challenge", rawURL, resp.StatusCode, body)
+	}
+	var base, _ = url.Parse(rawURL)
+	var ref, _ = url.Parse(html.UnescapeString(m[1]))
+	action = base.ResolveReference(ref).String()
+
+	return action, hiddenFields(body)
+}
+
+// hiddenFields returns the hidden form fields in a challenge page
+func hiddenFields(body string) url.Values {
+	var form = url.Values{}
+	for _, m := range hiddenInputRE.FindAllStringSubmatch(body, -1) {
+		form.Set(m[1], html.UnescapeString(m[2]))
+	}
+	return form
+}
+
+// postForm posts form to rawURL as a browser submitting the challenge form
+// on the same origin would
+func postForm(t *testing.T, client *http.Client, rawURL string, form url.Values) *http.Response {
+	t.Helper()
+	var req, err = http.NewRequest(http.MethodPost, rawURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		t.Fatalf("building POST %s: %s", rawURL, err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	var u, _ = url.Parse(rawURL)
+	req.Header.Set("Origin", u.Scheme+"://"+u.Host)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("POST %s: %s", rawURL, err)
+	}
+	return resp
+}
+
+// verifiedClient returns a client holding a session from passing the
+// challenge for rawURL, which must be served by a server in bypass mode
+func verifiedClient(t *testing.T, rawURL string) *http.Client {
+	t.Helper()
+	var client = newClient(t)
+	var action, form = challengeForm(t, client, rawURL)
+	var resp = postForm(t, client, action, form)
+	readBody(t, resp)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("verifying %s: got status %d, want 200", rawURL, resp.StatusCode)
+	}
+	return client
+}
+
+// readBody reads and closes resp's body
+func readBody(t *testing.T, resp *http.Response) string {
+	t.Helper()
+	defer resp.Body.Close()
+	var b, err = io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("reading response body: %s", err)
+	}
+	return string(b)
+}
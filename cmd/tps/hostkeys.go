@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"turnstile-proxy-server/internal/verifier"
+)
+
+// loadHostKeys reads per-host site/secret key pairs from the file at path.
+// Each non-blank line that doesn't start with "#" must have exactly three
+// whitespace-separated fields: hostname (no port), site key, and secret key.
+func loadHostKeys(path string) (map[string]verifier.Config, error) {
+	var f, err = os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var keys = make(map[string]verifier.Config)
+	var scanner = bufio.NewScanner(f)
+	var lineNum = 0
+	for scanner.Scan() {
+		lineNum++
+		var line = strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		var fields = strings.Fields(line)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("%s:%d: expected hostname, site key, and secret key, got %d fields", path, lineNum, len(fields))
+		}
+		var host = strings.ToLower(fields[0])
+		if _, exists := keys[host]; exists {
+			return nil, fmt.Errorf("%s:%d: duplicate entry for host %q", path, lineNum, host)
+		}
+		keys[host] = verifier.Config{SiteKey: fields[1], SecretKey: fields[2]}
+	}
+
+	return keys, scanner.Err()
+}
+
+// requestHost returns the hostname, without port, that the client asked for
+func requestHost(r *http.Request) string {
+	if r.URL.Hostname() != "" {
+		return strings.ToLower(r.URL.Hostname())
+	}
+
+	var host, _, err = net.SplitHostPort(r.Host)
+	if err != nil {
+		host = r.Host
+	}
+	return strings.ToLower(host)
+}
+
+// verifierFor returns the host-specific verifier for r's hostname if there is
+// one, otherwise the default verifier
+func (s *Server) verifierFor(r *http.Request) verifier.Verifier {
+	var v, ok = s.hostVerifiers[requestHost(r)]
+	if ok {
+		return v
+	}
+	return s.verifier
+}
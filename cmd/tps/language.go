@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net/http"
+	"turnstile-proxy-server/internal/i18n"
+
+	"github.com/gin-gonic/gin"
+)
+
+// SetMessages sets the message catalogs used to localize TPS's pages and
+// returns s for chaining
+func (s *Server) SetMessages(messages *i18n.Catalog) *Server {
+	if messages == nil {
+		panic("nil message catalog")
+	}
+	s.messages = messages
+	return s
+}
+
+// language returns the catalog language best matching the request's
+// Accept-Language header
+func (s *Server) language(r *http.Request) string {
+	return s.messages.Negotiate(r.Header.Get("Accept-Language"))
+}
+
+// localize adds the client's language to data as "Lang", and a function
+// translating message keys into it as "T", so templates can use
+// {{call .T "failed.heading"}}. The response's Content-Language is set to
+// match.
+func (s *Server) localize(c *gin.Context, data any) any {
+	var h gin.H
+	switch d := data.(type) {
+	case nil:
+		h = gin.H{}
+	case gin.H:
+		h = d
+	default:
+		return data
+	}
+
+	var lang = s.language(c.Request)
+	h["Lang"] = lang
+	h["T"] = s.messages.Translator(lang)
+	c.Header("Content-Language", lang)
+	c.Header("Vary", "Accept-Language")
+	return h
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"turnstile-proxy-server/internal/i18n"
+)
+
+func TestChallengeLanguage(t *testing.T) {
+	var spanishDefault, err = i18n.Load("es", i18n.FS)
+	if err != nil {
+		t.Fatalf("loading messages: %s", err)
+	}
+
+	var tests = map[string]struct {
+		messages       *i18n.Catalog
+		acceptLanguage string
+		wantLang       string
+		wantHeading    string
+	}{
+		"no preference":         {i18n.Default(), "", "en", "Verifying browser"},
+		"Spanish":               {i18n.Default(), "es-MX,es;q=0.9,en;q=0.8", "es", "Verificando el navegador"},
+		"unknown language":      {i18n.Default(), "fr", "en", "Verifying browser"},
+		"default language":      {spanishDefault, "fr", "es", "Verificando el navegador"},
+		"default not preferred": {spanishDefault, "en", "en", "Verifying browser"},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var ts = startServer(t, newTestServer(newUpstream(t, nil).URL).SetMessages(tc.messages))
+			var req, _ = http.NewRequest(http.MethodGet, ts.URL+"/page", nil)
+			if tc.acceptLanguage != "" {
+				req.Header.Set("Accept-Language", tc.acceptLanguage)
+			}
+			var resp, err = http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("GET: %s", err)
+			}
+			var body = readBody(t, resp)
+
+			if got := resp.Header.Get("Content-Language"); got != tc.wantLang {
+				t.Errorf("got Content-Language %q, want %q", got, tc.wantLang)
+			}
+			if got := resp.Header.Get("Vary"); !strings.Contains(got, "Accept-Language") {
+				t.Errorf("got Vary %q, want it to include Accept-Language", got)
+			}
+			if !strings.Contains(body, tc.wantHeading) {
+				t.Errorf("challenge page doesn't contain %q", tc.wantHeading)
+			}
+		})
+	}
+}
+
+func TestGetMessagesEnv(t *testing.T) {
+	var custom = t.TempDir()
+	var err = os.WriteFile(filepath.Join(custom, "fr.json"), []byte(`{"challenge.title": "Vérification du navigateur"}`), 0o600)
+	if err != nil {
+		t.Fatalf("writing messages: %s", err)
+	}
+
+	var tests = map[string]struct {
+		defaultLanguage string
+		messagesPath    string
+		wantFallback    string
+		wantErr         string
+	}{
+		"defaults to English":     {wantFallback: "en"},
+		"built-in language":       {defaultLanguage: "es", wantFallback: "es"},
+		"case doesn't matter":     {defaultLanguage: "ES", wantFallback: "es"},
+		"unknown language":        {defaultLanguage: "fr", wantErr: `no messages for default language "fr"`},
+		"custom language":         {defaultLanguage: "fr", messagesPath: custom, wantFallback: "fr"},
+		"missing messages path":   {messagesPath: filepath.Join(custom, "nope"), wantErr: "is not a readable directory"},
+		"messages path is a file": {messagesPath: filepath.Join(custom, "fr.json"), wantErr: "is not a readable directory"},
+	}
+
+	var saved = messages
+	t.Cleanup(func() { messages = saved })
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Setenv("DEFAULT_LANGUAGE", tc.defaultLanguage)
+			t.Setenv("MESSAGES_PATH", tc.messagesPath)
+
+			var errs = getMessagesEnv()
+			if tc.wantErr != "" {
+				if len(errs) == 0 || !strings.Contains(errs[0], tc.wantErr) {
+					t.Errorf("got errors %q, want one containing %q", errs, tc.wantErr)
+				}
+				return
+			}
+			if len(errs) != 0 {
+				t.Fatalf("got errors %q", errs)
+			}
+			if got := messages.Fallback(); got != tc.wantFallback {
+				t.Errorf("got fallback %q, want %q", got, tc.wantFallback)
+			}
+		})
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Kinds of request log, which LOG_OUTCOMES chooses among. Challenges are
+// logged once they're answered, as passed or failed, rather than when served.
+const (
+	logValidToken      = "valid-token"      // proxied with a valid session token
+	logTrusted         = "trusted"          // proxied because the client is in a trusted CIDR
+	logBlocked         = "blocked"          // refused because the client is in a blocked CIDR
+	logChallengePassed = "challenge-passed" // verification succeeded
+	logChallengeFailed = "challenge-failed" // verification failed or was rejected
+)
+
+// logKinds lists every kind of request log
+var logKinds = []string{logValidToken, logTrusted, logBlocked, logChallengePassed, logChallengeFailed}
+
+// logChallengePresented looks like a kind of request log, but serving a
+// challenge is never logged, so it's refused with an explanation rather than
+// a bare "unknown kind"
+const logChallengePresented = "challenge-presented"
+
+// parseLogOutcomes splits a comma-separated LOG_OUTCOMES value, validating
+// each kind. Empty or "all" returns nil, meaning every kind is logged, and
+// "none" returns an empty list.
+func parseLogOutcomes(val string) ([]string, error) {
+	switch strings.TrimSpace(val) {
+	case "", "all":
+		return nil, nil
+	case "none":
+		return []string{}, nil
+	}
+
+	var kinds = []string{}
+	for _, k := range strings.Split(val, ",") {
+		k = strings.TrimSpace(k)
+		if k == "" {
+			continue
+		}
+		if k == logChallengePresented {
+			return nil, fmt.Errorf("LOG_OUTCOMES: %q isn't supported: challenges are logged when they're answered, as %q or %q", k, logChallengePassed, logChallengeFailed)
+		}
+		if !slices.Contains(logKinds, k) {
+			return nil, fmt.Errorf("LOG_OUTCOMES: %q is not one of %q", k, logKinds)
+		}
+		kinds = append(kinds, k)
+	}
+	return kinds, nil
+}
+
+// SetLogOutcomes chooses which kinds of request are written to the request
+// log database, and returns s for chaining. nil logs every kind; an empty
+// list logs none. Unknown kinds panic.
+func (s *Server) SetLogOutcomes(kinds []string) *Server {
+	if kinds == nil {
+		s.logOutcomes = nil
+		return s
+	}
+
+	s.logOutcomes = make(map[string]bool, len(kinds))
+	for _, k := range kinds {
+		if !slices.Contains(logKinds, k) {
+			panic(fmt.Sprintf("unknown request log kind %q", k))
+		}
+		s.logOutcomes[k] = true
+	}
+	return s
+}
+
+// shouldLog returns true if requests of the given kind are written to the
+// request log database
+func (s *Server) shouldLog(kind string) bool {
+	return s.logOutcomes == nil || s.logOutcomes[kind]
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParseLogOutcomes(t *testing.T) {
+	var tests = map[string]struct {
+		val     string
+		want    []string
+		wantErr string
+	}{
+		"unset":               {val: "", want: nil},
+		"all":                 {val: " all ", want: nil},
+		"none":                {val: "none", want: []string{}},
+		"one kind":            {val: "blocked", want: []string{logBlocked}},
+		"several kinds":       {val: "challenge-passed, challenge-failed,,blocked", want: []string{logChallengePassed, logChallengeFailed, logBlocked}},
+		"unknown kind":        {val: "valid-token,bogus", wantErr: `"bogus" is not one of`},
+		"challenge presented": {val: "challenge-presented,challenge-failed", wantErr: "challenges are logged when they're answered"},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var got, err = parseLogOutcomes(tc.val)
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Errorf("got error %v, want one containing %q", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseLogOutcomes(%q): %s", tc.val, err)
+			}
+			if (got == nil) != (tc.want == nil) || !slices.Equal(got, tc.want) {
+				t.Errorf("got %#v, want %#v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestShouldLog(t *testing.T) {
+	var s = newTestServer("http://127.0.0.1:1")
+	if s.shouldLog(logChallengeFailed) {
+		t.Errorf("logged a challenge failure with no kinds chosen")
+	}
+
+	s.SetLogOutcomes([]string{logChallengeFailed})
+	if !s.shouldLog(logChallengeFailed) || s.shouldLog(logValidToken) {
+		t.Errorf("with only %q chosen, got %t for it and %t for %q", logChallengeFailed, s.shouldLog(logChallengeFailed), s.shouldLog(logValidToken), logValidToken)
+	}
+
+	s.SetLogOutcomes(nil)
+	for _, k := range logKinds {
+		if !s.shouldLog(k) {
+			t.Errorf("%q isn't logged with every kind chosen", k)
+		}
+	}
+}
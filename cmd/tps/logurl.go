@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"turnstile-proxy-server/internal/db"
+)
+
+// parseLogQueryParams reads the REQUEST_LOG_QUERY_PARAMS setting: empty or
+// "*" keeps whole query strings (nil), "none" drops them (an empty list), and
+// anything else is a comma-separated list of the parameter names to keep
+func parseLogQueryParams(val string) []string {
+	switch strings.TrimSpace(val) {
+	case "", "*":
+		return nil
+	case "none":
+		return []string{}
+	}
+
+	var params = []string{}
+	for _, p := range strings.Split(val, ",") {
+		p = strings.TrimSpace(p)
+		if p != "" {
+			params = append(params, p)
+		}
+	}
+	return params
+}
+
+// SetLogURLPolicy sets how request URLs are cleaned up before they're stored
+// in request_logs, and returns s for chaining. params lists the query
+// parameters to keep (nil keeps them all, empty drops the query string), and
+// maxLen caps the stored URL's length, up to [db.MaxURLLength]. Zero maxLen
+// means [db.MaxURLLength].
+func (s *Server) SetLogURLPolicy(params []string, maxLen int) *Server {
+	if maxLen < 0 || maxLen > db.MaxURLLength {
+		panic(fmt.Sprintf("log URL length must be between 0 and %d", db.MaxURLLength))
+	}
+	s.logQueryParams = params
+	s.logURLMaxLength = maxLen
+	return s
+}
+
+// sanitizeLogURL returns u as it should be stored in request_logs: no
+// userinfo, only the allowed query parameters, and no longer than the
+// configured max (see [db.SanitizeURL])
+func (s *Server) sanitizeLogURL(u *url.URL) string {
+	return db.SanitizeURL(u, s.logQueryParams, s.logURLMaxLength)
+}
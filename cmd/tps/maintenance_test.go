@@ -0,0 +1,115 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMaintenance(t *testing.T) {
+	var up = newUpstream(t, nil)
+	var s = newTestServer(up.URL).SetMaintenance(true).SetVerifyEndpoint(true)
+	var ts = startServer(t, s)
+	var token = signSession(t, time.Now(), time.Now().Add(time.Hour))
+
+	var tests = map[string]struct {
+		method string
+		path   string
+		cookie bool
+	}{
+		"new client":      {http.MethodGet, "/page", false},
+		"valid session":   {http.MethodGet, "/page", true},
+		"verify endpoint": {http.MethodPost, verifyPath, false},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var req, _ = http.NewRequest(tc.method, ts.URL+tc.path, nil)
+			if tc.cookie {
+				req.AddCookie(&http.Cookie{Name: s.cookieName, Value: token})
+			}
+			var resp, err = http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("%s %s: %s", tc.method, tc.path, err)
+			}
+			readBody(t, resp)
+			if resp.StatusCode != http.StatusServiceUnavailable {
+				t.Errorf("got status %d, want 503", resp.StatusCode)
+			}
+			if got := resp.Header.Get("Retry-After"); got != "300" {
+				t.Errorf("got Retry-After %q, want 300", got)
+			}
+		})
+	}
+
+	// TPS itself is still healthy
+	var resp, err = http.Get(ts.URL + "/_tps/healthz")
+	if err != nil {
+		t.Fatalf("GET healthz: %s", err)
+	}
+	readBody(t, resp)
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("healthz: got status %d, want 200", resp.StatusCode)
+	}
+
+	if got := up.hits.Load(); got != 0 {
+		t.Errorf("upstream got %d hits, want 0", got)
+	}
+}
+
+func TestMaintenanceToggle(t *testing.T) {
+	var up = newUpstream(t, nil)
+	var s = newTestServer(up.URL).SetAdminCredentials("admin", "secret")
+	var ts = startServer(t, s)
+
+	var admin = func(method, enabled string, auth bool) (int, string) {
+		t.Helper()
+		var body = url.Values{"enabled": {enabled}}.Encode()
+		var req, _ = http.NewRequest(method, ts.URL+"/_tps/maintenance", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if auth {
+			req.SetBasicAuth("admin", "secret")
+		}
+		var resp, err = http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s /_tps/maintenance: %s", method, err)
+		}
+		return resp.StatusCode, readBody(t, resp)
+	}
+	var page = func() int {
+		t.Helper()
+		var resp, err = http.Get(ts.URL + "/page")
+		if err != nil {
+			t.Fatalf("GET /page: %s", err)
+		}
+		readBody(t, resp)
+		return resp.StatusCode
+	}
+
+	var steps = []struct {
+		name       string
+		method     string
+		enabled    string
+		auth       bool
+		wantStatus int
+		wantBody   string
+		wantPage   int
+	}{
+		{"starts off", http.MethodGet, "", true, http.StatusOK, `{"maintenance":false}`, http.StatusOK},
+		{"turned on", http.MethodPost, "true", true, http.StatusOK, `{"maintenance":true}`, http.StatusServiceUnavailable},
+		{"reads back on", http.MethodGet, "", true, http.StatusOK, `{"maintenance":true}`, http.StatusServiceUnavailable},
+		{"not a boolean", http.MethodPost, "soon", true, http.StatusBadRequest, "must be a boolean", http.StatusServiceUnavailable},
+		{"unauthenticated", http.MethodPost, "false", false, http.StatusUnauthorized, "", http.StatusServiceUnavailable},
+		{"turned off", http.MethodPost, "0", true, http.StatusOK, `{"maintenance":false}`, http.StatusOK},
+	}
+	for _, st := range steps {
+		var status, body = admin(st.method, st.enabled, st.auth)
+		if status != st.wantStatus || !strings.Contains(body, st.wantBody) {
+			t.Errorf("%s: got status %d and body %q, want %d and %q", st.name, status, body, st.wantStatus, st.wantBody)
+		}
+		if got := page(); got != st.wantPage {
+			t.Errorf("%s: page got status %d, want %d", st.name, got, st.wantPage)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+var errForeignOrigin = errors.New("verification POST came from a foreign origin")
+
+// parseAllowedOrigins splits a comma-separated list of hostnames, lowercasing
+// each one. Full origins like "https://x.edu" are accepted too, but only the
+// hostname is kept.
+func parseAllowedOrigins(val string) []string {
+	var hosts []string
+	for _, h := range strings.Split(val, ",") {
+		h = strings.TrimSpace(h)
+		if h == "" {
+			continue
+		}
+		var u, err = url.Parse(h)
+		if err == nil && u.Hostname() != "" {
+			h = u.Hostname()
+		}
+		hosts = append(hosts, strings.ToLower(h))
+	}
+	return hosts
+}
+
+// checkOrigin makes sure a verification POST was submitted from the host
+// being protected, or one of the allowed origins. The challenge form always
+// posts back to the page it's on, so a mismatch means somebody is submitting
+// it cross-site.
+//
+// Browsers send Origin on every form POST, and we fall back to Referer when
+// it's missing. Requests with neither aren't from a browser, so there's no
+// cross-site submission to stop, and they're allowed through for API clients.
+func (s *Server) checkOrigin(r *http.Request) error {
+	var origin = r.Header.Get("Origin")
+	if origin == "" {
+		origin = r.Referer()
+	}
+	if origin == "" {
+		return nil
+	}
+
+	// Browsers send "Origin: null" for sandboxed frames, data URLs, and other
+	// contexts that have no real origin, none of which is our challenge page
+	var u, err = url.Parse(origin)
+	if err != nil || u.Hostname() == "" {
+		return errForeignOrigin
+	}
+
+	var host = strings.ToLower(u.Hostname())
+	if host == requestHost(r) || slices.Contains(s.allowedOrigins, host) {
+		return nil
+	}
+	return errForeignOrigin
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestCheckOrigin(t *testing.T) {
+	var tests = map[string]struct {
+		origin  string
+		referer string
+		allowed []string
+		wantErr bool
+	}{
+		"same origin":              {origin: "https://library.example.edu", wantErr: false},
+		"same origin, other case":  {origin: "https://Library.Example.EDU", wantErr: false},
+		"foreign origin":           {origin: "https://evil.example.com", wantErr: true},
+		"null origin":              {origin: "null", wantErr: true},
+		"no origin or referer":     {wantErr: false},
+		"same-site referer":        {referer: "https://library.example.edu/page?x=1", wantErr: false},
+		"foreign referer":          {referer: "https://evil.example.com/page", wantErr: true},
+		"origin beats referer":     {origin: "https://evil.example.com", referer: "https://library.example.edu/", wantErr: true},
+		"allowed origin":           {origin: "https://www.example.edu", allowed: []string{"www.example.edu"}, wantErr: false},
+		"allowed origin, referer":  {referer: "https://www.example.edu/x", allowed: []string{"www.example.edu"}, wantErr: false},
+		"not among allowed origin": {origin: "https://evil.example.com", allowed: []string{"www.example.edu"}, wantErr: true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var s = newTestServer("http://127.0.0.1:1").SetAllowedOrigins(tc.allowed)
+			var r = httptest.NewRequest(http.MethodPost, "https://library.example.edu/page", nil)
+			if tc.origin != "" {
+				r.Header.Set("Origin", tc.origin)
+			}
+			if tc.referer != "" {
+				r.Header.Set("Referer", tc.referer)
+			}
+
+			var err = s.checkOrigin(r)
+			if (err != nil) != tc.wantErr {
+				t.Errorf("got error %v, want error: %t", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseAllowedOrigins(t *testing.T) {
+	var got = parseAllowedOrigins(" www.example.edu, https://Other.Example.EDU:8443 ,, ")
+	var want = []string{"www.example.edu", "other.example.edu"}
+	if !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestForeignOriginVerificationIsRejected(t *testing.T) {
+	var up = newUpstream(t, nil)
+	var ts = startServer(t, newTestServer(up.URL).SetBypass(true))
+	var client = newClient(t)
+
+	var action, form = challengeForm(t, client, ts.URL+"/page")
+	var req, _ = http.NewRequest(http.MethodPost, action, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Origin", "https://evil.example.com")
+	var resp, err = client.Do(req)
+	if err != nil {
+		t.Fatalf("POST: %s", err)
+	}
+	readBody(t, resp)
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("got status %d, want 403", resp.StatusCode)
+	}
+	if got := up.hits.Load(); got != 0 {
+		t.Errorf("upstream got %d requests, want 0", got)
+	}
+}
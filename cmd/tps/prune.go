@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"time"
+	"turnstile-proxy-server/internal/db"
+)
+
+// pruneInterval is how often old request logs are pruned
+const pruneInterval = 24 * time.Hour
+
+// pruneLogs removes request logs older than the retention period once
+// immediately, then again every [pruneInterval] until ctx is canceled
+func pruneLogs(ctx context.Context, store *db.Store, retention time.Duration) {
+	var l = logger.With("log.source", "main.pruneLogs")
+	var prune = func() {
+		var n, err = store.PruneOlderThanContext(ctx, retention)
+		if err != nil {
+			l.Error("Unable to prune request logs", "error", err)
+			return
+		}
+		l.Info("Pruned old request logs", "deleted", n, "retention", retention)
+	}
+
+	prune()
+	var ticker = time.NewTicker(pruneInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			prune()
+		}
+	}
+}
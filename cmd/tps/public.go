@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// cleanPath cleans a request path to prevent directory traversal issues, and
+// removes the leading slash, e.g., "/a/b/../c/" becomes "a/c"
+func cleanPath(p string) string {
+	p = filepath.Clean(p)
+	if len(p) > 0 && p[0] == '/' {
+		p = p[1:]
+	}
+	return p
+}
+
+// parsePublicPaths splits a comma-separated list of public path patterns,
+// validating each one. Patterns must be absolute paths, and any glob syntax
+// must be valid for [path.Match].
+func parsePublicPaths(val string) ([]string, error) {
+	var patterns []string
+	for _, p := range strings.Split(val, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		if p[0] != '/' {
+			return nil, fmt.Errorf("PUBLIC_PATHS: %q must start with a slash", p)
+		}
+		if _, err := path.Match(p, ""); err != nil {
+			return nil, fmt.Errorf("PUBLIC_PATHS: %q is not a valid pattern", p)
+		}
+		patterns = append(patterns, p)
+	}
+	return patterns, nil
+}
+
+// isPublic returns true if the request path matches any of the server's public
+// path patterns. Matching is on the cleaned path, so "/public/../private"
+// can't sneak past the challenge.
+//
+// Patterns with glob characters ("*", "?", "[") are matched via [path.Match];
+// patterns ending in a slash match that path and everything below it; all
+// other patterns must match exactly.
+func (s *Server) isPublic(p string) bool {
+	p = "/" + cleanPath(p)
+	for _, pattern := range s.publicPaths {
+		switch {
+		case strings.ContainsAny(pattern, "*?["):
+			if ok, _ := path.Match(pattern, p); ok {
+				return true
+			}
+		case strings.HasSuffix(pattern, "/"):
+			if p+"/" == pattern || strings.HasPrefix(p, pattern) {
+				return true
+			}
+		default:
+			if p == pattern {
+				return true
+			}
+		}
+	}
+	return false
+}
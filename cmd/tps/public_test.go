@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"testing"
+)
+
+func TestParsePublicPaths(t *testing.T) {
+	var got, err = parsePublicPaths(" /health, /static/,, /img/*.png ")
+	if err != nil {
+		t.Fatalf("parsePublicPaths: %s", err)
+	}
+	var want = []string{"/health", "/static/", "/img/*.png"}
+	if !slices.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	for _, bad := range []string{"health", "/img/[.png"} {
+		if _, err = parsePublicPaths(bad); err == nil {
+			t.Errorf("parsePublicPaths(%q) succeeded, want an error", bad)
+		}
+	}
+}
+
+func TestIsPublic(t *testing.T) {
+	var s = newTestServer("http://upstream").SetPublicPaths([]string{"/health", "/static/", "/img/*.png"})
+	var tests = map[string]bool{
+		"/health":               true,
+		"/health/":              true,
+		"/healthz":              false,
+		"/health/more":          false,
+		"/static":               true,
+		"/static/":              true,
+		"/static/css/site.css":  true,
+		"/staticky":             false,
+		"/img/logo.png":         true,
+		"/img/sub/logo.png":     false,
+		"/img/logo.jpg":         false,
+		"/":                     false,
+		"/private":              false,
+		"//static/x.css":        true,
+		"/private/../health":    true,
+		"/static/../private":    false,
+		"/static/./../private":  false,
+		"/static/a/../../admin": false,
+		"/img/../img/logo.png":  true,
+		"/../static/x.css":      true,
+	}
+	for p, want := range tests {
+		t.Run(p, func(t *testing.T) {
+			if got := s.isPublic(p); got != want {
+				t.Errorf("isPublic(%q) = %t, want %t", p, got, want)
+			}
+		})
+	}
+}
+
+func TestPublicPathDotSegments(t *testing.T) {
+	var up = newUpstream(t, nil)
+	var ts = startServer(t, newTestServer(up.URL).SetPublicPaths([]string{"/static/"}))
+
+	// Whether each path is proxied without a challenge
+	var tests = map[string]bool{
+		"/static/site.css":            true,
+		"/private/../static/site.css": true,
+		"/static/../private":          false,
+		"/static/%2e%2e/private":      false,
+		"/static/sub/../../private":   false,
+		"/static/./../private":        false,
+	}
+	for p, wantPublic := range tests {
+		t.Run(p, func(t *testing.T) {
+			var hits = up.hits.Load()
+
+			// Built by hand so the client doesn't clean up the path itself
+			var req, _ = http.NewRequest(http.MethodGet, ts.URL, nil)
+			req.URL.Opaque = p
+			var resp, err = http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("GET %s: %s", p, err)
+			}
+			readBody(t, resp)
+
+			var proxied = up.hits.Load() > hits
+			if proxied != wantPublic {
+				t.Errorf("got proxied %t, want %t", proxied, wantPublic)
+			}
+		})
+	}
+}
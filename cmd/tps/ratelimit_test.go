@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestRateLimitedVerification(t *testing.T) {
+	var sv = newSiteverify(t, map[string]any{"success": true})
+	var up = newUpstream(t, nil)
+
+	// A burst of 2, refilling at one request every 2.5s
+	var s = newTestServer(up.URL).SetVerifier(sv.verifier()).SetRateLimit(0.4, 2)
+	var ts = startServer(t, s)
+	var client = newClient(t)
+
+	challengeForm(t, client, ts.URL+"/page")
+	var action, form = challengeForm(t, client, ts.URL+"/page")
+	form.Set("cf-turnstile-response", "token")
+
+	var resp = postForm(t, client, action, form)
+	readBody(t, resp)
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("got status %d, want 429", resp.StatusCode)
+	}
+	// Just under 2.5s rounds up, never down to a time that's too early
+	if got := resp.Header.Get("Retry-After"); got != "3" {
+		t.Errorf("got Retry-After %q, want %q", got, "3")
+	}
+	if got := sv.calls.Load(); got != 0 {
+		t.Errorf("siteverify got %d calls, want 0", got)
+	}
+	if got := up.hits.Load(); got != 0 {
+		t.Errorf("upstream got %d hits, want 0", got)
+	}
+}
+
+func TestRateLimitSkipsSessions(t *testing.T) {
+	var s = newTestServer(newUpstream(t, nil).URL).SetBypass(true).SetRateLimit(0.4, 2)
+	var ts = startServer(t, s)
+
+	// Getting the session uses up the burst: one challenge, one verification
+	var client = verifiedClient(t, ts.URL+"/page")
+	for i := range 5 {
+		var resp, err = client.Get(ts.URL + "/page")
+		if err != nil {
+			t.Fatalf("GET: %s", err)
+		}
+		readBody(t, resp)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("request %d with a session: got status %d, want 200", i+1, resp.StatusCode)
+		}
+	}
+
+	// Without a session, the same client IP is still limited
+	var resp, err = http.Get(ts.URL + "/page")
+	if err != nil {
+		t.Fatalf("GET: %s", err)
+	}
+	readBody(t, resp)
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("request without a session: got status %d, want 429", resp.StatusCode)
+	}
+}
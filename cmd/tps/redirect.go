@@ -0,0 +1,101 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"strings"
+	"turnstile-proxy-server/session"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Post-verification modes: after a successful challenge we either replay the
+// original (cached) request to the proxy target, or redirect the browser back
+// to the original URL with the token in the fragment so a client-side app can
+// store it and send it along in [tokenHeader].
+const (
+	postVerifyReplay   = "replay"
+	postVerifyRedirect = "redirect"
+)
+
+// tokenHeader is where client-side apps send a token they received via the
+// redirect fragment. It's validated exactly like the cookie.
+const tokenHeader = session.TokenHeader
+
+// tokenFragmentKey is the fragment key the token is delivered in on redirect
+const tokenFragmentKey = "tps_token"
+
+// sign computes a hex-encoded HMAC of val using the JWT signing key. purpose
+// is mixed in so a signature made for one use can't be replayed in another.
+func (s *Server) sign(purpose, val string) string {
+	var mac = hmac.New(sha256.New, s.jwtSigningKey)
+	mac.Write([]byte(purpose + ":" + val))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// validSignature returns true if sig is the signature [Server.sign] would
+// produce for purpose and val
+func (s *Server) validSignature(purpose, val, sig string) bool {
+	var expected, err = hex.DecodeString(s.sign(purpose, val))
+	if err != nil {
+		return false
+	}
+	given, err := hex.DecodeString(sig)
+	if err != nil {
+		return false
+	}
+	return hmac.Equal(expected, given)
+}
+
+// signReturnTo signs the given return path so we can tell if it was altered
+// while the browser held onto it
+func (s *Server) signReturnTo(returnTo string) string {
+	return s.sign("tps-return-to", returnTo)
+}
+
+// validLocalPath returns true if p is a local, absolute path, never a full or
+// scheme-relative URL
+func validLocalPath(p string) bool {
+	return strings.HasPrefix(p, "/") && !strings.HasPrefix(p, "//") && !strings.HasPrefix(p, `/\`)
+}
+
+// validReturnTo returns true if returnTo is a local, absolute path (never a
+// full or scheme-relative URL) and sig is its valid signature
+func (s *Server) validReturnTo(returnTo, sig string) bool {
+	if !validLocalPath(returnTo) {
+		return false
+	}
+
+	return s.validSignature("tps-return-to", returnTo, sig)
+}
+
+// redirectURL builds the URL we send SPA clients back to after a successful
+// verification: the original path and query, with the token in the fragment
+func redirectURL(returnTo, token string) string {
+	return returnTo + "#" + tokenFragmentKey + "=" + url.QueryEscape(token)
+}
+
+// postedReturnTo returns the signed return path from the challenge form. If
+// it's missing or was tampered with, the client gets a 400 and ok is false.
+// It's checked before the verification goes any further, so a bad form never
+// leaves the client with a session cookie.
+func (s *Server) postedReturnTo(c *gin.Context) (returnTo string, ok bool) {
+	returnTo = c.PostForm("return_to")
+	var sig = c.PostForm("return_sig")
+	if !s.validReturnTo(returnTo, sig) {
+		s.logger.Warn("Invalid or tampered return path", "returnTo", returnTo)
+		c.String(http.StatusBadRequest, "Invalid return path")
+		return "", false
+	}
+	return returnTo, true
+}
+
+// redirectWithToken redirects the client back to returnTo, which must come
+// from [Server.postedReturnTo], with token in the fragment
+func (s *Server) redirectWithToken(c *gin.Context, returnTo, token string) {
+	s.logger.Debug("Redirecting with token", "returnTo", returnTo)
+	c.Redirect(http.StatusSeeOther, redirectURL(returnTo, token))
+}
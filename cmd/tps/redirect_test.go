@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// sessionCookieSet returns true if resp sets the session cookie
+func sessionCookieSet(s *Server, resp *http.Response) bool {
+	for _, c := range resp.Cookies() {
+		if c.Name == s.cookieName && c.Value != "" {
+			return true
+		}
+	}
+	return false
+}
+
+func TestTamperedReturnToGetsNoToken(t *testing.T) {
+	var up = newUpstream(t, nil)
+	var s = newTestServer(up.URL).SetBypass(true).SetPostVerifyMode(postVerifyRedirect)
+	var ts = startServer(t, s)
+
+	var client = newClient(t)
+	var action, form = challengeForm(t, client, ts.URL+"/app?x=1")
+	var tampered = url.Values{}
+	for k, v := range form {
+		tampered[k] = v
+	}
+	tampered.Set("return_to", "/somewhere-else")
+
+	var resp = postForm(t, client, action, tampered)
+	readBody(t, resp)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("tampered return_to: got status %d, want 400", resp.StatusCode)
+	}
+	if sessionCookieSet(s, resp) {
+		t.Errorf("tampered return_to: session cookie was set")
+	}
+
+	// The untouched form still works, since the request was never claimed
+	resp = postForm(t, client, action, form)
+	readBody(t, resp)
+	var loc = resp.Header.Get("Location")
+	if resp.StatusCode != http.StatusSeeOther || !strings.HasPrefix(loc, "/app?x=1#"+tokenFragmentKey+"=") {
+		t.Errorf("valid return_to: got status %d and location %q, want a redirect to /app?x=1 with a token", resp.StatusCode, loc)
+	}
+	if !sessionCookieSet(s, resp) {
+		t.Errorf("valid return_to: session cookie wasn't set")
+	}
+
+	// A tampered duplicate of the verified form gets no token either
+	resp = postForm(t, newClient(t), action, tampered)
+	readBody(t, resp)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("tampered duplicate: got status %d, want 400", resp.StatusCode)
+	}
+	if sessionCookieSet(s, resp) {
+		t.Errorf("tampered duplicate: session cookie was set")
+	}
+
+	if got := up.hits.Load(); got != 0 {
+		t.Errorf("upstream got %d requests, want none in redirect mode", got)
+	}
+}
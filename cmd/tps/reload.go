@@ -0,0 +1,31 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// reloadOnHangup reloads the server's templates every time TPS gets a SIGHUP,
+// until ctx is canceled
+func reloadOnHangup(ctx context.Context, server *Server) {
+	var l = logger.With("log.source", "main.reloadOnHangup")
+	var hup = make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			var err = server.ReloadTemplates()
+			if err != nil {
+				l.Error("Unable to reload templates, keeping the old ones", "error", err)
+				continue
+			}
+			l.Info("Reloaded templates")
+		}
+	}
+}
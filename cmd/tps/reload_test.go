@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// TestReloadTemplatesDuringRequests reloads the templates, adding and removing
+// a custom challenge template, while requests are rendering challenges. Run it
+// with -race.
+func TestReloadTemplatesDuringRequests(t *testing.T) {
+	var dir = t.TempDir()
+	var custom = filepath.Join(dir, "example.edu", "challenge.go.html")
+	var err = os.MkdirAll(filepath.Dir(custom), 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var writeCustom = func(version int) {
+		var src = fmt.Sprintf(`<p>custom-v%d</p><script nonce="{{.Nonce}}"></script>`, version)
+		var err = os.WriteFile(custom, []byte(src), 0o644)
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	writeCustom(0)
+
+	var s = newTestServer(newUpstream(t, nil).URL)
+	s.customTemplatePath = dir
+	var ts = startServer(t, s)
+
+	// Requests go to TPS as if it were a forward proxy, so their URLs carry
+	// the hostname custom templates are chosen by
+	var proxyURL, _ = url.Parse(ts.URL)
+	var transport = &http.Transport{Proxy: http.ProxyURL(proxyURL)}
+	t.Cleanup(transport.CloseIdleConnections)
+	var client = &http.Client{Transport: transport}
+
+	var wg sync.WaitGroup
+	var stop = make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 1; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+
+			if i%3 == 0 {
+				os.Remove(custom)
+			} else {
+				writeCustom(i)
+			}
+			var err = s.ReloadTemplates()
+			if err != nil {
+				t.Errorf("reload %d: %s", i, err)
+				return
+			}
+		}
+	}()
+
+	var sawCustom atomic.Bool
+	var requests sync.WaitGroup
+	for range 8 {
+		requests.Add(1)
+		go func() {
+			defer requests.Done()
+			for range 25 {
+				var resp, err = client.Get("http://example.edu/page")
+				if err != nil {
+					t.Errorf("GET: %s", err)
+					return
+				}
+				var body = readBody(t, resp)
+				if resp.StatusCode != http.StatusOK {
+					t.Errorf("got status %d, want 200", resp.StatusCode)
+				}
+
+				if strings.Contains(body, "custom-v") {
+					sawCustom.Store(true)
+				} else if !strings.Contains(body, `name="request_id"`) {
+					t.Errorf("got neither template: %q", body)
+				}
+			}
+		}()
+	}
+	requests.Wait()
+	close(stop)
+	wg.Wait()
+
+	if !sawCustom.Load() {
+		t.Errorf("never rendered the custom template")
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+
+	"golang.org/x/net/http/httpguts"
+)
+
+// bodylessMethods never carry a request body upstream, whatever the client
+// sent along with them
+var bodylessMethods = map[string]bool{
+	http.MethodGet:   true,
+	http.MethodHead:  true,
+	http.MethodTrace: true,
+}
+
+// newCachedRequest captures everything needed to faithfully replay r later.
+// body must be r's fully-read body; trailers are only available once that's
+// happened. The URL and headers are copied so nothing that touches r
+// afterward can change what gets replayed.
+func newCachedRequest(r *http.Request, body []byte) *cachedRequest {
+	var u = *r.URL
+	return &cachedRequest{
+		Host:    r.Host,
+		Method:  r.Method,
+		Body:    body,
+		Headers: r.Header.Clone(),
+		Trailer: r.Trailer.Clone(),
+		URL:     &u,
+	}
+}
+
+// toRequest rebuilds the cached request for replay. The method, path, and
+// full query string are reproduced exactly, bodies are dropped for methods
+// that shouldn't have one, and Content-Length is derived from the body
+// actually sent rather than copied from the original headers.
+func (cr *cachedRequest) toRequest(ctx context.Context) (*http.Request, error) {
+	var body = cr.Body
+	if bodylessMethods[cr.Method] {
+		body = nil
+	}
+
+	var req, err = http.NewRequestWithContext(ctx, cr.Method, "/", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	var u = *cr.URL
+	req.URL = &u
+	req.RequestURI = ""
+	req.Host = cr.Host
+	req.Header = cr.Headers.Clone()
+	req.Header.Del("Content-Length")
+	req.Header.Del("Transfer-Encoding")
+
+	// Trailers can only be sent with a chunked body
+	if len(cr.Trailer) > 0 && len(body) > 0 {
+		req.Trailer = cr.Trailer.Clone()
+		req.ContentLength = -1
+		req.TransferEncoding = []string{"chunked"}
+	}
+
+	return req, nil
+}
+
+// isUpgrade returns true if req asks to switch protocols, e.g., a WebSocket
+// handshake
+func isUpgrade(req *http.Request) bool {
+	return httpguts.HeaderValuesContainsToken(req.Header["Connection"], "Upgrade") && req.Header.Get("Upgrade") != ""
+}
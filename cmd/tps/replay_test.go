@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEventStreamIsNotBuffered(t *testing.T) {
+	// The upstream won't send its second event until the client has read the
+	// first, so a proxy that buffers the stream never delivers either
+	var next = make(chan struct{})
+	var up = newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/events" {
+			io.WriteString(w, "upstream ok")
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		io.WriteString(w, "data: one\n\n")
+		w.(http.Flusher).Flush()
+		select {
+		case <-next:
+		case <-r.Context().Done():
+			return
+		}
+		io.WriteString(w, "data: two\n\n")
+	})
+	var s = newTestServer(up.URL).SetBypass(true).SetFlushInterval(time.Hour)
+	var ts = startServer(t, s)
+	var client = verifiedClient(t, ts.URL+"/page")
+
+	var resp, err = client.Get(ts.URL + "/events")
+	if err != nil {
+		t.Fatalf("GET /events: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d, want 200", resp.StatusCode)
+	}
+
+	var lines = make(chan string)
+	go func() {
+		defer close(lines)
+		var sc = bufio.NewScanner(resp.Body)
+		for sc.Scan() {
+			if sc.Text() != "" {
+				lines <- sc.Text()
+			}
+		}
+	}()
+
+	for i, want := range []string{"data: one", "data: two"} {
+		select {
+		case got := <-lines:
+			if got != want {
+				t.Fatalf("event %d: got %q, want %q", i+1, got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("event %d never arrived", i+1)
+		}
+		if i == 0 {
+			close(next)
+		}
+	}
+}
+
+func TestUpgradeIsProxied(t *testing.T) {
+	// An upstream which switches to a trivial echo protocol, standing in for
+	// a WebSocket server
+	var up = newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		if !isUpgrade(r) || r.Header.Get("Upgrade") != "echo" {
+			io.WriteString(w, "upstream ok")
+			return
+		}
+		var conn, buf, err = http.NewResponseController(w).Hijack()
+		if err != nil {
+			t.Errorf("hijacking upstream connection: %s", err)
+			return
+		}
+		defer conn.Close()
+		io.WriteString(buf, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+		buf.Flush()
+		io.Copy(conn, buf)
+	})
+	var s = newTestServer(up.URL).SetBypass(true)
+	var ts = startServer(t, s)
+	var client = verifiedClient(t, ts.URL+"/page")
+
+	var u, _ = url.Parse(ts.URL)
+	var conn, err = net.Dial("tcp", u.Host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	var req, _ = http.NewRequest(http.MethodGet, ts.URL+"/socket", nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "echo")
+	for _, c := range client.Jar.Cookies(u) {
+		req.AddCookie(c)
+	}
+	err = req.Write(conn)
+	if err != nil {
+		t.Fatalf("writing handshake: %s", err)
+	}
+
+	var r = bufio.NewReader(conn)
+	var resp *http.Response
+	resp, err = http.ReadResponse(r, req)
+	if err != nil {
+		t.Fatalf("reading handshake response: %s", err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Upgrade") != "echo" {
+		t.Fatalf("got status %d and Upgrade %q, want 101 and echo", resp.StatusCode, resp.Header.Get("Upgrade"))
+	}
+
+	// Both directions work once the connection is handed off
+	_, err = io.WriteString(conn, "ping\n")
+	if err != nil {
+		t.Fatalf("writing: %s", err)
+	}
+	var line string
+	line, err = r.ReadString('\n')
+	if err != nil || strings.TrimSpace(line) != "ping" {
+		t.Errorf("got %q and error %v, want ping echoed back", line, err)
+	}
+}
+
+func TestToRequest(t *testing.T) {
+	var tests = map[string]struct {
+		method     string
+		rawURL     string
+		body       string
+		trailer    http.Header
+		wantBody   string
+		wantLength int64
+		wantTE     []string
+	}{
+		"POST keeps its body": {
+			method:     http.MethodPost,
+			rawURL:     "/submit?x=1",
+			body:       "name=value",
+			wantBody:   "name=value",
+			wantLength: 10,
+		},
+		"PUT keeps its body": {
+			method:     http.MethodPut,
+			rawURL:     "/doc",
+			body:       "{}",
+			wantBody:   "{}",
+			wantLength: 2,
+		},
+		"GET drops its body": {
+			method: http.MethodGet,
+			rawURL: "/search?q=a+b&q=c&empty=&x=%2F",
+			body:   "ignored",
+		},
+		"HEAD drops its body": {
+			method: http.MethodHead,
+			rawURL: "/page",
+			body:   "ignored",
+		},
+		"trailers make it chunked": {
+			method:     http.MethodPost,
+			rawURL:     "/upload",
+			body:       "data",
+			trailer:    http.Header{"Checksum": {"abc"}},
+			wantBody:   "data",
+			wantLength: -1,
+			wantTE:     []string{"chunked"},
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var orig = httptest.NewRequest(tc.method, "http://front.example"+tc.rawURL, nil)
+			orig.Header.Set("Content-Length", "999")
+			orig.Header.Set("X-Custom", "kept")
+			orig.Trailer = tc.trailer
+			var cached = newCachedRequest(orig, []byte(tc.body))
+
+			var req, err = cached.toRequest(context.Background())
+			if err != nil {
+				t.Fatalf("toRequest: %s", err)
+			}
+			if req.Method != tc.method || req.URL.RequestURI() != tc.rawURL || req.Host != "front.example" {
+				t.Errorf("got %s %s on %s, want %s %s on front.example", req.Method, req.URL.RequestURI(), req.Host, tc.method, tc.rawURL)
+			}
+			if req.ContentLength != tc.wantLength {
+				t.Errorf("got Content-Length %d, want %d", req.ContentLength, tc.wantLength)
+			}
+			if got := req.Header.Get("Content-Length"); got != "" {
+				t.Errorf("original Content-Length header %q was kept", got)
+			}
+			if got := req.Header.Get("X-Custom"); got != "kept" {
+				t.Errorf("got X-Custom %q, want it kept", got)
+			}
+			if !slices.Equal(req.TransferEncoding, tc.wantTE) {
+				t.Errorf("got Transfer-Encoding %q, want %q", req.TransferEncoding, tc.wantTE)
+			}
+			var b, _ = io.ReadAll(req.Body)
+			if string(b) != tc.wantBody {
+				t.Errorf("got body %q, want %q", b, tc.wantBody)
+			}
+		})
+	}
+}
+
+func TestReplayedRequestReachesUpstream(t *testing.T) {
+	var up = newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		var b, _ = io.ReadAll(r.Body)
+		fmt.Fprintf(w, "%s %s length=%d body=%q", r.Method, r.RequestURI, r.ContentLength, b)
+	})
+	var s = newTestServer(up.URL).SetBypass(true)
+	var ts = startServer(t, s)
+
+	var tests = map[string]struct {
+		method string
+		uri    string
+		body   string
+		want   string
+	}{
+		"POST": {
+			method: http.MethodPost,
+			uri:    "/submit?x=1",
+			body:   "name=value",
+			want:   `POST /submit?x=1 length=10 body="name=value"`,
+		},
+		"GET": {
+			method: http.MethodGet,
+			uri:    "/search?q=a+b&q=c&x=%2F",
+			body:   "stray body",
+			want:   `GET /search?q=a+b&q=c&x=%2F length=0 body=""`,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var client = newClient(t)
+			var req, _ = http.NewRequest(tc.method, ts.URL+tc.uri, strings.NewReader(tc.body))
+			req.Header.Set("Content-Type", "text/plain")
+			var resp, err = client.Do(req)
+			if err != nil {
+				t.Fatalf("%s %s: %s", tc.method, tc.uri, err)
+			}
+			var form = hiddenFields(readBody(t, resp))
+
+			resp = postForm(t, client, ts.URL+tc.uri, form)
+			if got := readBody(t, resp); got != tc.want {
+				t.Errorf("upstream got %s, want %s", got, tc.want)
+			}
+		})
+	}
+}
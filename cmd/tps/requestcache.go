@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"turnstile-proxy-server/internal/reqcache"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RequestCache holds challenged requests, keyed by request ID, until their
+// clients pass the challenge. Requests leave it exactly once: taken for
+// replay, expired, or evicted to make room.
+type RequestCache interface {
+	Set(requestID string, req any)
+	Take(requestID string) (any, bool)
+	Peek(requestID string) (any, bool)
+	DeleteExpired()
+	Stats() reqcache.Stats
+}
+
+// SetMaxCachedRequests caps how many challenged requests are held at once. A
+// new request arriving when the cache is full evicts the oldest, whose client
+// will be challenged again if it ever submits its verification. Zero (the
+// default) means no cap, and a negative value will panic. Like
+// [Server.SetCacheTTL], this replaces the request cache, so it must be called
+// before the server starts handling requests.
+func (s *Server) SetMaxCachedRequests(n int) *Server {
+	if n < 0 {
+		panic("max cached requests must not be negative")
+	}
+	s.maxCachedRequests = n
+	s.resetRequestCache()
+	return s
+}
+
+// resetRequestCache replaces the request cache with an empty one using the
+// current TTL and size cap
+func (s *Server) resetRequestCache() {
+	s.requestCache = reqcache.New(s.cacheTTL, s.maxCachedRequests, s.releaseCachedRequest)
+}
+
+// metric is a single value exposed in Prometheus's text format
+type metric struct {
+	name  string
+	kind  string
+	help  string
+	value any
+}
+
+// handleMetrics exposes the request cache's counters, and how many request
+// log entries were dropped, in Prometheus's text exposition format
+func (s *Server) handleMetrics(c *gin.Context) {
+	var st = s.requestCache.Stats()
+	var metrics = []metric{
+		{"tps_request_cache_items", "gauge", "Challenged requests currently cached.", st.Items},
+		{"tps_request_cache_max_items", "gauge", "Cap on cached requests, or 0 for no cap.", st.MaxItems},
+		{"tps_request_cache_bytes", "gauge", "Bytes of request bodies currently cached.", s.cachedBytes.Load()},
+		{"tps_request_cache_sets_total", "counter", "Challenged requests added to the cache.", st.Sets},
+		{"tps_request_cache_hits_total", "counter", "Verifications which found their cached request.", st.Hits},
+		{"tps_request_cache_misses_total", "counter", "Verifications whose cached request was gone.", st.Misses},
+		{"tps_request_cache_expirations_total", "counter", "Cached requests which expired before being verified.", st.Expirations},
+		{"tps_request_cache_evictions_total", "counter", "Cached requests evicted to make room for new ones.", st.Evictions},
+		{"tps_request_log_dropped_total", "counter", "Request log entries dropped because the async log buffer was full.", s.db.Dropped()},
+	}
+
+	var b strings.Builder
+	for _, m := range metrics {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n%s %v\n", m.name, m.help, m.name, m.kind, m.name, m.value)
+	}
+	c.Data(http.StatusOK, "text/plain; version=0.0.4; charset=utf-8", []byte(b.String()))
+}
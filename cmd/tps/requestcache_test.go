@@ -0,0 +1,36 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+	var s = newTestServer(newUpstream(t, nil).URL).SetAdminCredentials("admin", "secret")
+	var ts = startServer(t, s)
+
+	// One challenged request is cached
+	challengeForm(t, newClient(t), ts.URL+"/page")
+
+	var req, _ = http.NewRequest(http.MethodGet, ts.URL+"/_tps/metrics", nil)
+	req.SetBasicAuth("admin", "secret")
+	var resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET /_tps/metrics: %s", err)
+	}
+	var body = readBody(t, resp)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d, want 200", resp.StatusCode)
+	}
+
+	for _, want := range []string{
+		"# TYPE tps_request_cache_items gauge\ntps_request_cache_items 1\n",
+		"# TYPE tps_request_cache_sets_total counter\ntps_request_cache_sets_total 1\n",
+		"# TYPE tps_request_log_dropped_total counter\ntps_request_log_dropped_total 0\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics are missing %q:\n%s", want, body)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+	"turnstile-proxy-server/internal/db"
+	"turnstile-proxy-server/internal/reqcache"
+
+	"github.com/gin-gonic/gin"
+)
+
+// reservedPrefix is the path prefix for TPS's own endpoints. Nothing under it
+// is ever proxied, so the protected app can't shadow TPS internals.
+const reservedPrefix = "/_tps/"
+
+// isReserved returns true if p is in TPS's reserved namespace. p is cleaned
+// first, so dot segments and doubled slashes can't be used to sneak a reserved
+// path past us to a backend that normalizes paths itself.
+func isReserved(p string) bool {
+	p = path.Clean("/" + p)
+	return p == strings.TrimSuffix(reservedPrefix, "/") || strings.HasPrefix(p, reservedPrefix)
+}
+
+// registerReservedRoutes sets up TPS's own endpoints. These must be real
+// routes rather than special cases in the proxy handler, so that gin
+// dispatches to them before anything else is considered.
+func (s *Server) registerReservedRoutes() {
+	var g = s.r.Group(reservedPrefix)
+	g.GET("/healthz", s.handleHealth)
+	g.GET("/assets/*filepath", s.handleAsset)
+	g.HEAD("/assets/*filepath", s.handleAsset)
+	g.POST("/verify", s.handleVerify)
+
+	var admin = g.Group("/", s.requireAdmin)
+	admin.GET("/maintenance", s.handleGetMaintenance)
+	admin.POST("/maintenance", s.handleSetMaintenance)
+	admin.GET("/stats", s.handleStats)
+	admin.GET("/metrics", s.handleMetrics)
+}
+
+// handleHealth reports that TPS is up. It deliberately ignores maintenance
+// mode, since TPS itself is fine even when the app behind it isn't.
+func (s *Server) handleHealth(c *gin.Context) {
+	c.String(http.StatusOK, "ok")
+}
+
+// requireAdmin protects admin endpoints with HTTP basic auth. If no admin
+// credentials are configured, admin endpoints don't exist.
+func (s *Server) requireAdmin(c *gin.Context) {
+	if s.adminUser == "" || s.adminPass == "" {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	var user, pass, ok = c.Request.BasicAuth()
+	var userOK = subtle.ConstantTimeCompare([]byte(user), []byte(s.adminUser)) == 1
+	var passOK = subtle.ConstantTimeCompare([]byte(pass), []byte(s.adminPass)) == 1
+	if !ok || !userOK || !passOK {
+		s.logger.Warn("Admin authentication failed", "clientIP", c.ClientIP(), "path", c.Request.URL.Path)
+		c.Header("WWW-Authenticate", `Basic realm="TPS admin"`)
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return
+	}
+	c.Next()
+}
+
+func (s *Server) handleGetMaintenance(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"maintenance": s.maintenance.Load()})
+}
+
+// handleSetMaintenance turns maintenance mode on or off based on the
+// "enabled" form value
+func (s *Server) handleSetMaintenance(c *gin.Context) {
+	var enabled, err = strconv.ParseBool(c.PostForm("enabled"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": `"enabled" must be a boolean`})
+		return
+	}
+
+	s.maintenance.Store(enabled)
+	s.logger.Warn("Maintenance mode changed", "maintenance", enabled, "clientIP", c.ClientIP())
+	c.JSON(http.StatusOK, gin.H{"maintenance": enabled})
+}
+
+// statsWindow is how far back the stats endpoint looks
+const statsWindow = 24 * time.Hour
+
+// statsReport is what the stats endpoint reports: request outcomes since the
+// given time, per host and in total, and the request cache's counters
+type statsReport struct {
+	Since        string             `json:"since"`
+	Total        db.OutcomeCounts   `json:"total"`
+	Hosts        []db.OutcomeCounts `json:"hosts"`
+	RequestCache reqcache.Stats     `json:"request_cache"`
+}
+
+// newStatsReport totals up the per-host counts for requests since the given
+// time into a report
+func newStatsReport(since time.Time, hosts []db.OutcomeCounts, cache reqcache.Stats) statsReport {
+	var total = db.OutcomeCounts{}
+	for _, h := range hosts {
+		total.Total += h.Total
+		total.ChallengesPresented += h.ChallengesPresented
+		total.ChallengesPassed += h.ChallengesPassed
+		total.ChallengesFailed += h.ChallengesFailed
+		total.ValidTokens += h.ValidTokens
+	}
+	if hosts == nil {
+		hosts = []db.OutcomeCounts{}
+	}
+
+	return statsReport{
+		Since:        since.UTC().Format(time.RFC3339),
+		Total:        total,
+		Hosts:        hosts,
+		RequestCache: cache,
+	}
+}
+
+// handleStats reports request outcomes over the last [statsWindow], per host
+// and in total
+func (s *Server) handleStats(c *gin.Context) {
+	var since = time.Now().Add(-statsWindow)
+	var hosts, err = s.db.CountByOutcome(c.Request.Context(), since)
+	if err != nil {
+		s.logger.Error("Unable to read stats", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "unable to read stats"})
+		return
+	}
+	c.JSON(http.StatusOK, newStatsReport(since, hosts, s.requestCache.Stats()))
+}
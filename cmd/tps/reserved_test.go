@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+	"turnstile-proxy-server/internal/db"
+	"turnstile-proxy-server/internal/reqcache"
+)
+
+func TestAdminAuth(t *testing.T) {
+	var up = newUpstream(t, nil)
+	var open = startServer(t, newTestServer(up.URL))
+	var protected = startServer(t, newTestServer(up.URL).SetAdminCredentials("admin", "secret"))
+
+	var tests = map[string]struct {
+		url        string
+		user, pass string
+		want       int
+	}{
+		"no admin configured":  {open.URL, "admin", "secret", http.StatusNotFound},
+		"no credentials":       {protected.URL, "", "", http.StatusUnauthorized},
+		"wrong password":       {protected.URL, "admin", "guess", http.StatusUnauthorized},
+		"wrong user":           {protected.URL, "root", "secret", http.StatusUnauthorized},
+		"password as the user": {protected.URL, "secret", "admin", http.StatusUnauthorized},
+	}
+
+	for _, endpoint := range []string{"/_tps/stats", "/_tps/metrics", "/_tps/maintenance"} {
+		for name, tc := range tests {
+			t.Run(endpoint+" "+name, func(t *testing.T) {
+				var req, _ = http.NewRequest(http.MethodGet, tc.url+endpoint, nil)
+				if tc.user != "" {
+					req.SetBasicAuth(tc.user, tc.pass)
+				}
+				var resp, err = http.DefaultClient.Do(req)
+				if err != nil {
+					t.Fatalf("GET %s: %s", endpoint, err)
+				}
+				readBody(t, resp)
+				if resp.StatusCode != tc.want {
+					t.Errorf("got status %d, want %d", resp.StatusCode, tc.want)
+				}
+				var challenge = resp.Header.Get("WWW-Authenticate")
+				if (tc.want == http.StatusUnauthorized) != (challenge != "") {
+					t.Errorf("got WWW-Authenticate %q with status %d", challenge, resp.StatusCode)
+				}
+			})
+		}
+	}
+
+	if got := up.hits.Load(); got != 0 {
+		t.Errorf("upstream got %d hits, want 0", got)
+	}
+}
+
+func TestStatsReport(t *testing.T) {
+	var since = time.Date(2025, 1, 1, 12, 0, 0, 0, time.FixedZone("PST", -8*3600))
+	var hosts = []db.OutcomeCounts{
+		{Host: "", Total: 5, ValidTokens: 5},
+		{Host: "a.x.edu", Total: 100, ChallengesPresented: 20, ChallengesPassed: 15, ChallengesFailed: 5, ValidTokens: 80},
+		{Host: "b.x.edu", Total: 15, ChallengesPresented: 10, ChallengesPassed: 10, ValidTokens: 5},
+	}
+	var cache = reqcache.Stats{Items: 12, MaxItems: 100000, Sets: 30, Hits: 25, Misses: 2, Expirations: 3}
+
+	var tests = map[string]struct {
+		hosts []db.OutcomeCounts
+		want  string
+	}{
+		"hosts": {hosts, `{` +
+			`"since":"2025-01-01T20:00:00Z",` +
+			`"total":{"host":"","total":120,"challenges_presented":30,"challenges_passed":25,"challenges_failed":5,"valid_tokens":90},` +
+			`"hosts":[` +
+			`{"host":"","total":5,"challenges_presented":0,"challenges_passed":0,"challenges_failed":0,"valid_tokens":5},` +
+			`{"host":"a.x.edu","total":100,"challenges_presented":20,"challenges_passed":15,"challenges_failed":5,"valid_tokens":80},` +
+			`{"host":"b.x.edu","total":15,"challenges_presented":10,"challenges_passed":10,"challenges_failed":0,"valid_tokens":5}` +
+			`],` +
+			`"request_cache":{"items":12,"max_items":100000,"sets":30,"hits":25,"misses":2,"expirations":3,"evictions":0}` +
+			`}`},
+		"no requests": {nil, `{` +
+			`"since":"2025-01-01T20:00:00Z",` +
+			`"total":{"host":"","total":0,"challenges_presented":0,"challenges_passed":0,"challenges_failed":0,"valid_tokens":0},` +
+			`"hosts":[],` +
+			`"request_cache":{"items":12,"max_items":100000,"sets":30,"hits":25,"misses":2,"expirations":3,"evictions":0}` +
+			`}`},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var got, err = json.Marshal(newStatsReport(since, tc.hosts, cache))
+			if err != nil {
+				t.Fatalf("encoding report: %s", err)
+			}
+			if string(got) != tc.want {
+				t.Errorf("got  %s\nwant %s", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// route sends requests matching a host and/or path prefix to a specific proxy
+// target. An empty host matches any host, and an empty prefix matches any
+// path.
+type route struct {
+	host   string
+	prefix string
+	target *url.URL
+}
+
+// routeTable is an ordered list of routes; see [routeTable.match] for how one
+// is chosen
+type routeTable []route
+
+// matches returns true if the route applies to the given host and path.
+// Prefixes match on path segment boundaries, so "/search" matches "/search"
+// and "/search/x", but not "/searching". path must already be cleaned (see
+// [routeTable.match]) and the prefix normalized (see [routePrefix]).
+func (rt route) matches(host, path string) bool {
+	if rt.host != "" && rt.host != host {
+		return false
+	}
+	if rt.prefix == "" || path == rt.prefix {
+		return true
+	}
+	return strings.HasPrefix(path, rt.prefix+"/")
+}
+
+// routePrefix normalizes a route's path prefix, dropping any trailing slash
+// so "/search/" matches "/search" itself, just like "/search" does. A prefix
+// of "/" matches everything, so it's the same as no prefix at all.
+func routePrefix(p string) string {
+	return strings.TrimRight(p, "/")
+}
+
+// match returns the target of the most specific route for the given host and
+// path, or nil if none match. Routes naming a host beat those that don't, and
+// among those, the longest matching prefix wins.
+//
+// The path is cleaned first, just as it is for public paths and templates, so
+// dot segments and doubled slashes can't steer a request to a different
+// upstream than the path it resolves to.
+func (t routeTable) match(host, path string) *url.URL {
+	path = "/" + cleanPath(path)
+	var best *route
+	for i := range t {
+		var rt = &t[i]
+		if !rt.matches(host, path) {
+			continue
+		}
+		if best == nil || moreSpecific(rt, best) {
+			best = rt
+		}
+	}
+
+	if best == nil {
+		return nil
+	}
+	return best.target
+}
+
+func moreSpecific(a, b *route) bool {
+	if (a.host != "") != (b.host != "") {
+		return a.host != ""
+	}
+	return len(a.prefix) > len(b.prefix)
+}
+
+// loadRoutes reads a routing table from the file at path. Each non-blank line
+// that doesn't start with "#" must have two whitespace-separated fields: what
+// to match and the target URL. The match is a hostname ("search.x.edu"), a
+// path prefix ("/search"), or both ("search.x.edu/search").
+func loadRoutes(path string) (routeTable, error) {
+	var f, err = os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var table routeTable
+	var scanner = bufio.NewScanner(f)
+	var lineNum = 0
+	for scanner.Scan() {
+		lineNum++
+		var line = strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		var fields = strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected a match and a target URL, got %d fields", path, lineNum, len(fields))
+		}
+
+		var rt route
+		var match = fields[0]
+		var slash = strings.Index(match, "/")
+		switch {
+		case slash == -1:
+			rt.host = strings.ToLower(match)
+		case slash == 0:
+			rt.prefix = routePrefix(match)
+		default:
+			rt.host = strings.ToLower(match[:slash])
+			rt.prefix = routePrefix(match[slash:])
+		}
+
+		rt.target, err = url.Parse(fields[1])
+		if err != nil || rt.target.Scheme == "" || rt.target.Host == "" {
+			return nil, fmt.Errorf("%s:%d: invalid target URL %q", path, lineNum, fields[1])
+		}
+		table = append(table, rt)
+	}
+
+	return table, scanner.Err()
+}
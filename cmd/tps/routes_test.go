@@ -0,0 +1,146 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeRoutes writes a routes file holding content and returns its path
+func writeRoutes(t *testing.T, content string) string {
+	t.Helper()
+	var path = filepath.Join(t.TempDir(), "routes")
+	var err = os.WriteFile(path, []byte(content), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadRoutes(t *testing.T) {
+	var rt, err = loadRoutes(writeRoutes(t, `
+# match                    target
+Exhibits.X.edu             http://exhibits:3000
+/api/                      http://api:8000
+search.x.edu/collections   http://collections:8080
+`))
+	if err != nil {
+		t.Fatalf("loadRoutes: %s", err)
+	}
+
+	var want = []struct{ host, prefix, target string }{
+		{"exhibits.x.edu", "", "http://exhibits:3000"},
+		{"", "/api", "http://api:8000"},
+		{"search.x.edu", "/collections", "http://collections:8080"},
+	}
+	if len(rt) != len(want) {
+		t.Fatalf("got %d routes, want %d", len(rt), len(want))
+	}
+	for i, w := range want {
+		if rt[i].host != w.host || rt[i].prefix != w.prefix || rt[i].target.String() != w.target {
+			t.Errorf("route %d: got %q %q %q, want %q %q %q", i, rt[i].host, rt[i].prefix, rt[i].target, w.host, w.prefix, w.target)
+		}
+	}
+
+	for name, content := range map[string]string{
+		"one field":      "/api\n",
+		"three fields":   "/api http://api:8000 extra\n",
+		"relative URL":   "/api api:8000/x\n",
+		"missing scheme": "/api //api:8000\n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			var _, err = loadRoutes(writeRoutes(t, content))
+			if err == nil {
+				t.Errorf("loadRoutes accepted %q", content)
+			}
+		})
+	}
+}
+
+func TestRouteTableMatch(t *testing.T) {
+	var rt, err = loadRoutes(writeRoutes(t, `
+exhibits.x.edu        http://exhibits
+/api                  http://api
+/api/v2/              http://api-v2
+search.x.edu/api      http://search-api
+`))
+	if err != nil {
+		t.Fatalf("loadRoutes: %s", err)
+	}
+
+	var tests = map[string]struct {
+		host string
+		path string
+		want string
+	}{
+		"host":                     {"exhibits.x.edu", "/anything", "http://exhibits"},
+		"prefix":                   {"other.x.edu", "/api/users", "http://api"},
+		"prefix itself":            {"other.x.edu", "/api", "http://api"},
+		"not a segment boundary":   {"other.x.edu", "/apiary", ""},
+		"longest prefix":           {"other.x.edu", "/api/v2/users", "http://api-v2"},
+		"trailing slash in prefix": {"other.x.edu", "/api/v2", "http://api-v2"},
+		"host beats prefix":        {"search.x.edu", "/api/v2/users", "http://search-api"},
+		"host and other path":      {"search.x.edu", "/other", ""},
+		"default":                  {"other.x.edu", "/", ""},
+		"dot segments":             {"other.x.edu", "/api/v2/../../admin", ""},
+		"dot segments into prefix": {"other.x.edu", "/admin/../api/v2/x", "http://api-v2"},
+		"doubled slashes":          {"other.x.edu", "//api//v2/x", "http://api-v2"},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var got = rt.match(tc.host, tc.path)
+			if tc.want == "" {
+				if got != nil {
+					t.Errorf("got %s, want the default target", got)
+				}
+				return
+			}
+			if got == nil || got.String() != tc.want {
+				t.Errorf("got %v, want %s", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestRoutedProxying(t *testing.T) {
+	var named = func(name string) *upstream {
+		return newUpstream(t, func(w http.ResponseWriter, _ *http.Request) {
+			io.WriteString(w, name)
+		})
+	}
+	var def, api = named("default"), named("api")
+
+	var rt, err = loadRoutes(writeRoutes(t, "/api/ "+api.URL+"\n"))
+	if err != nil {
+		t.Fatalf("loadRoutes: %s", err)
+	}
+	var s = newTestServer(def.URL).SetRoutes(rt).
+		SetTrustedCIDRs([]netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")})
+	var ts = startServer(t, s)
+
+	var tests = map[string]string{
+		"/api":          "api",
+		"/api/users":    "api",
+		"/apiary":       "default",
+		"/api/../admin": "default",
+		"/":             "default",
+	}
+	for path, want := range tests {
+		t.Run(path, func(t *testing.T) {
+			// Built by hand so the client doesn't clean up the path itself
+			var req, _ = http.NewRequest(http.MethodGet, ts.URL, nil)
+			req.URL.Opaque = path
+			var resp, err = http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("GET %s: %s", path, err)
+			}
+			if got := readBody(t, resp); got != want {
+				t.Errorf("went to %q, want %q", got, want)
+			}
+		})
+	}
+}
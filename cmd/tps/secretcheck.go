@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"time"
+	"turnstile-proxy-server/internal/verifier"
+)
+
+// CheckSecretKey sends the verification provider a dummy token to find out
+// whether it accepts our secret key, and the secret key of each host-specific
+// verifier. The token is always rejected, but Turnstile (like most providers)
+// reports an unusable secret ("invalid-input-secret") separately from a bad
+// token ("invalid-input-response"), and that's all we care about here.
+func (s *Server) CheckSecretKey() error {
+	var err = checkSecret(s.verifier)
+	if err != nil {
+		return err
+	}
+	for host, v := range s.hostVerifiers {
+		err = checkSecret(v)
+		if err != nil {
+			return fmt.Errorf("host %q: %w", host, err)
+		}
+	}
+	return nil
+}
+
+func checkSecret(v verifier.Verifier) error {
+	var ctx, cancel = context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	var result, err = v.Verify(ctx, "tps-startup-check", "")
+	if err != nil {
+		return err
+	}
+	if slices.Contains(result.ErrorCodes, "invalid-input-secret") {
+		return fmt.Errorf("the secret key was rejected (error codes: %q)", result.ErrorCodes)
+	}
+	return nil
+}
@@ -2,20 +2,33 @@ package main
 
 import (
 	"bytes"
-	"encoding/json"
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"io/fs"
 	"log/slog"
+	"math"
 	"net/http"
 	"net/http/httputil"
+	"net/netip"
 	"net/url"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"text/template"
 	"time"
+	"turnstile-proxy-server/internal/breaker"
 	"turnstile-proxy-server/internal/db"
+	"turnstile-proxy-server/internal/geoip"
+	"turnstile-proxy-server/internal/i18n"
+	"turnstile-proxy-server/internal/ratelimit"
 	"turnstile-proxy-server/internal/requestid"
+	"turnstile-proxy-server/internal/templates"
+	"turnstile-proxy-server/internal/verifier"
+	"turnstile-proxy-server/session"
 
 	"github.com/gin-contrib/multitemplate"
 	"github.com/gin-gonic/gin"
@@ -24,39 +37,123 @@ import (
 	"github.com/spf13/afero"
 )
 
+// defaultCookieName is the session cookie's name unless
+// [Server.SetCookieName] says otherwise
+const defaultCookieName = session.DefaultCookieName
+
+// defaultVerifiedHeader is the header set on verified requests sent upstream
+// unless [Server.SetVerifiedHeader] says otherwise
+const defaultVerifiedHeader = "X-TPS-Verified"
+
+// requestIDHeader carries the request ID of a verified request upstream
+const requestIDHeader = "X-TPS-Request-ID"
+
+// defaultRequestCacheTTL is how long a challenged request is held for replay
+// unless [Server.SetCacheTTL] says otherwise
+const defaultRequestCacheTTL = 5 * time.Minute
+
+// How we treat "Expect: 100-continue" on requests we're going to challenge.
+// Go's HTTP server sends the interim 100 response automatically the first
+// time a handler reads the body, so [expectContinue] simply lets that happen
+// when we buffer the body for later replay. [expectReject] instead responds
+// with a 417 before reading anything, since the body won't be forwarded until
+// the challenge is passed anyway.
 const (
-	cookieName = "tps-jwt"
+	expectContinue = "continue"
+	expectReject   = "reject"
 )
 
 type cachedRequest struct {
+	Host    string
 	Method  string
 	Body    []byte
 	Headers http.Header
+	Trailer http.Header
 	URL     *url.URL
 }
 
-// cloudflareVerifyResponse is the structure of the JSON response from Cloudflare
-type cloudflareVerifyResponse struct {
-	Success     bool     `json:"success"`
-	ErrorCodes  []string `json:"error-codes"`
-	ChallengeTS string   `json:"challenge_ts"`
-	Hostname    string   `json:"hostname"`
-}
-
 // Server wraps a [gin.Engine], encapsulating the handlers' logic and data for
 // presenting the turnstile challenge, verifying the challenge, and finally
 // proxying successful requests
 type Server struct {
-	r             *gin.Engine
-	render        multitemplate.Renderer
-	logger        *slog.Logger
-	db            *db.Store
-	siteKey       string
-	secretKey     string
-	jwtSigningKey []byte
-	requestCache  *cache.Cache
-	proxyTarget   *url.URL
-	templates     map[string]string
+	r              *gin.Engine
+	logger         *slog.Logger
+	db             *db.Store
+	verifier       verifier.Verifier
+	hostVerifiers  map[string]verifier.Verifier
+	jwtSigningKey  []byte
+	requestCache   RequestCache
+	usedRequestIDs *cache.Cache
+	verifications  *cache.Cache
+	cacheTTL       time.Duration
+	proxyTarget    *url.URL
+	routes         routeTable
+	templates      atomic.Pointer[templateSet]
+	strictHeaders  bool
+	postVerifyMode string
+	expectMode     string
+
+	appearance        string
+	theme             string
+	failureAppearance string
+	failures          *cache.Cache
+	messages          *i18n.Catalog
+
+	maxCachedBytes    int64
+	cachedBytes       atomic.Int64
+	maxCachedRequests int
+
+	cookieName     string
+	cookieDomain   string
+	cookieSameSite http.SameSite
+	cookieSecure   bool
+
+	readHeaderTimeout time.Duration
+	readTimeout       time.Duration
+	writeTimeout      time.Duration
+	idleTimeout       time.Duration
+
+	logQueryParams  []string
+	logURLMaxLength int
+	logOutcomes     map[string]bool
+
+	maxURLLength    int
+	flushInterval   time.Duration
+	upstreamTimeout time.Duration
+	bindChallenge   bool
+	bindSession     bool
+	bypass          bool
+	verifyEndpoint  bool
+
+	blockedCIDRs   []netip.Prefix
+	trustedCIDRs   []netip.Prefix
+	publicPaths    []string
+	limiter        *ratelimit.Limiter
+	breaker        *breaker.Breaker
+	geoip          *geoip.DB
+	allowedOrigins []string
+	csp            *template.Template
+	verifiedHeader string
+	refreshWindow  time.Duration
+	maxSessionAge  time.Duration
+	assets         fs.FS
+	maintenance    atomic.Bool
+	adminUser      string
+	adminPass      string
+
+	upstreamMaxIdleConns        int
+	upstreamMaxIdleConnsPerHost int
+	upstreamIdleConnTimeout     time.Duration
+	upstreamInsecureTLS         bool
+	proxy                       *httputil.ReverseProxy
+	proxyOnce                   sync.Once
+
+	routesOnce sync.Once
+
+	templateMu          sync.Mutex
+	coreTemplateFS      afero.Fs
+	coreTemplatePattern string
+	customTemplatePath  string
 }
 
 // NewServer creates and configures a new Server instance. You must manually
@@ -65,22 +162,44 @@ type Server struct {
 // is set to [slog.Default]. Use the various SetX methods to
 // change these settings.
 func NewServer(router *gin.Engine, db *db.Store) *Server {
-	var requestCache = cache.New(5*time.Minute, 10*time.Minute)
 
-	var render = multitemplate.NewRenderer()
+	var testVerifier = verifier.NewTurnstile(verifier.Config{
+		SiteKey:   "1x00000000000000000000AA",
+		SecretKey: "1x0000000000000000000000000000000AA",
+	})
 
-	router.HTMLRender = render
 	var s = &Server{
-		r:            router,
-		db:           db,
-		render:       render,
-		logger:       slog.Default(),
-		siteKey:      "1x00000000000000000000AA",
-		secretKey:    "1x0000000000000000000000000000000AA",
-		requestCache: requestCache,
-		templates:    make(map[string]string),
+		r:              router,
+		db:             db,
+		logger:         slog.Default(),
+		verifier:       testVerifier,
+		hostVerifiers:  make(map[string]verifier.Verifier),
+		postVerifyMode: postVerifyReplay,
+		expectMode:     expectContinue,
+		appearance:     "always",
+		theme:          "auto",
+		failures:       cache.New(failureWindow, 10*time.Minute),
+		verifications:  cache.New(dedupeWindow, 2*dedupeWindow),
+		cookieSameSite: http.SameSiteLaxMode,
+		cookieSecure:   true,
+		maxURLLength:   8192,
+		verifiedHeader: defaultVerifiedHeader,
+		cookieName:     defaultCookieName,
+		refreshWindow:  defaultRefreshWindow,
+		maxSessionAge:  defaultMaxSessionAge,
+		messages:       i18n.Default(),
+
+		readHeaderTimeout: defaultReadHeaderTimeout,
+		idleTimeout:       defaultIdleTimeout,
+
+		upstreamMaxIdleConns:        defaultUpstreamMaxIdleConns,
+		upstreamMaxIdleConnsPerHost: defaultUpstreamMaxIdleConnsPerHost,
+		upstreamIdleConnTimeout:     defaultUpstreamIdleConnTimeout,
 	}
-	s.r.Any("/*proxyPath", s.handleProxy)
+	s.templates.Store(&templateSet{render: multitemplate.NewRenderer(), names: map[string]string{}})
+	router.HTMLRender = templateRender{s}
+	s.SetCacheTTL(defaultRequestCacheTTL)
+	s.SetCSP(defaultCSP)
 
 	return s
 }
@@ -91,15 +210,18 @@ func (s *Server) SetLogger(l *slog.Logger) *Server {
 	return s
 }
 
-// SetSecretKey sets the turnstile secret key and returns s for chaining
-func (s *Server) SetSecretKey(k string) *Server {
-	s.secretKey = k
+// SetVerifier sets the challenge verification provider and returns s for
+// chaining
+func (s *Server) SetVerifier(v verifier.Verifier) *Server {
+	s.verifier = v
 	return s
 }
 
-// SetSiteKey sets the turnstile site key and returns s for chaining
-func (s *Server) SetSiteKey(k string) *Server {
-	s.siteKey = k
+// SetHostVerifier sets a verifier to use instead of the default for requests
+// to the given hostname (without port), e.g., when each host is registered as
+// its own Turnstile widget with its own keys
+func (s *Server) SetHostVerifier(host string, v verifier.Verifier) *Server {
+	s.hostVerifiers[strings.ToLower(host)] = v
 	return s
 }
 
@@ -116,6 +238,14 @@ func (s *Server) SetProxyTarget(proxyTarget string) *Server {
 	return s
 }
 
+// SetRoutes sets a routing table for sending requests to different proxy
+// targets by host or path prefix. Requests that don't match any route go to
+// the proxy target.
+func (s *Server) SetRoutes(rt routeTable) *Server {
+	s.routes = rt
+	return s
+}
+
 // SetJWTSigningKey stores the given key for our tokens, which are used to tell
 // if a user has already completed a challenge.
 func (s *Server) SetJWTSigningKey(k string) *Server {
@@ -123,13 +253,302 @@ func (s *Server) SetJWTSigningKey(k string) *Server {
 	return s
 }
 
+// SetStrictHeaders turns on rejection of requests with suspicious header
+// anomalies (see [headerAnomaly]) and returns s for chaining
+func (s *Server) SetStrictHeaders(strict bool) *Server {
+	s.strictHeaders = strict
+	return s
+}
+
+// SetPostVerifyMode sets what happens after a successful challenge: either
+// [postVerifyReplay] or [postVerifyRedirect]. Any other value will panic.
+func (s *Server) SetPostVerifyMode(mode string) *Server {
+	if mode != postVerifyReplay && mode != postVerifyRedirect {
+		panic(fmt.Sprintf("invalid post-verify mode %q", mode))
+	}
+	s.postVerifyMode = mode
+	return s
+}
+
+// SetExpectMode sets how "Expect: 100-continue" is handled for requests that
+// will be challenged: either [expectContinue] or [expectReject]. Any other
+// value will panic.
+func (s *Server) SetExpectMode(mode string) *Server {
+	if mode != expectContinue && mode != expectReject {
+		panic(fmt.Sprintf("invalid expect mode %q", mode))
+	}
+	s.expectMode = mode
+	return s
+}
+
+// SetWidgetStyle sets the Turnstile widget's appearance and theme, and
+// optionally an appearance to use instead for clients that have repeatedly
+// failed challenges (empty to disable). Invalid values will panic.
+func (s *Server) SetWidgetStyle(appearance, theme, failureAppearance string) *Server {
+	if !validAppearance(appearance) {
+		panic(fmt.Sprintf("invalid widget appearance %q", appearance))
+	}
+	if !validTheme(theme) {
+		panic(fmt.Sprintf("invalid widget theme %q", theme))
+	}
+	if failureAppearance != "" && !validAppearance(failureAppearance) {
+		panic(fmt.Sprintf("invalid widget failure appearance %q", failureAppearance))
+	}
+
+	s.appearance = appearance
+	s.theme = theme
+	s.failureAppearance = failureAppearance
+	return s
+}
+
+// SetMaxCachedBytes caps the total size of request bodies held in memory while
+// their clients are being challenged. Once the cap is reached, new requests get
+// a "busy" page instead of a challenge until enough cached requests expire or
+// are replayed. Zero (the default) means no cap.
+func (s *Server) SetMaxCachedBytes(n int64) *Server {
+	s.maxCachedBytes = n
+	return s
+}
+
+// SetCookieOptions sets the domain, SameSite mode, and Secure flag of the
+// session cookie. By default the domain is empty (the cookie is only sent to
+// the exact host that set it), SameSite is Lax, and Secure is on. SameSite=None
+// without Secure will panic, as browsers reject such cookies.
+func (s *Server) SetCookieOptions(domain string, sameSite http.SameSite, secure bool) *Server {
+	if sameSite == http.SameSiteNoneMode && !secure {
+		panic("SameSite=None cookies must be Secure")
+	}
+
+	s.cookieDomain = domain
+	s.cookieSameSite = sameSite
+	s.cookieSecure = secure
+	return s
+}
+
+// SetCookieName sets the session cookie's name, so several TPS instances
+// sharing a domain can keep their sessions apart. An empty or invalid name
+// will panic.
+func (s *Server) SetCookieName(name string) *Server {
+	if !validCookieName(name) {
+		panic(fmt.Sprintf("invalid cookie name %q", name))
+	}
+	s.cookieName = name
+	return s
+}
+
+// SetCacheTTL sets how long a challenged request is held while the client
+// solves the challenge, and returns s for chaining. This replaces the request
+// cache, so it must be called before the server starts handling requests. A
+// non-positive TTL will panic.
+func (s *Server) SetCacheTTL(ttl time.Duration) *Server {
+	if ttl <= 0 {
+		panic("request cache TTL must be positive")
+	}
+	s.cacheTTL = ttl
+	s.resetRequestCache()
+	s.usedRequestIDs = cache.New(ttl, 2*ttl)
+	return s
+}
+
+// SetMaxURLLength sets the longest request URI (path and query) TPS will
+// accept; anything longer gets a 414. Zero disables the limit. The default is
+// 8192.
+func (s *Server) SetMaxURLLength(n int) *Server {
+	s.maxURLLength = n
+	return s
+}
+
+// refuseLongURL responds with a 414 if the request URI is longer than the
+// configured maximum (see [Server.SetMaxURLLength]), returning true if it did
+func (s *Server) refuseLongURL(c *gin.Context) bool {
+	if s.maxURLLength <= 0 || len(c.Request.RequestURI) <= s.maxURLLength {
+		return false
+	}
+
+	s.logger.Warn("Rejecting over-length URL", "length", len(c.Request.RequestURI), "max", s.maxURLLength, "clientIP", c.ClientIP())
+	c.String(http.StatusRequestURITooLong, "URI too long")
+	return true
+}
+
+// SetFlushInterval sets how often proxied response bodies are flushed to the
+// client while they're being copied. Zero (the default) buffers normally.
+// Server-Sent Events (text/event-stream) and other responses without a
+// Content-Length are always flushed immediately regardless of this setting.
+func (s *Server) SetFlushInterval(d time.Duration) *Server {
+	s.flushInterval = d
+	return s
+}
+
+// SetUpstreamTimeout bounds how long a single proxied request may take,
+// including streaming its response back to the client. Zero (the default)
+// means no limit beyond the client's own connection. Protocol upgrades like
+// WebSockets are never bounded, since they're meant to stay open.
+func (s *Server) SetUpstreamTimeout(d time.Duration) *Server {
+	s.upstreamTimeout = d
+	return s
+}
+
+// Defaults for the listening server's timeouts: long enough for any real
+// client, short enough that idle or trickling connections can't pile up. Read
+// and write timeouts default to zero (no limit) so long uploads and streamed
+// responses aren't cut off.
+const (
+	defaultReadHeaderTimeout = 10 * time.Second
+	defaultIdleTimeout       = 120 * time.Second
+)
+
+// SetServerTimeouts sets the listening server's timeouts (see [http.Server])
+// and returns s for chaining. Zero means no limit, except that a zero
+// readHeader falls back to read, as in net/http. Protocol upgrades like
+// WebSockets escape the read and write timeouts once the connection has been
+// handed off to the upstream, but Server-Sent Events and other long
+// responses are cut off by a non-zero write timeout.
+func (s *Server) SetServerTimeouts(readHeader, read, write, idle time.Duration) *Server {
+	s.readHeaderTimeout = readHeader
+	s.readTimeout = read
+	s.writeTimeout = write
+	s.idleTimeout = idle
+	return s
+}
+
+// SetBindChallenge turns on the double-submit check tying each verification to
+// the browser its challenge was served to (see [bindingCookieName]) and
+// returns s for chaining
+func (s *Server) SetBindChallenge(bind bool) *Server {
+	s.bindChallenge = bind
+	return s
+}
+
+// SetBindSession turns on binding each issued token to the client IP and
+// User-Agent it was issued to, and returns s for chaining. Tokens presented by
+// a different client are treated as invalid.
+func (s *Server) SetBindSession(bind bool) *Server {
+	s.bindSession = bind
+	return s
+}
+
+// SetBypass turns verification bypass on or off and returns s for chaining.
+// With bypass on, the provider is never contacted: any verification POST for
+// a cached request ID succeeds, with or without a widget response. This is
+// for local development and CI only, and must never be used in production.
+func (s *Server) SetBypass(bypass bool) *Server {
+	s.bypass = bypass
+	return s
+}
+
+// SetBlockedCIDRs sets the client IP ranges which are always refused with a
+// 403, and returns s for chaining. Prefixes should come from [parseCIDRs].
+func (s *Server) SetBlockedCIDRs(prefixes []netip.Prefix) *Server {
+	s.blockedCIDRs = prefixes
+	return s
+}
+
+// SetTrustedCIDRs sets the client IP ranges which are proxied without ever
+// being challenged, and returns s for chaining. Prefixes should come from
+// [parseCIDRs].
+func (s *Server) SetTrustedCIDRs(prefixes []netip.Prefix) *Server {
+	s.trustedCIDRs = prefixes
+	return s
+}
+
+// SetPublicPaths sets the path patterns which are proxied without a challenge
+// or token (see [Server.isPublic]), and returns s for chaining. Patterns
+// should come from [parsePublicPaths].
+func (s *Server) SetPublicPaths(patterns []string) *Server {
+	s.publicPaths = patterns
+	return s
+}
+
+// SetAllowedOrigins sets the hostnames, besides the protected host itself,
+// that may submit verification POSTs (see [Server.checkOrigin]), and returns
+// s for chaining
+func (s *Server) SetAllowedOrigins(hosts []string) *Server {
+	s.allowedOrigins = hosts
+	return s
+}
+
+// SetVerifiedHeader sets the name of the header, set to "1", which marks
+// requests TPS has verified when they're proxied upstream, and returns s for
+// chaining. The request ID always goes in X-TPS-Request-ID. An empty name
+// will panic.
+func (s *Server) SetVerifiedHeader(name string) *Server {
+	if name == "" {
+		panic("verified header name must not be empty")
+	}
+	s.verifiedHeader = http.CanonicalHeaderKey(name)
+	return s
+}
+
+// SetSessionRefresh sets how close to expiring a valid token must be before
+// it's transparently reissued, and the max age of a session no matter how
+// often it's refreshed, then returns s for chaining. A zero window disables
+// refreshing; a zero max age means sessions can be refreshed forever.
+// Negative values will panic.
+func (s *Server) SetSessionRefresh(window, maxAge time.Duration) *Server {
+	if window < 0 || maxAge < 0 {
+		panic("session refresh window and max age must not be negative")
+	}
+	s.refreshWindow = window
+	s.maxSessionAge = maxAge
+	return s
+}
+
+// SetRateLimit limits challenges and verification attempts to rps per second
+// per client IP, with bursts of up to burst, and returns s for chaining.
+// Requests with a valid token are never limited. An rps of zero disables rate
+// limiting.
+func (s *Server) SetRateLimit(rps float64, burst int) *Server {
+	if rps == 0 {
+		s.limiter = nil
+		return s
+	}
+	s.limiter = ratelimit.New(rps, burst)
+	return s
+}
+
+// defaultBreakerCooldown is how long a tripped circuit breaker waits before
+// probing the upstream, unless configured otherwise
+const defaultBreakerCooldown = 30 * time.Second
+
+// SetCircuitBreaker stops proxying to an upstream after threshold consecutive
+// failures (connection errors, timeouts, or 5xx responses), and returns s for
+// chaining. While an upstream's circuit is open, requests for it get a 503
+// right away; after cooldown, one request at a time is let through to see if
+// it has recovered. A threshold of zero disables the breaker.
+func (s *Server) SetCircuitBreaker(threshold int, cooldown time.Duration) *Server {
+	if threshold == 0 {
+		s.breaker = nil
+		return s
+	}
+	s.breaker = breaker.New(threshold, cooldown)
+	return s
+}
+
+// SetMaintenance turns maintenance mode on or off and returns s for chaining.
+// In maintenance mode, every request that would be challenged or proxied gets
+// the maintenance page instead. It can also be toggled at runtime via the
+// admin endpoint.
+func (s *Server) SetMaintenance(on bool) *Server {
+	s.maintenance.Store(on)
+	return s
+}
+
+// SetAdminCredentials sets the HTTP basic auth credentials for admin
+// endpoints under [reservedPrefix], and returns s for chaining. Admin
+// endpoints are disabled unless both are non-empty.
+func (s *Server) SetAdminCredentials(user, pass string) *Server {
+	s.adminUser = user
+	s.adminPass = pass
+	return s
+}
+
 // LoadCoreTemplates is a general-case helper to load either from local disk
 // for hot-reloads, or from an embedded filesystem, depending on the gin mode
 func (s *Server) LoadCoreTemplates(pattern string, fsys fs.FS) {
 	var from string
 	var af afero.Fs
 	if gin.Mode() == gin.ReleaseMode {
-		af = afero.FromIOFS{fsys}
+		af = afero.FromIOFS{FS: fsys}
 		pattern = "*.go.html"
 		from = "io/fs.FS"
 	} else {
@@ -137,88 +556,190 @@ func (s *Server) LoadCoreTemplates(pattern string, fsys fs.FS) {
 		from = "OS Filesystem"
 	}
 
-	var templates, err = afero.Glob(af, pattern)
+	s.templateMu.Lock()
+	s.coreTemplateFS = af
+	s.coreTemplatePattern = pattern
+	s.templateMu.Unlock()
+
+	var err = s.ReloadTemplates()
 	if err != nil {
 		s.logger.Error("Cannot load core templates", "from", from, "pattern", pattern, "error", err)
 		panic("Fatal error, cannot continue without templates")
 	}
-
-	for _, pth := range templates {
-		if strings.HasSuffix(pth, ".go.html") {
-			var name = "core/" + strings.Replace(filepath.Base(pth), ".go.html", "", 1)
-			s.logger.Debug("Adding core template", "name", name, "path", pth)
-			s.render.AddFromFS(name, afero.NewIOFS(af), pth)
-			s.templates[name] = pth
-		}
-	}
-
-	return
 }
 
 // LoadCustomTemplates finds all templates under the given path named
 // "*.html.go" and registers them for use as custom templates for specific
-// proxied URLs' challenge and failed pages.
+// proxied URLs' challenge and failed pages. Core templates must already be
+// loaded.
 func (s *Server) LoadCustomTemplates(templatePath string) {
-	if templatePath == "" {
-		return
-	}
-
-	var err = filepath.Walk(templatePath, func(pth string, info fs.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-
-		if !info.Mode().IsRegular() {
-			return err
-		}
+	s.templateMu.Lock()
+	s.customTemplatePath = templatePath
+	s.templateMu.Unlock()
 
-		if strings.HasSuffix(pth, ".go.html") {
-			var name = strings.Replace(pth, templatePath+"/", "", 1)
-			name = strings.Replace(name, ".go.html", "", 1)
-			s.logger.Debug("Adding custom template", "name", name, "path", pth)
-			s.render.AddFromFiles(name, pth)
-			s.templates[name] = pth
-		}
-		return err
-	})
+	var err = s.ReloadTemplates()
 	if err != nil {
 		s.logger.Error("Failed to load custom templates", "path", templatePath, "error", err)
 	}
 }
 
-// Run starts the server listening on the configured address
-func (s *Server) Run(addr string) error {
+// validate returns an error if a setting TPS can't run without is missing
+func (s *Server) validate() error {
 	if len(s.jwtSigningKey) == 0 {
 		return errors.New("empty JWT signing key")
 	}
 	if s.proxyTarget == nil {
 		return errors.New("empty proxy target")
 	}
-	s.r.HTMLRender = s.render
+	return nil
+}
+
+// Handler returns the fully configured router without starting a listener,
+// so TPS can be served by another [http.Server] or mounted in a larger app.
+// It registers TPS's routes on the router passed to [NewServer] (only once,
+// however many times it's called), and loads the embedded core templates if
+// none have been loaded. Like the setters, it panics if the server is
+// misconfigured: the JWT signing key and proxy target must be set.
+//
+// TPS must see the same paths the browser uses, so don't strip a prefix
+// before handing requests to it. Everything under /_tps/ belongs to TPS, and
+// every other path it's given is challenged or proxied.
+func (s *Server) Handler() http.Handler {
+	var err = s.validate()
+	if err != nil {
+		panic(err.Error())
+	}
+
+	s.routesOnce.Do(func() {
+		s.registerReservedRoutes()
+		s.r.NoRoute(s.handleProxy)
+	})
+	s.r.HTMLRender = templateRender{s}
+
+	s.templateMu.Lock()
+	var loaded = s.coreTemplateFS != nil
+	if !loaded {
+		s.coreTemplateFS = afero.FromIOFS{FS: templates.FS}
+		s.coreTemplatePattern = "*.go.html"
+	}
+	s.templateMu.Unlock()
+	if !loaded {
+		err = s.ReloadTemplates()
+		if err != nil {
+			panic("cannot load embedded templates: " + err.Error())
+		}
+	}
+
+	return s.r
+}
+
+// httpServer returns the server [Server.Run] listens with, serving handler on
+// addr with s's timeouts
+func (s *Server) httpServer(addr string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: s.readHeaderTimeout,
+		ReadTimeout:       s.readTimeout,
+		WriteTimeout:      s.writeTimeout,
+		IdleTimeout:       s.idleTimeout,
+	}
+}
+
+// Run starts the server listening on the configured address, and shuts it down
+// gracefully once ctx is canceled
+func (s *Server) Run(ctx context.Context, addr string) error {
+	var err = s.validate()
+	if err != nil {
+		return err
+	}
+	var handler = s.Handler()
 
 	logger.Debug(
 		fmt.Sprintf("s.r.Run(%q)", bindAddr),
-		"s.siteKey", s.siteKey,
-		"s.secretKey", s.secretKey,
-		"s.jwtSigningKey", s.jwtSigningKey,
+		"s.verifier", fmt.Sprintf("%T", s.verifier),
+		"s.verifier.SiteKey()", s.verifier.SiteKey(),
+		"s.hostVerifiers", len(s.hostVerifiers),
+		"s.jwtSigningKey", len(s.jwtSigningKey) > 0,
 		"s.proxyTarget", s.proxyTarget,
-		"s.templates", s.templates,
+		"s.routes", len(s.routes),
+		"s.templates", s.templates.Load().names,
+		"s.strictHeaders", s.strictHeaders,
+		"s.postVerifyMode", s.postVerifyMode,
+		"s.expectMode", s.expectMode,
+		"s.appearance", s.appearance,
+		"s.theme", s.theme,
+		"s.failureAppearance", s.failureAppearance,
+		"s.messages", s.messages.Languages(),
+		"s.messages.Fallback()", s.messages.Fallback(),
+		"s.maxCachedBytes", s.maxCachedBytes,
+		"s.maxCachedRequests", s.maxCachedRequests,
+		"s.cookieName", s.cookieName,
+		"s.cookieDomain", s.cookieDomain,
+		"s.cookieSameSite", s.cookieSameSite,
+		"s.cookieSecure", s.cookieSecure,
+		"s.readHeaderTimeout", s.readHeaderTimeout,
+		"s.readTimeout", s.readTimeout,
+		"s.writeTimeout", s.writeTimeout,
+		"s.idleTimeout", s.idleTimeout,
+		"s.logQueryParams", s.logQueryParams,
+		"s.logURLMaxLength", s.logURLMaxLength,
+		"s.logOutcomes", s.logOutcomes,
+		"s.maxURLLength", s.maxURLLength,
+		"s.flushInterval", s.flushInterval,
+		"s.upstreamTimeout", s.upstreamTimeout,
+		"s.upstreamMaxIdleConns", s.upstreamMaxIdleConns,
+		"s.upstreamMaxIdleConnsPerHost", s.upstreamMaxIdleConnsPerHost,
+		"s.upstreamIdleConnTimeout", s.upstreamIdleConnTimeout,
+		"s.upstreamInsecureTLS", s.upstreamInsecureTLS,
+		"s.breaker", s.breaker != nil,
+		"s.geoip", s.geoip != nil,
+		"s.bindChallenge", s.bindChallenge,
+		"s.bindSession", s.bindSession,
+		"s.bypass", s.bypass,
+		"s.verifyEndpoint", s.verifyEndpoint,
+		"s.blockedCIDRs", s.blockedCIDRs,
+		"s.trustedCIDRs", s.trustedCIDRs,
+		"s.publicPaths", s.publicPaths,
+		"s.limiter", s.limiter != nil,
+		"s.cacheTTL", s.cacheTTL,
+		"s.allowedOrigins", s.allowedOrigins,
+		"s.verifiedHeader", s.verifiedHeader,
+		"s.refreshWindow", s.refreshWindow,
+		"s.maxSessionAge", s.maxSessionAge,
+		"s.maintenance", s.maintenance.Load(),
+		"s.adminUser", s.adminUser,
 	)
-	return s.r.Run(addr)
-}
 
-func (s *Server) getTemplate(r *http.Request, shortname string) string {
-	var host = r.URL.Hostname()
-	var path = r.URL.Path
+	var srv = s.httpServer(addr, handler)
+	var errCh = make(chan error, 1)
+	go func() { errCh <- srv.ListenAndServe() }()
 
-	// Clean the path to prevent directory traversal issues
-	path = filepath.Clean(path)
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+	}
 
-	// Remove leading slash
-	if len(path) > 0 && path[0] == '/' {
-		path = path[1:]
+	s.logger.Info("Shutting down server")
+	var shutdownCtx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	err = srv.Shutdown(shutdownCtx)
+	if err != nil {
+		return err
+	}
+	err = <-errCh
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
 	}
+	return err
+}
+
+func (s *Server) getTemplate(r *http.Request, shortname string) string {
+	var host = r.URL.Hostname()
+	var path = cleanPath(r.URL.Path)
 
+	var ts = s.templates.Load()
 	var parts = strings.Split(path, "/")
 	if len(parts) == 1 && parts[0] == "" {
 		parts = []string{}
@@ -228,7 +749,7 @@ func (s *Server) getTemplate(r *http.Request, shortname string) string {
 		var source = host + "/" + strings.Join(parts[:i], "/")
 		s.logger.Debug("Looking for template", "source", source, "shortname", shortname)
 		var name = filepath.Join(source, shortname)
-		var template = s.templates[name]
+		var template = ts.names[name]
 		if template != "" {
 			s.logger.Debug("Found custom template", "name", name)
 			return name
@@ -239,148 +760,405 @@ func (s *Server) getTemplate(r *http.Request, shortname string) string {
 	return "core/" + shortname
 }
 
+// handleProxy is the catch-all handler for everything TPS doesn't serve
+// itself, logging a single access line for each request once it's done
 func (s *Server) handleProxy(c *gin.Context) {
-	s.logger.Debug("handleProxy: checking for JWT")
-	var cookie, err = c.Cookie(cookieName)
-	if err == nil {
-		var _, parseErr = jwt.Parse(cookie, func(token *jwt.Token) (interface{}, error) {
-			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-				return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-			}
-			return s.jwtSigningKey, nil
-		})
+	var start = time.Now()
+	s.serveProxy(c)
+	s.logAccess(c, start)
+}
 
-		if parseErr == nil {
-			s.logger.Info("JWT is valid, proxying request", "URL", c.Request.URL.String())
-			s.db.LogRequest(db.RequestLog{
-				ClientIP:      c.ClientIP(),
-				Timestamp:     time.Now(),
-				URL:           c.Request.URL.String(),
-				HadValidToken: true,
+// serveProxy decides what to do with a request: challenge it, verify a
+// challenge response, or send it upstream
+func (s *Server) serveProxy(c *gin.Context) {
+	// Reserved paths only get here if no reserved route matched, e.g., the
+	// wrong method or a typo. They must never reach the proxy.
+	if isReserved(c.Request.URL.Path) {
+		c.String(http.StatusNotFound, "Not found")
+		return
+	}
+
+	// Blocked networks are turned away before they can cost us anything, even
+	// if they're also in a trusted range
+	if s.refuseBlocked(c) || s.refuseMaintenance(c) || s.refuseAnomalous(c) || s.refuseLongURL(c) {
+		return
+	}
+
+	// Trusted networks, like monitoring or office ranges, skip every check a
+	// bot might trip, and never get a session cookie
+	if clientInPrefixes(c, s.trustedCIDRs) {
+		s.logger.Debug("Client IP is trusted, proxying without a challenge", "clientIP", c.ClientIP(), "URL", c.Request.URL.String())
+		accessFor(c).outcome = outcomeTrusted
+		if s.shouldLog(logTrusted) {
+			s.logRequest(c, db.RequestLog{
+				ClientIP:       c.ClientIP(),
+				Host:           requestHost(c.Request),
+				Timestamp:      time.Now(),
+				URL:            s.sanitizeLogURL(c.Request.URL),
+				UserAgent:      c.Request.UserAgent(),
+				Referer:        c.Request.Referer(),
+				BypassedByCIDR: true,
 			})
-			s.replayRequest(c, c.Request)
-			return
 		}
-		s.logger.Warn("Failed to parse JWT", "error", parseErr)
+		s.replayRequest(c, c.Request, false, "", false)
+		return
 	}
 
-	// Not a valid session, check if this is a verification attempt
-	s.logger.Debug("handleProxy: checking request for turnstile POST")
-	var turnstileResponse = c.PostForm("cf-turnstile-response")
-	var requestID = c.PostForm("request_id")
-	if c.Request.Method == "POST" && turnstileResponse != "" && requestID != "" {
-		s.logger.Info("Received turnstile response, attempting verification", "requestID", requestID)
-
-		var verifyURL = "https://challenges.cloudflare.com/turnstile/v0/siteverify"
-		var client = &http.Client{Timeout: 10 * time.Second}
-		var resp, err = client.PostForm(verifyURL, url.Values{"secret": {s.secretKey}, "response": {turnstileResponse}})
-		if err != nil {
-			s.logger.Error("Failed to POST to Cloudflare", "error", err)
-			c.String(http.StatusInternalServerError, "Failed to verify token")
-			return
-		}
-		defer resp.Body.Close()
+	if s.isPublic(c.Request.URL.Path) {
+		s.logger.Debug("Public path, proxying without a challenge", "URL", c.Request.URL.String())
+		accessFor(c).outcome = outcomeProxy
+		s.replayRequest(c, c.Request, false, "", false)
+		return
+	}
 
-		var verifyResp cloudflareVerifyResponse
-		err = json.NewDecoder(resp.Body).Decode(&verifyResp)
-		if err != nil {
-			s.logger.Error("Failed to decode Cloudflare response", "error", err)
-			c.String(http.StatusInternalServerError, "Failed to decode Cloudflare response")
+	s.logger.Debug("handleProxy: checking for JWT")
+	var token = s.requestToken(c)
+	if token != "" {
+		var claims, parseErr = s.validateToken(c, token)
+		switch {
+		case parseErr != nil:
+			s.logger.Warn("Failed to parse JWT", "error", parseErr)
+		case s.resubmittedChallenge(c):
+			s.logger.Info("JWT is valid, but handling a resubmitted challenge form as a verification", "URL", c.Request.URL.String())
+		default:
+			s.logger.Info("JWT is valid, proxying request", "URL", c.Request.URL.String())
+			s.refreshToken(c, claims)
+			if s.shouldLog(logValidToken) {
+				s.logRequest(c, db.RequestLog{
+					ClientIP:      c.ClientIP(),
+					Host:          requestHost(c.Request),
+					Timestamp:     time.Now(),
+					URL:           s.sanitizeLogURL(c.Request.URL),
+					HadValidToken: true,
+					UserAgent:     c.Request.UserAgent(),
+					Referer:       c.Request.Referer(),
+				})
+			}
+			accessFor(c).outcome = outcomeProxy
+			s.replayRequest(c, c.Request, true, session.RequestID(claims), false)
 			return
 		}
+	}
 
-		if verifyResp.Success {
-			s.logger.Info("Turnstile verification successful")
-			s.db.LogRequest(db.RequestLog{
-				ClientIP:              c.ClientIP(),
-				Timestamp:             time.Now(),
-				URL:                   c.Request.URL.String(),
-				WasPresentedChallenge: true,
-				ChallengeSucceeded:    true,
-			})
-			s.issueTokenAndReplay(c, requestID)
-		} else {
-			s.logger.Warn("Turnstile verification failed", "error-codes", verifyResp.ErrorCodes)
-			s.db.LogRequest(db.RequestLog{
-				ClientIP:              c.ClientIP(),
-				Timestamp:             time.Now(),
-				URL:                   c.Request.URL.String(),
-				WasPresentedChallenge: true,
-				ChallengeSucceeded:    false,
-			})
-			c.HTML(http.StatusUnauthorized, s.getTemplate(c.Request, "failed"), nil)
-		}
+	// Not a valid session, so anything from here on may cost us a cached
+	// request or a siteverify call
+	if s.refuseRateLimited(c) {
 		return
 	}
 
-	// This is a new request, cache it and serve the challenge
-	s.logger.Debug("handleProxy: new request, presenting challenge")
-	var newRequestID = requestid.New()
-	var body, readErr = io.ReadAll(c.Request.Body)
+	// If the client is waiting on a 100 Continue and we
+	// don't want its body, we have to say so before anything reads it.
+	if s.expectMode == expectReject && strings.EqualFold(c.GetHeader("Expect"), "100-continue") {
+		s.logger.Info("Rejecting Expect: 100-continue on unverified request", "URL", c.Request.URL.String())
+		c.String(http.StatusExpectationFailed, "Verification required before sending a request body")
+		return
+	}
+
+	// Buffer the body before anything else reads it. Parsing the form below
+	// would otherwise consume a form POST's body, leaving nothing to replay
+	// if this turns out to be a new request rather than a verification. A
+	// body that could never fit in the request cache isn't read past the cap,
+	// so it can't use more memory than the cap allows.
+	var bodyReader = c.Request.Body
+	if limit := s.bodyReadLimit(); limit > 0 {
+		bodyReader = http.MaxBytesReader(c.Writer, c.Request.Body, limit)
+	}
+	var body, readErr = io.ReadAll(bodyReader)
+	var tooLarge *http.MaxBytesError
+	if errors.As(readErr, &tooLarge) {
+		s.logger.Warn("Rejecting request body larger than the request cache", "URL", c.Request.URL.String(), "max", tooLarge.Limit)
+		c.String(http.StatusRequestEntityTooLarge, "Request body too large")
+		return
+	}
 	if readErr != nil {
 		s.logger.Error("Could not read original request body", "error", readErr)
 		c.String(http.StatusInternalServerError, "Could not buffer request")
 		return
 	}
-	var cachedReq = &cachedRequest{
-		Method:  c.Request.Method,
-		Body:    body,
-		Headers: c.Request.Header,
-		URL:     c.Request.URL,
+	c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+	// Check if this is a verification attempt
+	s.logger.Debug("handleProxy: checking request for turnstile POST")
+	if s.isVerification(c) {
+		s.verify(c)
+		return
+	}
+
+	// This is a new request, cache it and serve the challenge
+	s.logger.Debug("handleProxy: new request, presenting challenge")
+	s.presentChallenge(c, newCachedRequest(c.Request, body), "")
+}
+
+// challengeTime parses when the provider says the challenge was solved. It's
+// zero if the provider didn't say, or said something we can't parse.
+func challengeTime(r verifier.Result) time.Time {
+	var t, err = time.Parse(time.RFC3339, r.ChallengeTS)
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
+
+// presentChallenge caches req under a new request ID and renders the challenge
+// page for it, with an optional message for the user, given as a message
+// catalog key
+func (s *Server) presentChallenge(c *gin.Context, req *cachedRequest, messageKey string) {
+	if !s.reserveCacheBytes(int64(len(req.Body))) {
+		s.logger.Warn("Request cache is full, serving busy page", "bodyBytes", len(req.Body), "cachedBytes", s.cachedBytes.Load())
+		c.Header("Retry-After", "60")
+		s.html(c, http.StatusServiceUnavailable, "busy", nil)
+		return
+	}
+
+	var newRequestID = requestid.New()
+	s.requestCache.Set(newRequestID, req)
+	if s.bindChallenge {
+		s.setBindingCookie(c, newRequestID)
 	}
-	s.requestCache.Set(newRequestID, cachedReq, cache.DefaultExpiration)
 	s.logger.Info("No/invalid JWT, serving challenge", "requestID", newRequestID)
-	c.HTML(http.StatusOK, s.getTemplate(c.Request, "challenge"), gin.H{
-		"SiteKey":    s.siteKey,
-		"RequestID":  newRequestID,
-		"PostAction": c.Request.URL,
-	})
+	var access = accessFor(c)
+	access.outcome = outcomeChallenge
+	access.requestID = newRequestID
+	var v = s.verifierFor(c.Request)
+
+	// API clients get enough information to render their own widget
+	if wantsJSON(c) {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error":             "challenge_required",
+			"message":           "Complete the challenge and POST the response to verify_url",
+			"verify_url":        s.postAction(req),
+			"request_id":        newRequestID,
+			"site_key":          v.SiteKey(),
+			"widget_script_url": v.WidgetScriptURL(),
+			"response_field":    v.ResponseField(),
+			"action":            challengeAction(req.URL.Path),
+			"cdata":             newRequestID,
+			"expires_in":        int(s.cacheTTL.Seconds()),
+		})
+		return
+	}
+
+	var nonce = requestid.New()
+	if s.csp != nil {
+		var policy, err = s.contentSecurityPolicy(nonce, v.WidgetScriptURL())
+		if err != nil {
+			s.logger.Error("Unable to render Content-Security-Policy", "error", err)
+		} else {
+			c.Header("Content-Security-Policy", policy)
+		}
+	}
+
+	var message string
+	if messageKey != "" {
+		message = s.messages.Translate(s.language(c.Request), messageKey)
+	}
+
+	var data = gin.H{
+		"AssetBase":       assetBase,
+		"Nonce":           nonce,
+		"SiteKey":         v.SiteKey(),
+		"WidgetScriptURL": v.WidgetScriptURL(),
+		"RequestID":       newRequestID,
+		"PostAction":      s.postAction(req),
+		"Appearance":      s.appearanceFor(c.ClientIP()),
+		"Theme":           s.theme,
+		"Message":         message,
+		"ExpiresIn":       int(s.cacheTTL.Seconds()),
+		"Action":          challengeAction(req.URL.Path),
+		"CData":           newRequestID,
+		"OriginalMethod":  req.Method,
+		"OriginalURL":     req.URL.RequestURI(),
+		"OriginalSig":     s.signOriginal(req.Method, req.URL.RequestURI()),
+	}
+	if s.postVerifyMode == postVerifyRedirect {
+		var returnTo = req.URL.RequestURI()
+		data["ReturnTo"] = returnTo
+		data["ReturnSig"] = s.signReturnTo(returnTo)
+	}
+	s.html(c, http.StatusOK, "challenge", data)
 }
 
-func (s *Server) replayRequest(c *gin.Context, req *http.Request) {
-	var director = func(req *http.Request) {
-		req.URL.Scheme = s.proxyTarget.Scheme
-		req.URL.Host = s.proxyTarget.Host
-		req.Host = s.proxyTarget.Host
+// requestToken returns the JWT from the session cookie if present, otherwise
+// from [tokenHeader], which is how client-side apps send a token they got via
+// the post-verification redirect
+func (s *Server) requestToken(c *gin.Context) string {
+	var cookie, err = c.Cookie(s.cookieName)
+	if err == nil && cookie != "" {
+		return cookie
 	}
-	var proxy = &httputil.ReverseProxy{Director: director}
-	proxy.ServeHTTP(c.Writer, req)
+	return c.GetHeader(tokenHeader)
 }
 
-func (s *Server) issueTokenAndReplay(c *gin.Context, requestID string) {
-	var claims = jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"iss": "tps",
-		"aud": "caddy",
-		"iat": time.Now().Unix(),
-		"exp": time.Now().Add(24 * time.Hour).Unix(),
-		"nbf": time.Now().Unix(),
-	})
+// validateToken parses and verifies a JWT we issued, including its max session
+// age and its client binding if session binding is on, returning its claims
+func (s *Server) validateToken(c *gin.Context, token string) (jwt.MapClaims, error) {
+	var claims, err = session.Parse(token, s.jwtSigningKey, s.maxSessionAge)
+	if err != nil {
+		return nil, err
+	}
+	if s.bindSession {
+		err = s.checkSessionBinding(c, claims)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return claims, nil
+}
 
-	var tokenString, err = claims.SignedString(s.jwtSigningKey)
+// targetFor returns the proxy target for req: the matching route's target if
+// there is one, otherwise the default proxy target
+func (s *Server) targetFor(req *http.Request) *url.URL {
+	var target = s.routes.match(requestHost(req), req.URL.Path)
+	if target != nil {
+		return target
+	}
+	return s.proxyTarget
+}
+
+// replayRequest proxies req to its target and copies the upstream response
+// back to the client as-is. Upstream status codes are never interpreted: in
+// particular a 401 or 403 from the app's own auth is the app's business, and
+// must reach the client untouched rather than being mistaken for a failed or
+// missing TPS session, which would send the client into a challenge loop. TPS
+// only ever challenges based on its own token, before anything is proxied.
+//
+// The one exception is justVerified, for replaying the original request right
+// after the client passed a challenge. There, a 5xx from the upstream is
+// replaced by the "unavailable" page telling the user they're verified, so
+// they don't think the challenge failed. The session cookie is already set,
+// so simply retrying later works.
+//
+// Verified requests are marked for the upstream app with the verified header
+// and requestID, the request ID of the challenge behind the client's session
+// (see [Server.SetVerifiedHeader]). requestID may be empty for sessions that
+// predate it being recorded, in which case only the verified header is set.
+// Requests that weren't verified, e.g., for public paths, aren't marked.
+// Either way, any copies the client sent are removed first, so they can't be
+// spoofed.
+func (s *Server) replayRequest(c *gin.Context, req *http.Request, verified bool, requestID string, justVerified bool) {
+	// Last line of defense: whatever path got us here, nothing in the reserved
+	// namespace is ever sent upstream
+	if isReserved(req.URL.Path) {
+		s.logger.Warn("Refusing to proxy reserved path", "URL", req.URL.String())
+		c.String(http.StatusNotFound, "Not found")
+		return
+	}
+
+	var target = s.targetFor(req)
+	if s.breaker != nil {
+		var ok, wait = s.breaker.Allow(target.Host)
+		if !ok {
+			s.logger.Warn("Upstream circuit is open, not proxying", "target", target.Host, "URL", req.URL.String())
+			accessFor(c).outcome = outcomeUnavailable
+			c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			s.html(c, http.StatusServiceUnavailable, "unavailable", gin.H{"Verified": justVerified})
+			return
+		}
+	}
+
+	// ReverseProxy already flushes every write immediately for SSE responses
+	// (and any response of unknown length), so FlushInterval only changes how
+	// ordinary, fixed-length responses are streamed.
+	//
+	// Hop-by-hop headers (RFC 9110 section 7.6.1) are stripped from both the
+	// request and response by ReverseProxy after the director runs, except for
+	// protocol upgrades like WebSockets: there it keeps "Connection: Upgrade"
+	// and "Upgrade", then hijacks the client connection and copies bytes in
+	// both directions once the upstream answers with a 101. Our writer (gin's,
+	// wrapped by slog-gin) supports both flushing and hijacking, so nothing
+	// else is needed here.
+	if isUpgrade(req) {
+		s.logger.Debug("Proxying protocol upgrade", "upgrade", req.Header.Get("Upgrade"), "URL", req.URL.String())
+	} else if s.upstreamTimeout > 0 {
+		var ctx, cancel = context.WithTimeout(req.Context(), s.upstreamTimeout)
+		defer cancel()
+		req = req.WithContext(ctx)
+	}
+	var access = accessFor(c)
+	if requestID != "" {
+		access.requestID = requestID
+	}
+	var call = &proxyCall{c: c, access: access, target: target, verified: verified, requestID: requestID, justVerified: justVerified}
+	req = req.WithContext(context.WithValue(req.Context(), proxyCallKey{}, call))
+
+	var start = time.Now()
+	s.reverseProxy().ServeHTTP(c.Writer, req)
+	access.upstreamLatency = time.Since(start)
+}
+
+// upstreamUnavailableError stops a 5xx upstream response from being sent to a
+// client that just passed a challenge (see [Server.replayRequest])
+type upstreamUnavailableError struct {
+	status     int
+	retryAfter string
+}
+
+func (e upstreamUnavailableError) Error() string {
+	return fmt.Sprintf("upstream returned %d after verification", e.status)
+}
+
+// verifiedButUnavailable tells a client that just passed a challenge that the
+// app itself is having trouble, passing along the app's Retry-After if any
+func (s *Server) verifiedButUnavailable(c *gin.Context, err upstreamUnavailableError) {
+	s.logger.Warn("Upstream failed the replay of a verified request", "status", err.status, "URL", c.Request.URL.String())
+	if err.retryAfter != "" {
+		c.Header("Retry-After", err.retryAfter)
+	}
+	s.html(c, http.StatusServiceUnavailable, "unavailable", gin.H{"Verified": true})
+}
+
+// recordUpstream tells the circuit breaker, if there is one, whether a call to
+// the given upstream host worked
+func (s *Server) recordUpstream(host string, ok bool) {
+	if s.breaker == nil {
+		return
+	}
+	if ok {
+		s.breaker.Success(host)
+		return
+	}
+	s.breaker.Failure(host)
+}
+
+// proxyError reports a failure to reach the upstream app: a 504 if it took
+// longer than the upstream timeout, and a 502 otherwise, just as ReverseProxy
+// would by default
+func (s *Server) proxyError(w http.ResponseWriter, req *http.Request, err error) {
+	if errors.Is(err, context.DeadlineExceeded) {
+		s.logger.Warn("Upstream request timed out", "URL", req.URL.String(), "timeout", s.upstreamTimeout)
+		w.WriteHeader(http.StatusGatewayTimeout)
+		return
+	}
+	if errors.Is(err, context.Canceled) {
+		s.logger.Debug("Client went away before the upstream responded", "URL", req.URL.String())
+	} else {
+		s.logger.Error("Unable to reach upstream", "URL", req.URL.String(), "error", err)
+	}
+	w.WriteHeader(http.StatusBadGateway)
+}
+
+// issueTokenAndReplay gives a verified client a session, then replays its
+// original request, or in redirect mode sends it back to returnTo
+func (s *Server) issueTokenAndReplay(c *gin.Context, requestID string, cachedReq *cachedRequest, returnTo string) {
+	var tokenString, err = s.issueToken(c, time.Now(), requestID)
 	if err != nil {
 		s.logger.Error("Failed to sign JWT", "error", err)
 		c.String(http.StatusInternalServerError, "Failed to create session")
 		return
 	}
 
-	c.SetCookie(cookieName, tokenString, 3600*24, "/", "", true, true)
-
-	var cachedReqInterface, ok = s.requestCache.Get(requestID)
-	if !ok {
-		s.logger.Error("Could not find cached request", "requestID", requestID)
-		c.String(http.StatusInternalServerError, "Could not find original request")
+	if s.postVerifyMode == postVerifyRedirect {
+		s.redirectWithToken(c, returnTo, tokenString)
 		return
 	}
 
-	var cachedReq = cachedReqInterface.(*cachedRequest)
 	s.logger.Debug("Replaying request", "Method", cachedReq.Method, "URL", cachedReq.URL)
 
-	var req, reqErr = http.NewRequest(cachedReq.Method, cachedReq.URL.String(), bytes.NewReader(cachedReq.Body))
+	var req, reqErr = cachedReq.toRequest(c.Request.Context())
 	if reqErr != nil {
 		s.logger.Error("Could not create new request from cached", "requestID", requestID, "error", reqErr)
 		c.String(http.StatusInternalServerError, "Could not replay original request")
 		return
 	}
-	req.Header = cachedReq.Headers
-	s.replayRequest(c, req)
+	s.replayRequest(c, req, true, requestID, true)
 }
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestHandler(t *testing.T) {
+	var gotURI = make(chan string, 10)
+	var up = newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		gotURI <- r.RequestURI
+		io.WriteString(w, "upstream ok")
+	})
+
+	// Trusted clients are proxied without a challenge, so anything that
+	// isn't handled by TPS itself reaches the upstream
+	var s = newTestServer(up.URL).SetTrustedCIDRs([]netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")})
+
+	// Routes are only registered the first time; gin panics on duplicates
+	s.Handler()
+	var ts = httptest.NewServer(s.Handler())
+	t.Cleanup(ts.Close)
+
+	var tests = map[string]struct {
+		method  string
+		path    string
+		want    int
+		proxied bool
+	}{
+		"health check":            {http.MethodGet, "/_tps/healthz", http.StatusOK, false},
+		"unknown reserved path":   {http.MethodGet, "/_tps/nope", http.StatusNotFound, false},
+		"reserved, wrong method":  {http.MethodPost, "/_tps/healthz", http.StatusNotFound, false},
+		"reserved prefix alone":   {http.MethodGet, "/_tps", http.StatusNotFound, false},
+		"dot segments":            {http.MethodGet, "/app/../_tps/nope", http.StatusNotFound, false},
+		"admin without admin set": {http.MethodGet, "/_tps/stats", http.StatusNotFound, false},
+		"app page":                {http.MethodGet, "/app/page?x=1&x=2", http.StatusOK, true},
+		"app root":                {http.MethodGet, "/", http.StatusOK, true},
+		"lookalike prefix":        {http.MethodGet, "/_tpsx/page", http.StatusOK, true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var req, _ = http.NewRequest(tc.method, ts.URL+tc.path, nil)
+			var resp, err = http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("%s %s: %s", tc.method, tc.path, err)
+			}
+			readBody(t, resp)
+			if resp.StatusCode != tc.want {
+				t.Errorf("got status %d, want %d", resp.StatusCode, tc.want)
+			}
+
+			select {
+			case uri := <-gotURI:
+				if !tc.proxied {
+					t.Errorf("request was proxied upstream as %q", uri)
+				} else if uri != tc.path {
+					t.Errorf("upstream got %q, want %q", uri, tc.path)
+				}
+			default:
+				if tc.proxied {
+					t.Errorf("request wasn't proxied")
+				}
+			}
+		})
+	}
+}
+
+func TestReadHeaderTimeout(t *testing.T) {
+	var s = newTestServer("http://127.0.0.1:1").SetServerTimeouts(100*time.Millisecond, 0, 0, 0)
+	var l, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var srv = s.httpServer(l.Addr().String(), s.Handler())
+	go srv.Serve(l)
+	t.Cleanup(func() { srv.Close() })
+
+	var conn net.Conn
+	conn, err = net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Start a request and never finish its headers
+	var start = time.Now()
+	_, err = io.WriteString(conn, "GET /_tps/healthz HTTP/1.1\r\nHost: example.edu\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = io.ReadAll(conn)
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("connection was still open after %s", time.Since(start))
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("connection was cut off after %s, want about 100ms", elapsed)
+	}
+}
+
+func TestUpstreamAuthFailuresPassThrough(t *testing.T) {
+	var up = newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/private":
+			w.Header().Set("WWW-Authenticate", `Basic realm="app"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			io.WriteString(w, "app login required")
+		case "/forbidden":
+			w.WriteHeader(http.StatusForbidden)
+			io.WriteString(w, "app says no")
+		default:
+			io.WriteString(w, "upstream ok")
+		}
+	})
+	var s = newTestServer(up.URL).SetBypass(true)
+	var ts = startServer(t, s)
+
+	// Pass a challenge so the client holds a valid TPS session
+	var client = newClient(t)
+	var action, form = challengeForm(t, client, ts.URL+"/page")
+	var resp = postForm(t, client, action, form)
+	readBody(t, resp)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("verification: got status %d, want 200", resp.StatusCode)
+	}
+
+	var tests = map[string]struct {
+		path       string
+		wantStatus int
+		wantBody   string
+	}{
+		"401": {"/private", http.StatusUnauthorized, "app login required"},
+		"403": {"/forbidden", http.StatusForbidden, "app says no"},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			// Twice over, since a re-challenge would show up on the retry
+			for range 2 {
+				var hits = up.hits.Load()
+				var resp, err = client.Get(ts.URL + tc.path)
+				if err != nil {
+					t.Fatalf("GET %s: %s", tc.path, err)
+				}
+				var body = readBody(t, resp)
+				if resp.StatusCode != tc.wantStatus || body != tc.wantBody {
+					t.Errorf("got status %d and body %q, want the app's %d and %q", resp.StatusCode, body, tc.wantStatus, tc.wantBody)
+				}
+				if up.hits.Load() != hits+1 {
+					t.Errorf("request wasn't proxied")
+				}
+			}
+		})
+	}
+
+	resp, err := client.Get(ts.URL + "/private")
+	if err != nil {
+		t.Fatalf("GET /private: %s", err)
+	}
+	readBody(t, resp)
+	if got := resp.Header.Get("WWW-Authenticate"); got != `Basic realm="app"` {
+		t.Errorf("got WWW-Authenticate %q, want the app's", got)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"time"
+	"turnstile-proxy-server/session"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"golang.org/x/net/http/httpguts"
+)
+
+// tokenLifetime is how long a newly issued or refreshed token is good for
+const tokenLifetime = 24 * time.Hour
+
+// Session refresh defaults: refresh in the last quarter of a token's
+// lifetime, and never let a session run longer than a week
+const (
+	defaultRefreshWindow = tokenLifetime / 4
+	defaultMaxSessionAge = 7 * 24 * time.Hour
+)
+
+// checkSessionBinding verifies that a token's binding claims match the client
+// presenting it
+func (s *Server) checkSessionBinding(c *gin.Context, claims jwt.MapClaims) error {
+	var err = session.CheckBinding(claims, c.ClientIP(), c.Request.UserAgent())
+	if err != nil {
+		var ip, _ = claims[session.ClaimClientIP].(string)
+		s.logger.Warn("Session binding mismatch", "claimedIP", ip, "actualIP", c.ClientIP())
+	}
+	return err
+}
+
+// sessionExpiry returns when a token issued now for a session that began at
+// start should expire: a full [tokenLifetime] from now, but never past the
+// max session age
+func (s *Server) sessionExpiry(start time.Time) time.Time {
+	var exp = time.Now().Add(tokenLifetime)
+	if s.maxSessionAge > 0 {
+		var limit = start.Add(s.maxSessionAge)
+		if limit.Before(exp) {
+			exp = limit
+		}
+	}
+	return exp
+}
+
+// issueToken signs a new token for the session that began at start, when the
+// challenge with the given request ID was passed, and sets it as the session
+// cookie
+func (s *Server) issueToken(c *gin.Context, start time.Time, requestID string) (string, error) {
+	var now = time.Now()
+	var exp = s.sessionExpiry(start)
+	var claims = jwt.MapClaims{
+		"iss":                     "tps",
+		"aud":                     "caddy",
+		"iat":                     now.Unix(),
+		"exp":                     exp.Unix(),
+		"nbf":                     now.Unix(),
+		session.ClaimSessionStart: start.Unix(),
+	}
+	if requestID != "" {
+		claims[session.ClaimRequestID] = requestID
+	}
+	if s.bindSession {
+		session.BindClaims(claims, c.ClientIP(), c.Request.UserAgent())
+	}
+
+	var tokenString, err = jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(s.jwtSigningKey)
+	if err != nil {
+		return "", err
+	}
+
+	c.SetSameSite(s.cookieSameSite)
+	c.SetCookie(s.cookieName, tokenString, int(exp.Sub(now).Seconds()), "/", s.cookieDomain, s.cookieSecure, true)
+	return tokenString, nil
+}
+
+// refreshToken reissues the session cookie if the token behind claims is
+// within the refresh window of expiring, so active users aren't bounced to a
+// challenge mid-session. Nothing happens if refreshing wouldn't push the
+// expiry out, i.e., the session is up against its max age.
+func (s *Server) refreshToken(c *gin.Context, claims jwt.MapClaims) {
+	if s.refreshWindow <= 0 {
+		return
+	}
+
+	var exp, err = claims.GetExpirationTime()
+	if err != nil || exp == nil || time.Until(exp.Time) > s.refreshWindow {
+		return
+	}
+
+	var start = session.Start(claims)
+	if !s.sessionExpiry(start).After(exp.Time) {
+		return
+	}
+
+	_, err = s.issueToken(c, start, session.RequestID(claims))
+	if err != nil {
+		s.logger.Error("Failed to refresh session token", "error", err)
+		return
+	}
+	s.logger.Debug("Refreshed session token", "sessionStart", start)
+}
+
+// validCookieName returns true if name can be used as a cookie name, which
+// must be a non-empty HTTP token (RFC 6265 section 4.1.1)
+func validCookieName(name string) bool {
+	return httpguts.ValidHeaderFieldName(name)
+}
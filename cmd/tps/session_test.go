@@ -0,0 +1,147 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+	"turnstile-proxy-server/session"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// testRequestID is the request ID recorded in tokens from signSession
+const testRequestID = "0123456789abcdef0123456789abcdef"
+
+// signSession returns a token like a test server issues, for a session which
+// began at start and expires at exp
+func signSession(t *testing.T, start, exp time.Time) string {
+	t.Helper()
+	var token, err = jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"iss":                     "tps",
+		"aud":                     "caddy",
+		"iat":                     start.Unix(),
+		"nbf":                     start.Unix(),
+		"exp":                     exp.Unix(),
+		session.ClaimSessionStart: start.Unix(),
+		session.ClaimRequestID:    testRequestID,
+	}).SignedString([]byte(testSigningKey))
+	if err != nil {
+		t.Fatalf("signing token: %s", err)
+	}
+	return token
+}
+
+// getWithToken requests rawURL with token as s's session cookie
+func getWithToken(t *testing.T, s *Server, rawURL, token string) *http.Response {
+	t.Helper()
+	var req, _ = http.NewRequest(http.MethodGet, rawURL, nil)
+	req.AddCookie(&http.Cookie{Name: s.cookieName, Value: token})
+	var resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET %s: %s", rawURL, err)
+	}
+	return resp
+}
+
+func TestRefreshToken(t *testing.T) {
+	var now = time.Now()
+	var tests = map[string]struct {
+		window, maxAge time.Duration
+		start, exp     time.Time
+		wantExp        time.Time
+	}{
+		"outside the window": {
+			window: 30 * time.Minute,
+			start:  now.Add(-time.Hour),
+			exp:    now.Add(2 * time.Hour),
+		},
+		"inside the window": {
+			window:  30 * time.Minute,
+			start:   now.Add(-time.Hour),
+			exp:     now.Add(10 * time.Minute),
+			wantExp: now.Add(tokenLifetime),
+		},
+		"refreshing off": {
+			start: now.Add(-time.Hour),
+			exp:   now.Add(10 * time.Minute),
+		},
+		"capped by the max age": {
+			window:  30 * time.Minute,
+			maxAge:  2 * time.Hour,
+			start:   now.Add(-time.Hour),
+			exp:     now.Add(10 * time.Minute),
+			wantExp: now.Add(time.Hour),
+		},
+		"up against the max age": {
+			window: 30 * time.Minute,
+			maxAge: 2 * time.Hour,
+			start:  now.Add(-110 * time.Minute),
+			exp:    now.Add(10 * time.Minute),
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var s = newTestServer(newUpstream(t, nil).URL).SetSessionRefresh(tc.window, tc.maxAge)
+			var ts = startServer(t, s)
+
+			var resp = getWithToken(t, s, ts.URL+"/page", signSession(t, tc.start, tc.exp))
+			if body := readBody(t, resp); body != "upstream ok" {
+				t.Fatalf("got body %q, want the request proxied", body)
+			}
+
+			var refreshed string
+			for _, c := range resp.Cookies() {
+				if c.Name == s.cookieName {
+					refreshed = c.Value
+				}
+			}
+			if tc.wantExp.IsZero() {
+				if refreshed != "" {
+					t.Errorf("token was refreshed, want it left alone")
+				}
+				return
+			}
+			if refreshed == "" {
+				t.Fatalf("token wasn't refreshed")
+			}
+
+			var claims, err = session.Parse(refreshed, []byte(testSigningKey), 0)
+			if err != nil {
+				t.Fatalf("parsing refreshed token: %s", err)
+			}
+			var exp, _ = claims.GetExpirationTime()
+			if exp == nil || exp.Sub(tc.wantExp).Abs() > 2*time.Second {
+				t.Errorf("refreshed token expires %v, want %v", exp, tc.wantExp)
+			}
+			if got := session.Start(claims); got.Unix() != tc.start.Unix() {
+				t.Errorf("refreshed token's session began %s, want %s", got, tc.start)
+			}
+			if got := session.RequestID(claims); got != testRequestID {
+				t.Errorf("refreshed token has request ID %q, want %q", got, testRequestID)
+			}
+		})
+	}
+}
+
+func TestMaxSessionAge(t *testing.T) {
+	var now = time.Now()
+	var up = newUpstream(t, nil)
+	var s = newTestServer(up.URL).SetSessionRefresh(30*time.Minute, 2*time.Hour)
+	var ts = startServer(t, s)
+
+	var resp = getWithToken(t, s, ts.URL+"/page", signSession(t, now.Add(-time.Hour), now.Add(time.Hour)))
+	if body := readBody(t, resp); body != "upstream ok" {
+		t.Errorf("session within the max age: got body %q, want the request proxied", body)
+	}
+
+	// A token that hasn't expired, for a session that's too old
+	resp = getWithToken(t, s, ts.URL+"/page", signSession(t, now.Add(-3*time.Hour), now.Add(time.Hour)))
+	var form = hiddenFields(readBody(t, resp))
+	if form.Get("request_id") == "" {
+		t.Errorf("session past the max age: got status %d without a challenge, want a challenge", resp.StatusCode)
+	}
+	if got := up.hits.Load(); got != 1 {
+		t.Errorf("upstream got %d hits, want 1", got)
+	}
+}
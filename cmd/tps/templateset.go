@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/gin-contrib/multitemplate"
+	"github.com/gin-gonic/gin/render"
+	"github.com/spf13/afero"
+)
+
+// templateSet is an immutable, fully loaded set of templates. Reloading builds
+// a new set and swaps it in, so requests never see a half-populated one.
+type templateSet struct {
+	render multitemplate.Renderer
+	names  map[string]string
+}
+
+// loadTemplateSet builds a new template set from the core templates matching
+// pattern in af, plus any custom templates under customPath. Template parse
+// errors are returned rather than panicking, so a bad edit to a custom
+// template can't take down a running server.
+func loadTemplateSet(af afero.Fs, pattern, customPath string) (ts *templateSet, err error) {
+	defer func() {
+		var r = recover()
+		if r != nil {
+			ts, err = nil, fmt.Errorf("parsing templates: %v", r)
+		}
+	}()
+
+	ts = &templateSet{render: multitemplate.NewRenderer(), names: make(map[string]string)}
+	var core []string
+	core, err = afero.Glob(af, pattern)
+	if err != nil {
+		return nil, fmt.Errorf("finding core templates: %w", err)
+	}
+	for _, pth := range core {
+		if strings.HasSuffix(pth, ".go.html") {
+			var name = "core/" + strings.Replace(filepath.Base(pth), ".go.html", "", 1)
+			ts.render.AddFromFS(name, afero.NewIOFS(af), pth)
+			ts.names[name] = pth
+		}
+	}
+
+	if customPath == "" {
+		return ts, nil
+	}
+	err = filepath.Walk(customPath, func(pth string, info fs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !info.Mode().IsRegular() {
+			return err
+		}
+
+		if strings.HasSuffix(pth, ".go.html") {
+			var name = strings.Replace(pth, customPath+"/", "", 1)
+			name = strings.Replace(name, ".go.html", "", 1)
+			ts.render.AddFromFiles(name, pth)
+			ts.names[name] = pth
+		}
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("finding custom templates: %w", err)
+	}
+	return ts, nil
+}
+
+// templateRender is the gin HTML renderer for a [Server]. It always renders
+// from the server's current template set.
+type templateRender struct {
+	s *Server
+}
+
+// Instance implements gin's [render.HTMLRender]. If a reload dropped the
+// template chosen by [Server.getTemplate] between choosing and rendering, the
+// core template of the same name is used instead.
+func (tr templateRender) Instance(name string, data any) render.Render {
+	var ts = tr.s.templates.Load()
+	if _, ok := ts.names[name]; !ok {
+		name = "core/" + path.Base(name)
+	}
+	return ts.render.Instance(name, data)
+}
+
+// ReloadTemplates rereads the core and custom templates from wherever they
+// were last loaded, and swaps them in all at once. If anything fails to load,
+// or a custom challenge template would be broken by the CSP (see
+// [checkNonces]), the current templates are kept and the error is returned.
+func (s *Server) ReloadTemplates() error {
+	s.templateMu.Lock()
+	defer s.templateMu.Unlock()
+
+	var ts, err = loadTemplateSet(s.coreTemplateFS, s.coreTemplatePattern, s.customTemplatePath)
+	if err != nil {
+		return err
+	}
+	if s.cspUsesNonce() {
+		err = checkNonces(ts)
+		if err != nil {
+			return err
+		}
+	}
+	for name, pth := range ts.names {
+		s.logger.Debug("Loaded template", "name", name, "path", pth)
+	}
+	s.templates.Store(ts)
+	return nil
+}
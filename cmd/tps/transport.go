@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Defaults for the upstream connection pool. Everything TPS proxies goes to a
+// handful of hosts, so unlike [http.DefaultTransport] we keep plenty of idle
+// connections to each.
+const (
+	defaultUpstreamMaxIdleConns        = 100
+	defaultUpstreamMaxIdleConnsPerHost = 32
+	defaultUpstreamIdleConnTimeout     = 90 * time.Second
+)
+
+// SetUpstreamTransport tunes the connection pool shared by every proxied
+// request: the most idle connections kept in total and per upstream host, and
+// how long an idle connection is kept before it's closed. insecureTLS skips
+// verifying upstream TLS certificates, for internal targets with self-signed
+// certificates; never use it for anything reached over an untrusted network.
+// Negative values will panic. This must be called before the server starts
+// handling requests.
+func (s *Server) SetUpstreamTransport(maxIdle, maxIdlePerHost int, idleTimeout time.Duration, insecureTLS bool) *Server {
+	if maxIdle < 0 || maxIdlePerHost < 0 || idleTimeout < 0 {
+		panic("upstream transport settings must not be negative")
+	}
+	s.upstreamMaxIdleConns = maxIdle
+	s.upstreamMaxIdleConnsPerHost = maxIdlePerHost
+	s.upstreamIdleConnTimeout = idleTimeout
+	s.upstreamInsecureTLS = insecureTLS
+	return s
+}
+
+// newTransport builds the transport for proxied requests from
+// [http.DefaultTransport]'s settings and our own pool settings
+func (s *Server) newTransport() *http.Transport {
+	var t = http.DefaultTransport.(*http.Transport).Clone()
+	t.MaxIdleConns = s.upstreamMaxIdleConns
+	t.MaxIdleConnsPerHost = s.upstreamMaxIdleConnsPerHost
+	t.IdleConnTimeout = s.upstreamIdleConnTimeout
+	if s.upstreamInsecureTLS {
+		if t.TLSClientConfig == nil {
+			t.TLSClientConfig = &tls.Config{}
+		}
+		t.TLSClientConfig.InsecureSkipVerify = true
+	}
+	return t
+}
+
+// proxyCall is what the shared reverse proxy needs to know about a single
+// proxied request. It travels in the request's context.
+type proxyCall struct {
+	c            *gin.Context
+	access       *accessEntry
+	target       *url.URL
+	verified     bool
+	requestID    string
+	justVerified bool
+}
+
+// proxyCallKey is the context key for a request's [proxyCall]
+type proxyCallKey struct{}
+
+// callFor returns the [proxyCall] stashed in req's context by
+// [Server.replayRequest]
+func callFor(req *http.Request) *proxyCall {
+	return req.Context().Value(proxyCallKey{}).(*proxyCall)
+}
+
+// reverseProxy returns the reverse proxy shared by every proxied request,
+// building it (and its transport) on first use
+func (s *Server) reverseProxy() *httputil.ReverseProxy {
+	s.proxyOnce.Do(func() {
+		s.proxy = &httputil.ReverseProxy{
+			Director:       s.direct,
+			Transport:      s.newTransport(),
+			FlushInterval:  s.flushInterval,
+			ErrorHandler:   s.handleProxyError,
+			ModifyResponse: s.modifyResponse,
+		}
+	})
+	return s.proxy
+}
+
+// direct points an outgoing request at its upstream target, and sets or
+// clears the headers telling the upstream whether it was verified
+func (s *Server) direct(req *http.Request) {
+	var call = callFor(req)
+	req.URL.Scheme = call.target.Scheme
+	req.URL.Host = call.target.Host
+	req.Host = call.target.Host
+
+	req.Header.Del(s.verifiedHeader)
+	req.Header.Del(requestIDHeader)
+	if call.verified {
+		req.Header.Set(s.verifiedHeader, "1")
+		if call.requestID != "" {
+			req.Header.Set(requestIDHeader, call.requestID)
+		}
+	}
+}
+
+// handleProxyError deals with a proxied request that got no usable response.
+// A client that just passed a challenge gets the verified "unavailable" page
+// rather than a bare 502 or 504, so it knows its verification still counts.
+func (s *Server) handleProxyError(w http.ResponseWriter, req *http.Request, err error) {
+	var call = callFor(req)
+	var unavailable upstreamUnavailableError
+	if errors.As(err, &unavailable) {
+		s.verifiedButUnavailable(call.c, unavailable)
+		return
+	}
+
+	// A client hanging up says nothing about the upstream's health, and
+	// there's nobody left to answer
+	if errors.Is(err, context.Canceled) {
+		s.proxyError(w, req, err)
+		return
+	}
+
+	s.recordUpstream(call.target.Host, false)
+	if call.justVerified {
+		var status = http.StatusBadGateway
+		if errors.Is(err, context.DeadlineExceeded) {
+			status = http.StatusGatewayTimeout
+		}
+		s.logger.Error("Unable to reach upstream", "URL", req.URL.String(), "error", err)
+		s.verifiedButUnavailable(call.c, upstreamUnavailableError{status: status})
+		return
+	}
+	s.proxyError(w, req, err)
+}
+
+// modifyResponse records the upstream's response, and keeps a 5xx from
+// reaching a client that just passed a challenge
+func (s *Server) modifyResponse(resp *http.Response) error {
+	var call = callFor(resp.Request)
+	call.access.upstreamStatus = resp.StatusCode
+	s.recordUpstream(call.target.Host, resp.StatusCode < 500)
+	if call.justVerified && resp.StatusCode >= 500 {
+		return upstreamUnavailableError{status: resp.StatusCode, retryAfter: resp.Header.Get("Retry-After")}
+	}
+	return nil
+}
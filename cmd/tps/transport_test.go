@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestUpstreamConnectionsAreReused(t *testing.T) {
+	var newConns atomic.Int64
+	var up = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	up.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			newConns.Add(1)
+		}
+	}
+	up.Start()
+	t.Cleanup(up.Close)
+
+	// Trusted clients are proxied without a challenge
+	var s = newTestServer(up.URL).SetTrustedCIDRs([]netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")})
+	var ts = startServer(t, s)
+
+	const workers, requests = 8, 50
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range requests {
+				var resp, err = http.Get(ts.URL + "/page")
+				if err != nil {
+					t.Errorf("GET: %s", err)
+					return
+				}
+				readBody(t, resp)
+				if resp.StatusCode != http.StatusOK {
+					t.Errorf("got status %d, want 200", resp.StatusCode)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got := newConns.Load(); got > workers {
+		t.Errorf("upstream saw %d new connections for %d requests, want at most %d", got, workers*requests, workers)
+	}
+}
+
+// verifyAgainst passes a challenge for /page on ts and returns the response
+// to the verification
+func verifyAgainst(t *testing.T, ts *httptest.Server) (status int, body string) {
+	t.Helper()
+	var client = newClient(t)
+	var action, form = challengeForm(t, client, ts.URL+"/page")
+	var resp = postForm(t, client, action, form)
+	return resp.StatusCode, readBody(t, resp)
+}
+
+func TestVerifiedClientSeesFriendlyUnavailablePage(t *testing.T) {
+	// An upstream that's gone: connections to it are refused
+	var dead = httptest.NewServer(http.NotFoundHandler())
+	dead.Close()
+
+	var s = newTestServer(dead.URL).SetBypass(true).SetCircuitBreaker(1, time.Minute)
+	var ts = startServer(t, s)
+	var verifiedText = "been verified"
+
+	// The refused connection gets the verified page, and opens the circuit
+	var status, body = verifyAgainst(t, ts)
+	if status != http.StatusServiceUnavailable || !strings.Contains(body, verifiedText) {
+		t.Errorf("unreachable upstream: got status %d and body %q, want 503 and the verified page", status, body)
+	}
+
+	// With the circuit open, nothing is even tried
+	status, body = verifyAgainst(t, ts)
+	if status != http.StatusServiceUnavailable || !strings.Contains(body, verifiedText) {
+		t.Errorf("open circuit: got status %d and body %q, want 503 and the verified page", status, body)
+	}
+
+	// Unverified requests skip straight to a challenge, so the only other way
+	// to hit the open circuit is as a trusted client, who was never verified
+	s.SetTrustedCIDRs([]netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")})
+	var resp, err = http.Get(ts.URL + "/page")
+	if err != nil {
+		t.Fatalf("GET: %s", err)
+	}
+	body = readBody(t, resp)
+	if resp.StatusCode != http.StatusServiceUnavailable || strings.Contains(body, verifiedText) {
+		t.Errorf("trusted client: got status %d and body %q, want 503 without the verified message", resp.StatusCode, body)
+	}
+}
+
+func TestUnverifiedProxyErrorIsBadGateway(t *testing.T) {
+	var dead = httptest.NewServer(http.NotFoundHandler())
+	dead.Close()
+
+	var s = newTestServer(dead.URL).SetTrustedCIDRs([]netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")})
+	var ts = startServer(t, s)
+	var resp, err = http.Get(ts.URL + "/page")
+	if err != nil {
+		t.Fatalf("GET: %s", err)
+	}
+	readBody(t, resp)
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("got status %d, want 502", resp.StatusCode)
+	}
+}
+
+func TestVerifiedHeadersCannotBeSpoofed(t *testing.T) {
+	// The upstream echoes the verification headers it was sent
+	var up = newUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "verified=%q id=%q", r.Header.Get("X-TPS-Verified"), r.Header.Get(requestIDHeader))
+	})
+	var unmarked = `verified="" id=""`
+
+	var get = func(t *testing.T, client *http.Client, rawURL string) string {
+		t.Helper()
+		var req, _ = http.NewRequest(http.MethodGet, rawURL, nil)
+		req.Header.Set("X-TPS-Verified", "1")
+		req.Header.Set(requestIDHeader, "spoofed")
+		var resp, err = client.Do(req)
+		if err != nil {
+			t.Fatalf("GET %s: %s", rawURL, err)
+		}
+		var body = readBody(t, resp)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("GET %s: got status %d, want 200", rawURL, resp.StatusCode)
+		}
+		return body
+	}
+
+	t.Run("public path", func(t *testing.T) {
+		var ts = startServer(t, newTestServer(up.URL).SetPublicPaths([]string{"/public/*"}))
+		if got := get(t, newClient(t), ts.URL+"/public/page"); got != unmarked {
+			t.Errorf("upstream got %s, want %s", got, unmarked)
+		}
+	})
+
+	t.Run("trusted client", func(t *testing.T) {
+		var s = newTestServer(up.URL).SetTrustedCIDRs([]netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")})
+		var ts = startServer(t, s)
+		if got := get(t, newClient(t), ts.URL+"/page"); got != unmarked {
+			t.Errorf("upstream got %s, want %s", got, unmarked)
+		}
+	})
+
+	t.Run("verified client", func(t *testing.T) {
+		var ts = startServer(t, newTestServer(up.URL).SetBypass(true))
+		var client = newClient(t)
+		var action, form = challengeForm(t, client, ts.URL+"/page")
+		var want = fmt.Sprintf("verified=%q id=%q", "1", form.Get("request_id"))
+
+		var resp = postForm(t, client, action, form)
+		if got := readBody(t, resp); got != want {
+			t.Errorf("replay: upstream got %s, want %s", got, want)
+		}
+
+		// Later requests on the session carry the same challenge's ID, not
+		// whatever the client claims
+		for range 2 {
+			if got := get(t, client, ts.URL+"/other"); got != want {
+				t.Errorf("session request: upstream got %s, want %s", got, want)
+			}
+		}
+	})
+}
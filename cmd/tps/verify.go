@@ -0,0 +1,320 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+	"turnstile-proxy-server/internal/db"
+	"turnstile-proxy-server/internal/requestid"
+	"turnstile-proxy-server/internal/verifier"
+
+	"github.com/gin-gonic/gin"
+)
+
+// verifyPath is the dedicated endpoint challenge forms post to when
+// [Server.SetVerifyEndpoint] is on. Forms posted back to the original URL
+// are still accepted either way.
+const verifyPath = reservedPrefix + "verify"
+
+// SetVerifyEndpoint chooses where the challenge form posts its response, and
+// returns s for chaining. By default it posts back to the URL that was
+// challenged; when on, it posts to [verifyPath] instead, so backends (and
+// WAFs or logs in front of them) never see verification POSTs to paths that
+// only accept GETs. The original method and URL travel with the form, and
+// the original request is still replayed from the cache.
+func (s *Server) SetVerifyEndpoint(on bool) *Server {
+	s.verifyEndpoint = on
+	return s
+}
+
+// maxLoggedRequestID is how much of a malformed request ID we log
+const maxLoggedRequestID = 64
+
+// truncateRequestID cuts a client-supplied request ID down to a size that's
+// safe to log
+func truncateRequestID(id string) string {
+	if len(id) <= maxLoggedRequestID {
+		return id
+	}
+	return id[:maxLoggedRequestID] + "..."
+}
+
+// postAction returns the URL the challenge form for req should post to
+func (s *Server) postAction(req *cachedRequest) string {
+	if s.verifyEndpoint {
+		return verifyPath
+	}
+	return req.URL.RequestURI()
+}
+
+// isVerification returns true if the request is a challenge response: a POST
+// with a request ID and the provider's response (or just a request ID, in
+// bypass mode)
+func (s *Server) isVerification(c *gin.Context) bool {
+	var v = s.verifierFor(c.Request)
+	var turnstileResponse = c.PostForm(v.ResponseField())
+	var requestID = c.PostForm("request_id")
+	return c.Request.Method == http.MethodPost && (turnstileResponse != "" || s.bypass) && requestID != ""
+}
+
+// handleVerify is the dedicated verification endpoint, logging a single
+// access line for each request once it's done
+func (s *Server) handleVerify(c *gin.Context) {
+	var start = time.Now()
+	s.serveVerify(c)
+	s.logAccess(c, start)
+}
+
+// serveVerify applies the same gatekeeping as [Server.serveProxy] to a
+// verification posted to [verifyPath], then verifies it
+func (s *Server) serveVerify(c *gin.Context) {
+	if s.refuseBlocked(c) || s.refuseMaintenance(c) || s.refuseAnomalous(c) || s.refuseLongURL(c) || s.refuseRateLimited(c) {
+		return
+	}
+	if !s.isVerification(c) {
+		c.String(http.StatusBadRequest, "Bad request")
+		return
+	}
+	s.verify(c)
+}
+
+// refuseBlocked serves the blocked page if the client is in a blocked range,
+// returning true if it did
+func (s *Server) refuseBlocked(c *gin.Context) bool {
+	if !clientInPrefixes(c, s.blockedCIDRs) {
+		return false
+	}
+
+	s.logger.Warn("Client IP is blocked", "clientIP", c.ClientIP(), "URL", c.Request.URL.String())
+	accessFor(c).outcome = outcomeBlocked
+	if s.shouldLog(logBlocked) {
+		s.logRequest(c, db.RequestLog{
+			ClientIP:  c.ClientIP(),
+			Host:      requestHost(c.Request),
+			Timestamp: time.Now(),
+			URL:       s.sanitizeLogURL(c.Request.URL),
+			UserAgent: c.Request.UserAgent(),
+			Referer:   c.Request.Referer(),
+			Blocked:   true,
+		})
+	}
+	s.html(c, http.StatusForbidden, "blocked", nil)
+	return true
+}
+
+// refuseMaintenance serves the maintenance page if maintenance mode is on,
+// returning true if it did
+func (s *Server) refuseMaintenance(c *gin.Context) bool {
+	if !s.maintenance.Load() {
+		return false
+	}
+
+	accessFor(c).outcome = outcomeMaintenance
+	c.Header("Retry-After", "300")
+	s.html(c, http.StatusServiceUnavailable, "maintenance", nil)
+	return true
+}
+
+// refuseRateLimited responds with a 429 if the client is over the rate limit,
+// returning true if it did
+func (s *Server) refuseRateLimited(c *gin.Context) bool {
+	if s.limiter == nil {
+		return false
+	}
+
+	var ok, wait = s.limiter.Allow(c.ClientIP())
+	if ok {
+		return false
+	}
+	s.logger.Warn("Rate limit exceeded", "clientIP", c.ClientIP(), "URL", c.Request.URL.String())
+	c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	c.String(http.StatusTooManyRequests, "Too many requests")
+	return true
+}
+
+// verifyTurnstile asks the request's provider (see [Server.verifierFor])
+// whether response is valid, passing along the client's IP. In bypass mode the
+// provider isn't asked, and every response passes.
+//
+// The provider's endpoint and HTTP client belong to the verifier, so tests
+// point a server at a stub with [Server.SetVerifier] and a verifier built with
+// [verifier.Config.Endpoint].
+func (s *Server) verifyTurnstile(c *gin.Context, response string) (verifier.Result, error) {
+	if s.bypass {
+		s.logger.Warn("Verification bypass is on, skipping provider", "requestID", c.PostForm("request_id"))
+		return verifier.Result{Success: true}, nil
+	}
+	return s.verifierFor(c.Request).Verify(c.Request.Context(), response, c.ClientIP())
+}
+
+// verify checks a challenge response (see [Server.isVerification]) with the
+// provider, then replays the original request from the cache or serves the
+// failure page
+func (s *Server) verify(c *gin.Context) {
+	var v = s.verifierFor(c.Request)
+	var turnstileResponse = c.PostForm(v.ResponseField())
+	var requestID = c.PostForm("request_id")
+	s.logger.Info("Received turnstile response, attempting verification", "requestID", requestID)
+
+	// Request IDs are cache keys, so junk is turned away before it can touch
+	// the cache or cost a siteverify call
+	if !requestid.Valid(requestID) || len(requestID) != 2*requestid.DefaultBytes {
+		s.logger.Debug("Rejecting verification with a malformed request ID", "requestID", truncateRequestID(requestID), "length", len(requestID))
+		c.String(http.StatusBadRequest, "Bad request")
+		return
+	}
+
+	// Anything short of success from here on is a failed verification
+	var access = accessFor(c)
+	access.requestID = requestID
+	access.outcome = outcomeVerifyFailed
+
+	if s.bindChallenge {
+		var err = s.checkBinding(c, requestID)
+		if errors.Is(err, errNoBindingCookie) {
+			s.logger.Warn("Verification without a challenge binding cookie", "requestID", requestID)
+			s.html(c, http.StatusForbidden, "cookies", nil)
+			return
+		}
+		if err != nil {
+			s.logger.Warn("Rejecting verification", "requestID", requestID, "error", err)
+			s.html(c, http.StatusForbidden, "failed", nil)
+			return
+		}
+	}
+
+	var err = s.checkOrigin(c.Request)
+	if err != nil {
+		s.logger.Warn("Rejecting verification", "requestID", requestID, "origin", c.GetHeader("Origin"), "referer", c.Request.Referer(), "error", err)
+		s.html(c, http.StatusForbidden, "failed", nil)
+		return
+	}
+
+	// In redirect mode the client is sent back to the signed return path, so
+	// a tampered one is turned away before anything is claimed or issued
+	var returnTo string
+	if s.postVerifyMode == postVerifyRedirect {
+		var ok bool
+		returnTo, ok = s.postedReturnTo(c)
+		if !ok {
+			return
+		}
+	}
+
+	// A double-click or browser retry submits the same response twice. The
+	// provider would reject the second call, so wait for the first
+	// verification and reuse its outcome instead.
+	var ver *verification
+	if turnstileResponse != "" {
+		var dup bool
+		ver, dup = s.startVerification(turnstileResponse, requestID)
+		if dup {
+			s.reuseVerification(c, ver, requestID, returnTo)
+			return
+		}
+		defer func() {
+			ver.success = access.outcome == outcomeVerified
+			close(ver.done)
+		}()
+	}
+
+	// Each request ID may only be submitted once, and there's no point
+	// asking the provider about a response if we no longer have the request
+	// it was for
+	var cached *cachedRequest
+	cached, err = s.peekRequest(requestID)
+	if errors.Is(err, errRequestIDUsed) {
+		s.logger.Warn("Rejecting verification", "requestID", requestID, "error", err)
+		s.html(c, http.StatusForbidden, "failed", nil)
+		return
+	}
+	if err != nil {
+		s.recoverExpired(c, requestID)
+		return
+	}
+	if ver != nil {
+		ver.originalURI = cached.URL.RequestURI()
+	}
+
+	var verifyResp verifier.Result
+	verifyResp, err = s.verifyTurnstile(c, turnstileResponse)
+	if err != nil {
+		// The provider never answered, even after retrying, so this is
+		// nobody's fault. The request stays cached and the response is
+		// forgotten, so simply resubmitting the form tries again.
+		s.logger.Error("Failed to verify token with provider", "requestID", requestID, "error", err)
+		s.verifications.Delete(turnstileResponse)
+		access.outcome = outcomeUnavailable
+		s.html(c, http.StatusServiceUnavailable, "unavailable", nil)
+		return
+	}
+
+	if verifyResp.Success && !s.bypass {
+		err = checkEcho(verifyResp, challengeAction(cached.URL.Path), requestID)
+		if errors.Is(err, errNoEcho) {
+			s.logger.Warn("Provider echoed no action or cData, so the response can't be tied to its request; pass both to the widget in custom templates", "requestID", requestID)
+		} else if err != nil {
+			s.logger.Warn("Rejecting verification", "requestID", requestID, "action", verifyResp.Action, "cData", verifyResp.CData, "error", err)
+			verifyResp.Success = false
+		}
+	}
+
+	// The provider's answer is definitive, so the request can be claimed. It
+	// may have been claimed by a concurrent submission of the same request ID
+	// with another response, or expired, while we waited.
+	cached, err = s.claimRequest(requestID)
+	if errors.Is(err, errRequestIDUsed) {
+		s.logger.Warn("Rejecting verification", "requestID", requestID, "error", err)
+		s.html(c, http.StatusForbidden, "failed", nil)
+		return
+	}
+	if err != nil {
+		s.recoverExpired(c, requestID)
+		return
+	}
+
+	if verifyResp.Success {
+		s.logger.Info("Turnstile verification successful")
+		access.outcome = outcomeVerified
+		if s.shouldLog(logChallengePassed) {
+			s.logRequest(c, db.RequestLog{
+				ClientIP:              c.ClientIP(),
+				Host:                  requestHost(c.Request),
+				Timestamp:             time.Now(),
+				URL:                   s.sanitizeLogURL(cached.URL),
+				WasPresentedChallenge: true,
+				ChallengeSucceeded:    true,
+				UserAgent:             c.Request.UserAgent(),
+				Referer:               c.Request.Referer(),
+				CFHostname:            verifyResp.Hostname,
+				ChallengeTS:           challengeTime(verifyResp),
+			})
+		}
+		s.issueTokenAndReplay(c, requestID, cached, returnTo)
+	} else {
+		s.logger.Warn("Turnstile verification failed", "error-codes", verifyResp.ErrorCodes)
+		if slices.Contains(verifyResp.ErrorCodes, verifier.TurnstileTimeoutOrDuplicate) {
+			s.logger.Warn("Provider says the response expired or was already used elsewhere; this was not a duplicate submission to TPS", "requestID", requestID)
+		}
+		if s.shouldLog(logChallengeFailed) {
+			s.logRequest(c, db.RequestLog{
+				ClientIP:              c.ClientIP(),
+				Host:                  requestHost(c.Request),
+				Timestamp:             time.Now(),
+				URL:                   s.sanitizeLogURL(cached.URL),
+				WasPresentedChallenge: true,
+				ChallengeSucceeded:    false,
+				UserAgent:             c.Request.UserAgent(),
+				Referer:               c.Request.Referer(),
+				ErrorCodes:            verifyResp.ErrorCodes,
+				CFHostname:            verifyResp.Hostname,
+				ChallengeTS:           challengeTime(verifyResp),
+			})
+		}
+		s.recordFailure(c.ClientIP())
+		s.html(c, http.StatusUnauthorized, "failed", nil)
+	}
+}
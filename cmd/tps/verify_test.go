@@ -0,0 +1,118 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// verifyContext returns a gin context for a verification POST from the given
+// remote address
+func verifyContext(remoteAddr string) *gin.Context {
+	var c, _ = gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest(http.MethodPost, "/page", nil)
+	c.Request.RemoteAddr = remoteAddr
+	return c
+}
+
+func TestVerifyTurnstile(t *testing.T) {
+	var tests = map[string]struct {
+		resp      map[string]any
+		failing   bool
+		bypass    bool
+		wantOK    bool
+		wantCodes []string
+		wantErr   bool
+		wantCalls int64
+	}{
+		"success": {
+			resp:      map[string]any{"success": true, "action": "tps_page", "cdata": "abc"},
+			wantOK:    true,
+			wantCalls: 1,
+		},
+		"failure": {
+			resp:      map[string]any{"success": false, "error-codes": []string{"invalid-input-response"}},
+			wantCodes: []string{"invalid-input-response"},
+			wantCalls: 1,
+		},
+		"provider down": {
+			failing:   true,
+			wantErr:   true,
+			wantCalls: 3,
+		},
+		"bypass": {
+			resp:   map[string]any{"success": false},
+			bypass: true,
+			wantOK: true,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var sv = newSiteverify(t, tc.resp)
+			sv.failing.Store(tc.failing)
+			var s = newTestServer(newUpstream(t, nil).URL).SetVerifier(sv.verifier()).SetBypass(tc.bypass)
+
+			var result, err = s.verifyTurnstile(verifyContext("192.0.2.1:1234"), "token")
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("got error %v, want error: %t", err, tc.wantErr)
+			}
+			if result.Success != tc.wantOK {
+				t.Errorf("got success %t, want %t", result.Success, tc.wantOK)
+			}
+			if !slices.Equal(result.ErrorCodes, tc.wantCodes) {
+				t.Errorf("got error codes %v, want %v", result.ErrorCodes, tc.wantCodes)
+			}
+			if got := sv.calls.Load(); got != tc.wantCalls {
+				t.Errorf("siteverify got %d calls, want %d", got, tc.wantCalls)
+			}
+		})
+	}
+}
+
+func TestMalformedRequestID(t *testing.T) {
+	var tests = map[string]struct {
+		path      string
+		requestID string
+	}{
+		"overlong":            {"/page", strings.Repeat("ab", 1000)},
+		"non-hex":             {"/page", strings.Repeat("zz", 16)},
+		"uppercase":           {"/page", strings.Repeat("AB", 16)},
+		"wrong length":        {"/page", "abcd"},
+		"empty":               {verifyPath, ""},
+		"overlong, endpoint":  {verifyPath, strings.Repeat("ab", 1000)},
+		"non-hex, endpoint":   {verifyPath, strings.Repeat("zz", 16)},
+		"uppercase, endpoint": {verifyPath, strings.Repeat("AB", 16)},
+	}
+
+	var sv = newSiteverify(t, map[string]any{"success": true})
+	var up = newUpstream(t, nil)
+	var s = newTestServer(up.URL).SetVerifier(sv.verifier()).SetVerifyEndpoint(true)
+	var ts = startServer(t, s)
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var form = url.Values{"request_id": {tc.requestID}, "cf-turnstile-response": {"token"}}
+			var resp = postForm(t, newClient(t), ts.URL+tc.path, form)
+			readBody(t, resp)
+			if resp.StatusCode != http.StatusBadRequest {
+				t.Errorf("got status %d, want 400", resp.StatusCode)
+			}
+		})
+	}
+
+	if got := sv.calls.Load(); got != 0 {
+		t.Errorf("siteverify got %d calls, want 0", got)
+	}
+	if got := up.hits.Load(); got != 0 {
+		t.Errorf("upstream got %d hits, want 0", got)
+	}
+	if got := s.requestCache.Stats().Misses; got != 0 {
+		t.Errorf("request cache got %d lookups, want 0", got)
+	}
+}
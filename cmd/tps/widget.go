@@ -0,0 +1,53 @@
+package main
+
+import (
+	"slices"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+)
+
+// Valid values for the Turnstile widget's data-appearance and data-theme
+// attributes. See https://developers.cloudflare.com/turnstile/get-started/client-side-rendering/
+var (
+	validAppearances = []string{"always", "execute", "interaction-only"}
+	validThemes      = []string{"light", "dark", "auto"}
+)
+
+// repeatFailureThreshold is how many failed challenges a client IP needs
+// within [failureWindow] before we switch to the failure appearance
+const repeatFailureThreshold = 2
+
+// failureWindow is how long a failed challenge counts against a client IP
+const failureWindow = time.Hour
+
+func validAppearance(a string) bool {
+	return slices.Contains(validAppearances, a)
+}
+
+func validTheme(t string) bool {
+	return slices.Contains(validThemes, t)
+}
+
+// recordFailure notes a failed challenge from the given client IP
+func (s *Server) recordFailure(ip string) {
+	var err = s.failures.Increment(ip, 1)
+	if err != nil {
+		s.failures.Set(ip, 1, cache.DefaultExpiration)
+	}
+}
+
+// appearanceFor returns the widget appearance for the given client IP: the
+// failure appearance if one is configured and the IP has failed repeatedly,
+// otherwise the normal appearance
+func (s *Server) appearanceFor(ip string) string {
+	if s.failureAppearance == "" {
+		return s.appearance
+	}
+
+	var count, ok = s.failures.Get(ip)
+	if ok && count.(int) >= repeatFailureThreshold {
+		return s.failureAppearance
+	}
+	return s.appearance
+}
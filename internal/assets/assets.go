@@ -0,0 +1,10 @@
+// Package assets exists solely to embed the default static files for TPS's
+// pages into the binary
+package assets
+
+import "embed"
+
+// FS is the embedded filesystem for the default static assets
+//
+//go:embed *.css
+var FS embed.FS
@@ -0,0 +1,101 @@
+// Package breaker is a simple per-key circuit breaker, safe for concurrent use
+package breaker
+
+import (
+	"sync"
+	"time"
+)
+
+// circuit is the state of one key's circuit. It's open while openedAt is
+// set; once the cooldown has passed, one probe at a time is let through
+// (half-open) to find out whether the key has recovered.
+type circuit struct {
+	failures   int
+	openedAt   time.Time
+	probeSince time.Time
+}
+
+// Breaker stops calls to a key after threshold consecutive failures, for a
+// cooldown period. Each key gets its own circuit, which starts closed.
+type Breaker struct {
+	sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	circuits  map[string]*circuit
+
+	// now tells the time, and is only ever replaced by tests
+	now func() time.Time
+}
+
+// New returns a breaker which opens a key's circuit after threshold
+// consecutive failures, and waits cooldown before probing it again.
+// threshold and cooldown must both be positive.
+func New(threshold int, cooldown time.Duration) *Breaker {
+	if threshold <= 0 || cooldown <= 0 {
+		panic("breaker: threshold and cooldown must be positive")
+	}
+	return &Breaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+		circuits:  make(map[string]*circuit),
+		now:       time.Now,
+	}
+}
+
+// Allow returns true if a call to key may go ahead. While key's circuit is
+// open, it returns false and how long until the next probe may be tried. A
+// call allowed through a half-open circuit is the probe, and must be followed
+// by [Breaker.Success] or [Breaker.Failure]; if it never is, another probe is
+// allowed after the cooldown.
+func (b *Breaker) Allow(key string) (bool, time.Duration) {
+	b.Lock()
+	defer b.Unlock()
+
+	var c = b.circuits[key]
+	if c == nil || c.openedAt.IsZero() {
+		return true, 0
+	}
+
+	var now = b.now()
+	var wait = c.openedAt.Add(b.cooldown).Sub(now)
+	if wait > 0 {
+		return false, wait
+	}
+
+	if !c.probeSince.IsZero() {
+		var probeWait = c.probeSince.Add(b.cooldown).Sub(now)
+		if probeWait > 0 {
+			return false, probeWait
+		}
+	}
+	c.probeSince = now
+	return true, 0
+}
+
+// Success records a successful call to key, closing its circuit
+func (b *Breaker) Success(key string) {
+	b.Lock()
+	defer b.Unlock()
+
+	delete(b.circuits, key)
+}
+
+// Failure records a failed call to key. The circuit opens once threshold
+// failures in a row have been recorded, and a failed probe reopens it for
+// another cooldown.
+func (b *Breaker) Failure(key string) {
+	b.Lock()
+	defer b.Unlock()
+
+	var c = b.circuits[key]
+	if c == nil {
+		c = &circuit{}
+		b.circuits[key] = c
+	}
+
+	c.failures++
+	if c.failures >= b.threshold {
+		c.openedAt = b.now()
+		c.probeSince = time.Time{}
+	}
+}
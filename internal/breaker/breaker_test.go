@@ -0,0 +1,132 @@
+package breaker
+
+import (
+	"testing"
+	"time"
+)
+
+// clock is a fake time source which only moves when told to
+type clock struct {
+	t time.Time
+}
+
+func (c *clock) now() time.Time {
+	return c.t
+}
+
+func (c *clock) advance(d time.Duration) {
+	c.t = c.t.Add(d)
+}
+
+// newTestBreaker returns a breaker running on a fake clock
+func newTestBreaker(threshold int, cooldown time.Duration) (*Breaker, *clock) {
+	var clk = &clock{t: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	var b = New(threshold, cooldown)
+	b.now = clk.now
+	return b, clk
+}
+
+// wantAllow fails the test unless Allow(key) gives the expected answer and
+// wait
+func wantAllow(t *testing.T, b *Breaker, key string, want bool, wantWait time.Duration) {
+	t.Helper()
+	var ok, wait = b.Allow(key)
+	if ok != want || wait != wantWait {
+		t.Errorf("Allow(%q) = %t, %s; want %t, %s", key, ok, wait, want, wantWait)
+	}
+}
+
+func TestTrip(t *testing.T) {
+	var b, _ = newTestBreaker(3, time.Minute)
+
+	b.Failure("a")
+	b.Failure("a")
+	wantAllow(t, b, "a", true, 0)
+
+	// A success in between starts the count over
+	b.Success("a")
+	b.Failure("a")
+	b.Failure("a")
+	wantAllow(t, b, "a", true, 0)
+
+	b.Failure("a")
+	wantAllow(t, b, "a", false, time.Minute)
+
+	// Every key has its own circuit
+	wantAllow(t, b, "b", true, 0)
+}
+
+func TestCooldown(t *testing.T) {
+	var b, clk = newTestBreaker(1, time.Minute)
+	b.Failure("a")
+
+	clk.advance(40 * time.Second)
+	wantAllow(t, b, "a", false, 20*time.Second)
+
+	clk.advance(20 * time.Second)
+	wantAllow(t, b, "a", true, 0)
+}
+
+func TestHalfOpen(t *testing.T) {
+	var tests = map[string]struct {
+		probe    func(b *Breaker)
+		wantOpen bool
+	}{
+		"probe succeeds": {
+			probe: func(b *Breaker) { b.Success("a") },
+		},
+		"probe fails": {
+			probe:    func(b *Breaker) { b.Failure("a") },
+			wantOpen: true,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var b, clk = newTestBreaker(2, time.Minute)
+			b.Failure("a")
+			b.Failure("a")
+			clk.advance(time.Minute)
+
+			// Only one probe at a time gets through
+			wantAllow(t, b, "a", true, 0)
+			clk.advance(10 * time.Second)
+			wantAllow(t, b, "a", false, 50*time.Second)
+
+			tc.probe(b)
+			if tc.wantOpen {
+				wantAllow(t, b, "a", false, time.Minute)
+			} else {
+				wantAllow(t, b, "a", true, 0)
+				wantAllow(t, b, "a", true, 0)
+			}
+		})
+	}
+}
+
+func TestAbandonedProbe(t *testing.T) {
+	var b, clk = newTestBreaker(1, time.Minute)
+	b.Failure("a")
+	clk.advance(time.Minute)
+	wantAllow(t, b, "a", true, 0)
+
+	// The probe never reports back, so another is allowed after a cooldown
+	clk.advance(time.Minute)
+	wantAllow(t, b, "a", true, 0)
+}
+
+func TestNewPanics(t *testing.T) {
+	for _, tc := range []struct {
+		threshold int
+		cooldown  time.Duration
+	}{{0, time.Minute}, {1, 0}, {-1, -time.Second}} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("New(%d, %s) didn't panic", tc.threshold, tc.cooldown)
+				}
+			}()
+			New(tc.threshold, tc.cooldown)
+		}()
+	}
+}
@@ -0,0 +1,139 @@
+package db
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Batching limits for asynchronous logging: the worker writes whenever it has
+// this many rows, or after this long, whichever comes first
+const (
+	asyncBatchSize     = 100
+	asyncFlushInterval = time.Second
+)
+
+// ErrQueueFull is returned by [Store.LogRequest] in async mode when the buffer
+// is full and the log entry had to be dropped
+var ErrQueueFull = errors.New("request log queue is full")
+
+// asyncLogger holds the state for asynchronous, batched request logging
+type asyncLogger struct {
+	sync.RWMutex
+	queue   chan RequestLog
+	done    chan struct{}
+	closed  bool
+	dropped atomic.Uint64
+}
+
+// EnableAsync switches the store to asynchronous logging: [Store.LogRequest]
+// queues entries in a buffer of the given size instead of writing them
+// immediately, and a background worker inserts them in batches. When the
+// buffer is full, entries are dropped rather than blocking the caller. Close
+// flushes anything still queued.
+//
+// This must be called before the store is in use, and at most once.
+func (s *Store) EnableAsync(bufferSize int) {
+	s.async = &asyncLogger{
+		queue: make(chan RequestLog, bufferSize),
+		done:  make(chan struct{}),
+	}
+	go s.asyncWorker()
+}
+
+// Dropped returns how many log entries have been dropped because the async
+// buffer was full. It's always zero when async logging isn't enabled.
+func (s *Store) Dropped() uint64 {
+	if s.async == nil {
+		return 0
+	}
+	return s.async.dropped.Load()
+}
+
+// enqueue adds log to the async queue without blocking
+func (s *Store) enqueue(log RequestLog) error {
+	var a = s.async
+	a.RLock()
+	defer a.RUnlock()
+
+	if a.closed {
+		return errors.New("store is closed")
+	}
+
+	select {
+	case a.queue <- log:
+		return nil
+	default:
+		var n = a.dropped.Add(1)
+		s.logger.Warn("Request log queue full, dropping entry", "dropped", n)
+		return ErrQueueFull
+	}
+}
+
+// closeAsync stops accepting new entries, then waits for the worker to flush
+// everything already queued
+func (s *Store) closeAsync() {
+	var a = s.async
+	a.Lock()
+	if !a.closed {
+		a.closed = true
+		close(a.queue)
+	}
+	a.Unlock()
+	<-a.done
+}
+
+// asyncWorker batches queued entries and writes them until the queue is
+// closed and drained
+func (s *Store) asyncWorker() {
+	defer close(s.async.done)
+
+	var batch = make([]RequestLog, 0, asyncBatchSize)
+	var ticker = time.NewTicker(asyncFlushInterval)
+	defer ticker.Stop()
+
+	var flush = func() {
+		if len(batch) == 0 {
+			return
+		}
+		var err = s.insertBatch(batch)
+		if err != nil {
+			s.logger.Error("Could not log requests to database", "count", len(batch), "error", err)
+		}
+		batch = batch[:0]
+	}
+
+	for {
+		select {
+		case log, ok := <-s.async.queue:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, log)
+			if len(batch) >= asyncBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// insertBatch writes all logs with a single multi-row INSERT
+func (s *Store) insertBatch(logs []RequestLog) error {
+	var rows = make([]string, len(logs))
+	var args []any
+	for i, log := range logs {
+		rows[i] = requestLogPlaceholders
+		args = append(args, log.values()...)
+	}
+
+	var query = `
+	INSERT INTO request_logs (` + requestLogColumns + `)
+	VALUES ` + strings.Join(rows, ", ") + `;`
+	var _, err = s.db.Exec(rebind(s.driver, query), args...)
+	return err
+}
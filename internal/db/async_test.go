@@ -0,0 +1,111 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestAsyncBatchesInserts(t *testing.T) {
+	var f = &fakeDB{}
+	var s = newFakeStore(t, f, DriverPostgres)
+	s.EnableAsync(1000)
+
+	const total = 2*asyncBatchSize + 50
+	for range total {
+		var err = s.LogRequest(context.Background(), RequestLog{URL: "/page"})
+		if err != nil {
+			t.Fatalf("LogRequest: %s", err)
+		}
+	}
+	var err = s.Close()
+	if err != nil {
+		t.Fatalf("Close: %s", err)
+	}
+
+	// The flush interval may cut a batch short on a slow machine, but no
+	// batch is ever larger than the limit, and nothing is lost
+	var inserts = f.insertedRows()
+	var sum = 0
+	for _, n := range inserts {
+		sum += n
+		if n > asyncBatchSize {
+			t.Errorf("inserted a batch of %d rows, want at most %d", n, asyncBatchSize)
+		}
+	}
+	if sum != total {
+		t.Errorf("inserted %d rows, want %d", sum, total)
+	}
+	if len(inserts) >= total {
+		t.Errorf("used %d inserts for %d rows, want them batched", len(inserts), total)
+	}
+}
+
+func TestAsyncCloseFlushes(t *testing.T) {
+	var f = &fakeDB{}
+	var s = newFakeStore(t, f, DriverMySQL)
+	s.EnableAsync(10)
+
+	for range 5 {
+		s.LogRequest(context.Background(), RequestLog{URL: "/page"})
+	}
+
+	// Far fewer than a batch, and well inside the flush interval, so only
+	// Close can have written them
+	var err = s.Close()
+	if err != nil {
+		t.Fatalf("Close: %s", err)
+	}
+	var inserts = f.insertedRows()
+	if len(inserts) != 1 || inserts[0] != 5 {
+		t.Errorf("got inserts of %v rows, want a single insert of 5", inserts)
+	}
+
+	err = s.LogRequest(context.Background(), RequestLog{URL: "/late"})
+	if err == nil {
+		t.Errorf("LogRequest after Close succeeded, want an error")
+	}
+}
+
+func TestAsyncDropsOnOverflow(t *testing.T) {
+	var f = &fakeDB{}
+	var s = newFakeStore(t, f, DriverPostgres)
+
+	// Set up the queue without its worker, so nothing drains it until we say
+	// so
+	s.async = &asyncLogger{
+		queue: make(chan RequestLog, 2),
+		done:  make(chan struct{}),
+	}
+
+	var errs []error
+	for range 4 {
+		errs = append(errs, s.LogRequest(context.Background(), RequestLog{URL: "/page"}))
+	}
+	for i, err := range errs {
+		var want error
+		if i >= 2 {
+			want = ErrQueueFull
+		}
+		if !errors.Is(err, want) {
+			t.Errorf("entry %d: got error %v, want %v", i, err, want)
+		}
+	}
+	if got := s.Dropped(); got != 2 {
+		t.Errorf("Dropped() = %d, want 2", got)
+	}
+
+	go s.asyncWorker()
+	s.Close()
+	var inserts = f.insertedRows()
+	if len(inserts) != 1 || inserts[0] != 2 {
+		t.Errorf("got inserts of %v rows, want the 2 queued entries", inserts)
+	}
+}
+
+func TestDroppedWithoutAsync(t *testing.T) {
+	var s = newFakeStore(t, &fakeDB{}, DriverPostgres)
+	if got := s.Dropped(); got != 0 {
+		t.Errorf("Dropped() = %d, want 0", got)
+	}
+}
@@ -2,79 +2,160 @@
 package db
 
 import (
+	"context"
 	"database/sql"
 	"log/slog"
+	"strings"
 	"time"
 
 	// Import for side effects
 	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/lib/pq"
 )
 
 // RequestLog represents a single entry in our request log database.
 type RequestLog struct {
 	ClientIP              string
+	Host                  string
 	Timestamp             time.Time
 	URL                   string
 	HadValidToken         bool
 	WasPresentedChallenge bool
 	ChallengeSucceeded    bool
+	UserAgent             string
+	Referer               string
+	BypassedByCIDR        bool
+	Blocked               bool
+
+	// Where the client IP is, when GeoIP lookups are configured. Stored as
+	// NULL when unknown.
+	Country string
+	ASN     uint
+
+	// Details from the provider's verdict, for verification attempts only.
+	// They're stored as NULL when empty, as they are in rows logged before
+	// they were recorded.
+	ErrorCodes  []string
+	CFHostname  string
+	ChallengeTS time.Time
+}
+
+// requestLogColumns lists the request_logs columns we insert, in the order
+// [RequestLog.values] returns them
+const requestLogColumns = "client_ip, timestamp, url, had_valid_token, was_presented_challenge, challenge_succeeded, user_agent, referer, host, error_codes, cf_hostname, challenge_ts, bypassed_by_cidr, blocked, country, asn"
+
+// requestLogPlaceholders is a row of placeholders matching [requestLogColumns]
+const requestLogPlaceholders = "(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)"
+
+// values returns the log's column values in [requestLogColumns] order
+func (log RequestLog) values() []any {
+	var errorCodes = sql.NullString{String: strings.Join(log.ErrorCodes, ","), Valid: len(log.ErrorCodes) > 0}
+	var cfHostname = sql.NullString{String: log.CFHostname, Valid: log.CFHostname != ""}
+	var challengeTS = sql.NullTime{Time: log.ChallengeTS, Valid: !log.ChallengeTS.IsZero()}
+	var country = sql.NullString{String: log.Country, Valid: log.Country != ""}
+	var asn = sql.NullInt64{Int64: int64(log.ASN), Valid: log.ASN != 0}
+	return []any{
+		log.ClientIP, log.Timestamp, log.URL, log.HadValidToken, log.WasPresentedChallenge, log.ChallengeSucceeded,
+		log.UserAgent, log.Referer, log.Host, errorCodes, cfHostname, challengeTS, log.BypassedByCIDR, log.Blocked,
+		country, asn,
+	}
 }
 
 // Store is a database abstraction that provides methods for storing and
 // retrieving request logs.
 type Store struct {
 	db     *sql.DB
+	driver string
 	logger *slog.Logger
+	async  *asyncLogger
 }
 
-// NewStore creates a new Store and initializes the database schema if it
-// doesn't already exist.
-func NewStore(dataSourceName string, logger *slog.Logger) (*Store, error) {
-	db, err := sql.Open("mysql", dataSourceName)
+// NewStore creates a new Store using the given driver ([DriverMySQL] or
+// [DriverPostgres]) and applies any pending migrations, initializing the
+// database schema if it doesn't already exist. See [Open] for how the DSN
+// and connection are checked.
+func NewStore(driver, dataSourceName string, logger *slog.Logger) (*Store, error) {
+	var store, err = Open(driver, dataSourceName, logger)
 	if err != nil {
 		return nil, err
 	}
-	if err := db.Ping(); err != nil {
+	_, err = store.Migrate()
+	if err != nil {
+		store.Close()
 		return nil, err
 	}
+	return store, nil
+}
 
-	var store = &Store{db: db, logger: logger}
-	if err := store.migrate(); err != nil {
+// Open connects to the database without touching its schema; most callers
+// want [NewStore] instead. The DSN is checked with [ValidateDSN] before
+// connecting, and connection failures wrap [ErrAuthFailed], [ErrUnreachable],
+// or [ErrUnknownDatabase] when the driver tells us which it was.
+func Open(driver, dataSourceName string, logger *slog.Logger) (*Store, error) {
+	if err := ValidateDSN(driver, dataSourceName); err != nil {
 		return nil, err
 	}
-	return store, nil
+
+	db, err := sql.Open(driver, dataSourceName)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, explainConnectError(err)
+	}
+
+	return &Store{db: db, driver: driver, logger: logger}, nil
 }
 
-// Close closes the database connection.
+// Close flushes any queued request logs if async logging is enabled, then
+// closes the database connection.
 func (s *Store) Close() error {
+	if s.async != nil {
+		s.closeAsync()
+	}
 	return s.db.Close()
 }
 
-func (s *Store) migrate() error {
-	var query = `
-	CREATE TABLE IF NOT EXISTS request_logs(
-		id INTEGER PRIMARY KEY AUTO_INCREMENT,
-		client_ip TEXT,
-		timestamp DATETIME(6),
-		url TEXT,
-		had_valid_token TINYINT(1),
-		was_presented_challenge TINYINT(1),
-		challenge_succeeded TINYINT(1)
-	);
-	`
-	_, err := s.db.Exec(query)
-	return err
-}
+// LogRequest logs a request to the database, truncating its URL, User-Agent,
+// Referer, and hostnames to [MaxURLLength], [MaxUserAgentLength],
+// [MaxRefererLength], and [MaxHostLength] if necessary. The write is
+// abandoned if ctx is done first. In async mode (see [Store.EnableAsync]) the
+// request is queued rather than written immediately, and ctx is ignored.
+func (s *Store) LogRequest(ctx context.Context, log RequestLog) error {
+	log.URL = truncate(log.URL, MaxURLLength)
+	log.UserAgent = truncate(log.UserAgent, MaxUserAgentLength)
+	log.Referer = truncate(log.Referer, MaxRefererLength)
+	log.Host = truncate(log.Host, MaxHostLength)
+	log.CFHostname = truncate(log.CFHostname, MaxHostLength)
+	if s.async != nil {
+		return s.enqueue(log)
+	}
 
-// LogRequest logs a request to the database.
-func (s *Store) LogRequest(log RequestLog) error {
 	var query = `
-	INSERT INTO request_logs (client_ip, timestamp, url, had_valid_token, was_presented_challenge, challenge_succeeded)
-	VALUES (?, ?, ?, ?, ?, ?);
+	INSERT INTO request_logs (` + requestLogColumns + `)
+	VALUES ` + requestLogPlaceholders + `;
 	`
-	_, err := s.db.Exec(query, log.ClientIP, log.Timestamp, log.URL, log.HadValidToken, log.WasPresentedChallenge, log.ChallengeSucceeded)
+	_, err := s.db.ExecContext(ctx, rebind(s.driver, query), log.values()...)
 	if err != nil {
 		s.logger.Error("Could not log request to database", "error", err)
 	}
 	return err
 }
+
+// PruneOlderThan deletes all request logs older than d, returning the number
+// of rows removed.
+func (s *Store) PruneOlderThan(d time.Duration) (int64, error) {
+	return s.PruneOlderThanContext(context.Background(), d)
+}
+
+// PruneOlderThanContext is [Store.PruneOlderThan], abandoning the delete if
+// ctx is done first.
+func (s *Store) PruneOlderThanContext(ctx context.Context, d time.Duration) (int64, error) {
+	var query = `DELETE FROM request_logs WHERE timestamp < ?;`
+	var result, err = s.db.ExecContext(ctx, rebind(s.driver, query), time.Now().Add(-d))
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
@@ -0,0 +1,39 @@
+package db
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Supported database drivers
+const (
+	DriverMySQL    = "mysql"
+	DriverPostgres = "postgres"
+)
+
+// ValidDriver returns true if driver is one we know how to talk to
+func ValidDriver(driver string) bool {
+	return driver == DriverMySQL || driver == DriverPostgres
+}
+
+// rebind rewrites a query written with "?" placeholders into the style the
+// given driver expects. MySQL takes them as-is; Postgres wants "$1", "$2", etc.
+// Our queries never contain a literal question mark, so no attempt is made to
+// skip quoted strings.
+func rebind(driver, query string) string {
+	if driver != DriverPostgres {
+		return query
+	}
+
+	var b strings.Builder
+	var n = 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
@@ -0,0 +1,90 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/lib/pq"
+)
+
+// Connection problems [NewStore] can identify. Errors it returns wrap one of
+// these, plus the original driver error, when the cause is known.
+var (
+	ErrAuthFailed      = errors.New("database rejected the username or password")
+	ErrUnreachable     = errors.New("database host is unreachable")
+	ErrUnknownDatabase = errors.New("database does not exist")
+)
+
+// MySQL server error numbers we can explain
+const (
+	mysqlErrDBAccessDenied = 1044
+	mysqlErrAccessDenied   = 1045
+	mysqlErrBadDB          = 1049
+)
+
+// Postgres error codes we can explain
+const (
+	pgErrInvalidAuth     = "28000"
+	pgErrInvalidPassword = "28P01"
+	pgErrInvalidCatalog  = "3D000"
+)
+
+// ValidateDSN parses dsn with the given driver's own parser, and checks it has
+// the settings TPS relies on, returning an error naming the specific problem
+func ValidateDSN(driver, dsn string) error {
+	switch driver {
+	case DriverMySQL:
+		var cfg, err = mysql.ParseDSN(dsn)
+		if err != nil {
+			return fmt.Errorf("invalid MySQL DSN: %w", err)
+		}
+		// We scan DATETIME(6) columns into time.Time, which the driver only
+		// does with parseTime on
+		if !cfg.ParseTime {
+			return errors.New(`invalid MySQL DSN: "parseTime=true" is required`)
+		}
+		return nil
+
+	case DriverPostgres:
+		var _, err = pq.NewConfig(dsn)
+		if err != nil {
+			return fmt.Errorf("invalid Postgres DSN: %w", err)
+		}
+		return nil
+	}
+
+	return fmt.Errorf("unsupported database driver %q", driver)
+}
+
+// explainConnectError wraps err with whichever of [ErrAuthFailed],
+// [ErrUnreachable], or [ErrUnknownDatabase] explains it, if any
+func explainConnectError(err error) error {
+	var myErr *mysql.MySQLError
+	if errors.As(err, &myErr) {
+		switch myErr.Number {
+		case mysqlErrAccessDenied, mysqlErrDBAccessDenied:
+			return fmt.Errorf("%w: %w", ErrAuthFailed, err)
+		case mysqlErrBadDB:
+			return fmt.Errorf("%w: %w", ErrUnknownDatabase, err)
+		}
+	}
+
+	var pgErr *pq.Error
+	if errors.As(err, &pgErr) {
+		switch pgErr.Code {
+		case pgErrInvalidAuth, pgErrInvalidPassword:
+			return fmt.Errorf("%w: %w", ErrAuthFailed, err)
+		case pgErrInvalidCatalog:
+			return fmt.Errorf("%w: %w", ErrUnknownDatabase, err)
+		}
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return fmt.Errorf("%w: %w", ErrUnreachable, err)
+	}
+
+	return err
+}
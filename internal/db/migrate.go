@@ -0,0 +1,335 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// migration is a single, numbered schema change with the queries needed to
+// apply it for each driver. Versions must be unique and increasing; a
+// migration is never edited once it has shipped, since deployments that
+// already applied it won't see the change.
+type migration struct {
+	version int
+	queries map[string][]string
+}
+
+// schemaMigrationsDDL creates the table tracking which migrations have run
+var schemaMigrationsDDL = map[string]string{
+	DriverMySQL: `
+		CREATE TABLE IF NOT EXISTS schema_migrations(
+			version INTEGER PRIMARY KEY,
+			applied_at DATETIME(6) NOT NULL
+		);
+	`,
+	DriverPostgres: `
+		CREATE TABLE IF NOT EXISTS schema_migrations(
+			version INTEGER PRIMARY KEY,
+			applied_at TIMESTAMP(6) NOT NULL
+		);
+	`,
+}
+
+// migrations lists every schema change in the order it must be applied.
+//
+// Version 1 is the original schema, which was created with "IF NOT EXISTS"
+// before we tracked migrations, so it's safe to run against a database that
+// predates the schema_migrations table.
+var migrations = []migration{
+	{
+		version: 1,
+		queries: map[string][]string{
+			DriverMySQL: {`
+				CREATE TABLE IF NOT EXISTS request_logs(
+					id INTEGER PRIMARY KEY AUTO_INCREMENT,
+					client_ip TEXT,
+					timestamp DATETIME(6),
+					url TEXT,
+					had_valid_token TINYINT(1),
+					was_presented_challenge TINYINT(1),
+					challenge_succeeded TINYINT(1)
+				);
+			`},
+			DriverPostgres: {`
+				CREATE TABLE IF NOT EXISTS request_logs(
+					id SERIAL PRIMARY KEY,
+					client_ip TEXT,
+					timestamp TIMESTAMP(6),
+					url TEXT,
+					had_valid_token BOOLEAN,
+					was_presented_challenge BOOLEAN,
+					challenge_succeeded BOOLEAN
+				);
+			`},
+		},
+	},
+	{
+		// URLs have no meaningful upper bound, so url stays TEXT, but IPs (even
+		// IPv6) fit in 45 characters, which lets us index client_ip directly.
+		version: 2,
+		queries: map[string][]string{
+			DriverMySQL: {
+				`ALTER TABLE request_logs MODIFY client_ip VARCHAR(45)`,
+				`CREATE INDEX request_logs_timestamp ON request_logs (timestamp)`,
+				`CREATE INDEX request_logs_client_ip ON request_logs (client_ip)`,
+			},
+			DriverPostgres: {
+				`ALTER TABLE request_logs ALTER COLUMN client_ip TYPE VARCHAR(45)`,
+				`CREATE INDEX request_logs_timestamp ON request_logs (timestamp)`,
+				`CREATE INDEX request_logs_client_ip ON request_logs (client_ip)`,
+			},
+		},
+	},
+	{
+		// Client details for abuse analysis. Both are nullable so rows logged
+		// before this migration are left alone.
+		version: 3,
+		queries: map[string][]string{
+			DriverMySQL: {
+				`ALTER TABLE request_logs ADD COLUMN user_agent VARCHAR(512) NULL`,
+				`ALTER TABLE request_logs ADD COLUMN referer TEXT NULL`,
+			},
+			DriverPostgres: {
+				`ALTER TABLE request_logs ADD COLUMN user_agent VARCHAR(512) NULL`,
+				`ALTER TABLE request_logs ADD COLUMN referer TEXT NULL`,
+			},
+		},
+	},
+	{
+		// The public hostname, so stats can be broken down by site when TPS
+		// fronts more than one
+		version: 4,
+		queries: map[string][]string{
+			DriverMySQL: {
+				`ALTER TABLE request_logs ADD COLUMN host VARCHAR(253) NULL`,
+			},
+			DriverPostgres: {
+				`ALTER TABLE request_logs ADD COLUMN host VARCHAR(253) NULL`,
+			},
+		},
+	},
+	{
+		// The provider's verdict details, for digging into failed or abusive
+		// verifications. error_codes is a comma-separated list.
+		version: 5,
+		queries: map[string][]string{
+			DriverMySQL: {
+				`ALTER TABLE request_logs ADD COLUMN error_codes TEXT NULL`,
+				`ALTER TABLE request_logs ADD COLUMN cf_hostname VARCHAR(253) NULL`,
+				`ALTER TABLE request_logs ADD COLUMN challenge_ts DATETIME(6) NULL`,
+			},
+			DriverPostgres: {
+				`ALTER TABLE request_logs ADD COLUMN error_codes TEXT NULL`,
+				`ALTER TABLE request_logs ADD COLUMN cf_hostname VARCHAR(253) NULL`,
+				`ALTER TABLE request_logs ADD COLUMN challenge_ts TIMESTAMP(6) NULL`,
+			},
+		},
+	},
+	{
+		// Requests from trusted networks, which are proxied without a challenge
+		version: 6,
+		queries: map[string][]string{
+			DriverMySQL: {
+				`ALTER TABLE request_logs ADD COLUMN bypassed_by_cidr TINYINT(1) NULL`,
+			},
+			DriverPostgres: {
+				`ALTER TABLE request_logs ADD COLUMN bypassed_by_cidr BOOLEAN NULL`,
+			},
+		},
+	},
+	{
+		// Requests from blocked networks, which are refused outright
+		version: 7,
+		queries: map[string][]string{
+			DriverMySQL: {
+				`ALTER TABLE request_logs ADD COLUMN blocked TINYINT(1) NULL`,
+			},
+			DriverPostgres: {
+				`ALTER TABLE request_logs ADD COLUMN blocked BOOLEAN NULL`,
+			},
+		},
+	},
+	{
+		// GeoIP details of the client IP, for abuse investigations
+		version: 8,
+		queries: map[string][]string{
+			DriverMySQL: {
+				`ALTER TABLE request_logs ADD COLUMN country CHAR(2) NULL`,
+				`ALTER TABLE request_logs ADD COLUMN asn INT UNSIGNED NULL`,
+			},
+			DriverPostgres: {
+				`ALTER TABLE request_logs ADD COLUMN country CHAR(2) NULL`,
+				`ALTER TABLE request_logs ADD COLUMN asn BIGINT NULL`,
+			},
+		},
+	},
+}
+
+// Advisory lock held while migrating, so instances starting at the same time
+// take turns instead of racing to apply the same migration. MySQL's locks are
+// named; Postgres's are numbered, so its key is just an arbitrary constant.
+const (
+	migrationLockName    = "tps_schema_migrations"
+	migrationLockKey     = 7_391_004_823
+	migrationLockTimeout = 5 * time.Minute
+)
+
+var errMigrationLockTimeout = errors.New("timed out waiting for another instance's migrations")
+
+// execer is what [Store.applyMigration] needs from a connection or transaction
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+// Migrate ensures the schema_migrations table exists, then applies any
+// migrations which haven't yet been recorded there, returning the versions it
+// applied. On error, the versions applied before the failure are returned
+// along with it.
+//
+// Everything happens on one connection holding a database advisory lock, so
+// concurrent calls (e.g., from instances starting together) run one after
+// another, and each sees what the previous one applied. On Postgres, each
+// migration is applied and recorded in a single transaction. MySQL commits
+// DDL statements as they run, so a migration failing partway there leaves its
+// earlier statements applied but not recorded.
+func (s *Store) Migrate() ([]int, error) {
+	var ctx = context.Background()
+	var conn, err = s.db.Conn(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to migrate: %w", err)
+	}
+	defer conn.Close()
+
+	err = s.lockMigrations(ctx, conn)
+	if err != nil {
+		return nil, fmt.Errorf("locking migrations: %w", err)
+	}
+	defer s.unlockMigrations(ctx, conn)
+
+	_, err = conn.ExecContext(ctx, schemaMigrationsDDL[s.driver])
+	if err != nil {
+		return nil, fmt.Errorf("creating schema_migrations: %w", err)
+	}
+
+	var applied = make(map[int]bool)
+	rows, err := conn.QueryContext(ctx, `SELECT version FROM schema_migrations`)
+	if err != nil {
+		return nil, fmt.Errorf("reading schema_migrations: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var v int
+		err = rows.Scan(&v)
+		if err != nil {
+			return nil, fmt.Errorf("reading schema_migrations: %w", err)
+		}
+		applied[v] = true
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("reading schema_migrations: %w", err)
+	}
+	rows.Close()
+
+	var done []int
+	for _, m := range migrations {
+		if applied[m.version] {
+			continue
+		}
+
+		s.logger.Info("Applying database migration", "version", m.version, "driver", s.driver)
+		err = s.applyMigration(ctx, conn, m)
+		if err != nil {
+			return done, err
+		}
+		done = append(done, m.version)
+	}
+
+	return done, nil
+}
+
+// applyMigration runs m's queries and records it in schema_migrations, in one
+// transaction on drivers with transactional DDL
+func (s *Store) applyMigration(ctx context.Context, conn *sql.Conn, m migration) (err error) {
+	var ex execer = conn
+	if s.driver == DriverPostgres {
+		var tx *sql.Tx
+		tx, err = conn.BeginTx(ctx, nil)
+		if err != nil {
+			return fmt.Errorf("starting migration %d: %w", m.version, err)
+		}
+		defer func() {
+			if err != nil {
+				tx.Rollback()
+				return
+			}
+			err = tx.Commit()
+			if err != nil {
+				err = fmt.Errorf("committing migration %d: %w", m.version, err)
+			}
+		}()
+		ex = tx
+	}
+
+	for _, q := range m.queries[s.driver] {
+		_, err = ex.ExecContext(ctx, q)
+		if err != nil {
+			return fmt.Errorf("applying migration %d: %w", m.version, err)
+		}
+	}
+
+	var query = rebind(s.driver, `INSERT INTO schema_migrations (version, applied_at) VALUES (?, ?)`)
+	_, err = ex.ExecContext(ctx, query, m.version, time.Now())
+	if err != nil {
+		return fmt.Errorf("recording migration %d: %w", m.version, err)
+	}
+	return nil
+}
+
+// lockMigrations takes the migration advisory lock on conn, waiting for any
+// other instance holding it
+func (s *Store) lockMigrations(ctx context.Context, conn *sql.Conn) error {
+	if s.driver == DriverPostgres {
+		ctx, cancel := context.WithTimeout(ctx, migrationLockTimeout)
+		defer cancel()
+		var _, err = conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, migrationLockKey)
+		if err != nil && ctx.Err() != nil {
+			return errMigrationLockTimeout
+		}
+		return err
+	}
+
+	// GET_LOCK returns 1 once it has the lock, 0 if it timed out, and NULL on
+	// errors like being killed
+	var got sql.NullInt64
+	var err = conn.QueryRowContext(ctx, `SELECT GET_LOCK(?, ?)`, migrationLockName, int(migrationLockTimeout.Seconds())).Scan(&got)
+	if err != nil {
+		return err
+	}
+	if got.Int64 != 1 {
+		return errMigrationLockTimeout
+	}
+	return nil
+}
+
+// unlockMigrations releases the lock taken by [Store.lockMigrations]. If that
+// fails, the connection is thrown away rather than returned to the pool, which
+// releases the lock along with the session holding it.
+func (s *Store) unlockMigrations(ctx context.Context, conn *sql.Conn) {
+	var err error
+	if s.driver == DriverPostgres {
+		_, err = conn.ExecContext(ctx, `SELECT pg_advisory_unlock($1)`, migrationLockKey)
+	} else {
+		_, err = conn.ExecContext(ctx, `SELECT RELEASE_LOCK(?)`, migrationLockName)
+	}
+	if err != nil {
+		s.logger.Warn("Unable to release the migration lock, closing its connection", "error", err)
+		conn.Raw(func(any) error {
+			return driver.ErrBadConn
+		})
+	}
+}
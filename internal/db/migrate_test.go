@@ -0,0 +1,361 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeDB is a database/sql driver which records the statements it's given,
+// and understands just enough of them to track schema_migrations, advisory
+// locks, transactions, and the timestamps of request_logs rows. Queries
+// counting request_logs get counts as their rows.
+type fakeDB struct {
+	mu       sync.Mutex
+	log      []string
+	versions []int64
+	inserts  []int
+	logTimes []time.Time
+	counts   [][]driver.Value
+	failOn   string
+	lockHeld bool
+}
+
+// Connect implements [driver.Connector]
+func (f *fakeDB) Connect(context.Context) (driver.Conn, error) {
+	return &fakeConn{db: f}, nil
+}
+
+// Driver implements [driver.Connector]
+func (f *fakeDB) Driver() driver.Driver {
+	return nil
+}
+
+// statements returns the recorded statements
+func (f *fakeDB) statements() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return slices.Clone(f.log)
+}
+
+type fakeConn struct {
+	db      *fakeDB
+	pending []int64
+	inTx    bool
+}
+
+func (c *fakeConn) Prepare(string) (driver.Stmt, error) {
+	return nil, errors.New("fakeConn doesn't prepare statements")
+}
+
+func (c *fakeConn) Close() error {
+	return nil
+}
+
+func (c *fakeConn) Begin() (driver.Tx, error) {
+	c.db.mu.Lock()
+	defer c.db.mu.Unlock()
+	c.db.log = append(c.db.log, "BEGIN")
+	c.inTx = true
+	return c, nil
+}
+
+func (c *fakeConn) Commit() error {
+	c.db.mu.Lock()
+	defer c.db.mu.Unlock()
+	c.db.log = append(c.db.log, "COMMIT")
+	c.db.versions = append(c.db.versions, c.pending...)
+	c.pending, c.inTx = nil, false
+	return nil
+}
+
+func (c *fakeConn) Rollback() error {
+	c.db.mu.Lock()
+	defer c.db.mu.Unlock()
+	c.db.log = append(c.db.log, "ROLLBACK")
+	c.pending, c.inTx = nil, false
+	return nil
+}
+
+func (c *fakeConn) ExecContext(_ context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	c.db.mu.Lock()
+	defer c.db.mu.Unlock()
+	query = strings.TrimSpace(query)
+	c.db.log = append(c.db.log, strings.SplitN(query, "\n", 2)[0])
+	if c.db.failOn != "" && strings.Contains(query, c.db.failOn) {
+		return nil, errors.New("fake failure")
+	}
+
+	switch {
+	case strings.HasPrefix(query, "INSERT INTO request_logs"):
+		var cols = strings.Count(requestLogPlaceholders, "?")
+		c.db.inserts = append(c.db.inserts, len(args)/cols)
+		for i := 0; i < len(args); i += cols {
+			c.db.logTimes = append(c.db.logTimes, args[i+1].Value.(time.Time))
+		}
+	case strings.HasPrefix(query, "DELETE FROM request_logs WHERE timestamp <"):
+		var cutoff = args[0].Value.(time.Time)
+		var kept = c.db.logTimes[:0]
+		for _, ts := range c.db.logTimes {
+			if !ts.Before(cutoff) {
+				kept = append(kept, ts)
+			}
+		}
+		var deleted = len(c.db.logTimes) - len(kept)
+		c.db.logTimes = kept
+		return driver.RowsAffected(deleted), nil
+	case strings.HasPrefix(query, "INSERT INTO schema_migrations"):
+		var v = args[0].Value.(int64)
+		if c.inTx {
+			c.pending = append(c.pending, v)
+		} else {
+			c.db.versions = append(c.db.versions, v)
+		}
+	case strings.Contains(query, "pg_advisory_lock"):
+		c.db.lockHeld = true
+	case strings.Contains(query, "pg_advisory_unlock"), strings.Contains(query, "RELEASE_LOCK"):
+		c.db.lockHeld = false
+	}
+	return driver.RowsAffected(1), nil
+}
+
+func (c *fakeConn) QueryContext(_ context.Context, query string, _ []driver.NamedValue) (driver.Rows, error) {
+	c.db.mu.Lock()
+	defer c.db.mu.Unlock()
+	c.db.log = append(c.db.log, query)
+
+	switch {
+	case strings.Contains(query, "GET_LOCK"):
+		c.db.lockHeld = true
+		return &fakeRows{col: "got", values: []int64{1}}, nil
+	case strings.Contains(query, "FROM schema_migrations"):
+		return &fakeRows{col: "version", values: slices.Clone(c.db.versions)}, nil
+	case strings.Contains(query, "FROM request_logs"):
+		return &fakeTable{rows: slices.Clone(c.db.counts)}, nil
+	}
+	return nil, errors.New("fakeConn can't answer " + query)
+}
+
+type fakeRows struct {
+	col    string
+	values []int64
+}
+
+func (r *fakeRows) Columns() []string {
+	return []string{r.col}
+}
+
+func (r *fakeRows) Close() error {
+	return nil
+}
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	dest[0], r.values = r.values[0], r.values[1:]
+	return nil
+}
+
+// insertedRows returns the number of rows written by each request_logs insert
+func (f *fakeDB) insertedRows() []int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return slices.Clone(f.inserts)
+}
+
+// fakeTable is a result set with any number of columns
+type fakeTable struct {
+	rows [][]driver.Value
+}
+
+func (r *fakeTable) Columns() []string {
+	if len(r.rows) == 0 {
+		return nil
+	}
+	return make([]string, len(r.rows[0]))
+}
+
+func (r *fakeTable) Close() error {
+	return nil
+}
+
+func (r *fakeTable) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
+
+// newFakeStore returns a store on top of f for the given driver
+func newFakeStore(t *testing.T, f *fakeDB, driver string) *Store {
+	t.Helper()
+	var db = sql.OpenDB(f)
+	t.Cleanup(func() { db.Close() })
+	return &Store{db: db, driver: driver, logger: slog.New(slog.DiscardHandler)}
+}
+
+// allVersions lists every migration's version
+func allVersions() []int {
+	var versions []int
+	for _, m := range migrations {
+		versions = append(versions, m.version)
+	}
+	return versions
+}
+
+func TestMigrateFreshDatabase(t *testing.T) {
+	for _, drv := range []string{DriverMySQL, DriverPostgres} {
+		t.Run(drv, func(t *testing.T) {
+			var f = &fakeDB{}
+			var got, err = newFakeStore(t, f, drv).Migrate()
+			if err != nil {
+				t.Fatalf("Migrate: %s", err)
+			}
+			if !slices.Equal(got, allVersions()) {
+				t.Errorf("applied %v, want %v", got, allVersions())
+			}
+			if len(f.versions) != len(migrations) {
+				t.Errorf("recorded %v, want every version", f.versions)
+			}
+			if f.lockHeld {
+				t.Errorf("migration lock wasn't released")
+			}
+
+			var log = f.statements()
+			var lock, unlock = "GET_LOCK", "RELEASE_LOCK"
+			if drv == DriverPostgres {
+				lock, unlock = "pg_advisory_lock", "pg_advisory_unlock"
+			}
+			if !strings.Contains(log[0], lock) || !strings.Contains(log[len(log)-1], unlock) {
+				t.Errorf("statements weren't run under %s: first %q, last %q", lock, log[0], log[len(log)-1])
+			}
+
+			var begins, commits = 0, 0
+			for _, st := range log {
+				switch st {
+				case "BEGIN":
+					begins++
+				case "COMMIT":
+					commits++
+				}
+			}
+			var wantTx = 0
+			if drv == DriverPostgres {
+				wantTx = len(migrations)
+			}
+			if begins != wantTx || commits != wantTx {
+				t.Errorf("got %d transactions begun and %d committed, want %d", begins, commits, wantTx)
+			}
+		})
+	}
+}
+
+func TestMigrateUpgradeFromBaseline(t *testing.T) {
+	// A database from before migrations 2 and up, which already has the
+	// original schema recorded
+	var f = &fakeDB{versions: []int64{1}}
+	var got, err = newFakeStore(t, f, DriverPostgres).Migrate()
+	if err != nil {
+		t.Fatalf("Migrate: %s", err)
+	}
+	if !slices.Equal(got, allVersions()[1:]) {
+		t.Errorf("applied %v, want %v", got, allVersions()[1:])
+	}
+	for _, st := range f.statements() {
+		if strings.Contains(st, "CREATE TABLE IF NOT EXISTS request_logs") {
+			t.Errorf("reapplied migration 1")
+		}
+	}
+
+	// Running again finds nothing to do
+	got, err = newFakeStore(t, f, DriverPostgres).Migrate()
+	if err != nil || len(got) != 0 {
+		t.Errorf("second Migrate applied %v with error %v, want nothing", got, err)
+	}
+}
+
+func TestMigrateFailureRollsBack(t *testing.T) {
+	var f = &fakeDB{failOn: "ADD COLUMN host"}
+	var got, err = newFakeStore(t, f, DriverPostgres).Migrate()
+	if err == nil {
+		t.Fatalf("Migrate succeeded, want an error from migration 4")
+	}
+	if !slices.Equal(got, []int{1, 2, 3}) {
+		t.Errorf("applied %v, want [1 2 3]", got)
+	}
+	if !slices.Equal(f.versions, []int64{1, 2, 3}) {
+		t.Errorf("recorded %v, want [1 2 3]", f.versions)
+	}
+	if !slices.Contains(f.statements(), "ROLLBACK") {
+		t.Errorf("failed migration wasn't rolled back")
+	}
+	if f.lockHeld {
+		t.Errorf("migration lock wasn't released after the failure")
+	}
+}
+
+func TestPruneOlderThan(t *testing.T) {
+	for _, drv := range []string{DriverMySQL, DriverPostgres} {
+		t.Run(drv, func(t *testing.T) {
+			var f = &fakeDB{}
+			var s = newFakeStore(t, f, drv)
+			var now = time.Now()
+			var day = 24 * time.Hour
+			for _, age := range []time.Duration{40 * day, 31 * day, 29 * day, day, 0} {
+				var err = s.LogRequest(context.Background(), RequestLog{URL: "/page", Timestamp: now.Add(-age)})
+				if err != nil {
+					t.Fatalf("LogRequest: %s", err)
+				}
+			}
+
+			var n, err = s.PruneOlderThan(30 * day)
+			if err != nil {
+				t.Fatalf("PruneOlderThan: %s", err)
+			}
+			if n != 2 {
+				t.Errorf("pruned %d rows, want 2", n)
+			}
+			for _, ts := range f.logTimes {
+				if now.Sub(ts) > 30*day {
+					t.Errorf("row from %s survived pruning", ts)
+				}
+			}
+			if len(f.logTimes) != 3 {
+				t.Errorf("%d rows left, want 3", len(f.logTimes))
+			}
+
+			// Nothing left to prune
+			n, err = s.PruneOlderThan(30 * day)
+			if err != nil || n != 0 {
+				t.Errorf("second prune removed %d rows with error %v, want none", n, err)
+			}
+		})
+	}
+}
+
+func TestPruneOlderThanContextCanceled(t *testing.T) {
+	var f = &fakeDB{}
+	var s = newFakeStore(t, f, DriverPostgres)
+	s.LogRequest(context.Background(), RequestLog{URL: "/page", Timestamp: time.Now().Add(-time.Hour)})
+
+	var ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	var _, err = s.PruneOlderThanContext(ctx, time.Minute)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("got error %v, want %v", err, context.Canceled)
+	}
+	if len(f.logTimes) != 1 {
+		t.Errorf("%d rows left, want the 1 row untouched", len(f.logTimes))
+	}
+}
@@ -0,0 +1,40 @@
+package db
+
+import (
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// SanitizeURL returns u as it should be stored in request_logs: without any
+// userinfo, so credentials never land in the database, and cut down to at most
+// maxLen bytes (never more than [MaxURLLength]). If params is nil the query
+// string is kept whole; otherwise only the named parameters are kept, in their
+// original order, and an empty params drops the query string entirely.
+func SanitizeURL(u *url.URL, params []string, maxLen int) string {
+	var clean = *u
+	clean.User = nil
+	if params != nil {
+		clean.RawQuery = filterQuery(u.RawQuery, params)
+		clean.ForceQuery = false
+	}
+
+	if maxLen <= 0 || maxLen > MaxURLLength {
+		maxLen = MaxURLLength
+	}
+	return truncate(clean.String(), maxLen)
+}
+
+// filterQuery returns the parts of a raw query string whose (unescaped) names
+// are in params. Parts that can't be unescaped are dropped.
+func filterQuery(rawQuery string, params []string) string {
+	var kept []string
+	for part := range strings.SplitSeq(rawQuery, "&") {
+		var name, _, _ = strings.Cut(part, "=")
+		var unescaped, err = url.QueryUnescape(name)
+		if err == nil && slices.Contains(params, unescaped) {
+			kept = append(kept, part)
+		}
+	}
+	return strings.Join(kept, "&")
+}
@@ -0,0 +1,53 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// OutcomeCounts summarizes logged requests for a single host
+type OutcomeCounts struct {
+	Host                string `json:"host"`
+	Total               int64  `json:"total"`
+	ChallengesPresented int64  `json:"challenges_presented"`
+	ChallengesPassed    int64  `json:"challenges_passed"`
+	ChallengesFailed    int64  `json:"challenges_failed"`
+	ValidTokens         int64  `json:"valid_tokens"`
+}
+
+// CountByOutcome returns counts of requests logged since the given time,
+// grouped by host and sorted by hostname. Requests logged before hosts were
+// recorded are grouped under an empty hostname. The query is abandoned if ctx
+// is done first.
+func (s *Store) CountByOutcome(ctx context.Context, since time.Time) ([]OutcomeCounts, error) {
+	var query = `
+	SELECT
+		COALESCE(host, ''),
+		COUNT(*),
+		SUM(CASE WHEN was_presented_challenge THEN 1 ELSE 0 END),
+		SUM(CASE WHEN was_presented_challenge AND challenge_succeeded THEN 1 ELSE 0 END),
+		SUM(CASE WHEN was_presented_challenge AND NOT challenge_succeeded THEN 1 ELSE 0 END),
+		SUM(CASE WHEN had_valid_token THEN 1 ELSE 0 END)
+	FROM request_logs
+	WHERE timestamp >= ?
+	GROUP BY COALESCE(host, '')
+	ORDER BY COALESCE(host, '');
+	`
+	var rows, err = s.db.QueryContext(ctx, rebind(s.driver, query), since)
+	if err != nil {
+		return nil, fmt.Errorf("counting request outcomes: %w", err)
+	}
+	defer rows.Close()
+
+	var counts []OutcomeCounts
+	for rows.Next() {
+		var c OutcomeCounts
+		err = rows.Scan(&c.Host, &c.Total, &c.ChallengesPresented, &c.ChallengesPassed, &c.ChallengesFailed, &c.ValidTokens)
+		if err != nil {
+			return nil, fmt.Errorf("counting request outcomes: %w", err)
+		}
+		counts = append(counts, c)
+	}
+	return counts, rows.Err()
+}
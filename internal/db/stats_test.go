@@ -0,0 +1,35 @@
+package db
+
+import (
+	"context"
+	"database/sql/driver"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestCountByOutcome(t *testing.T) {
+	var f = &fakeDB{counts: [][]driver.Value{
+		{"", int64(5), int64(0), int64(0), int64(0), int64(5)},
+		{"a.x.edu", int64(100), int64(20), int64(15), int64(5), int64(80)},
+	}}
+	var got, err = newFakeStore(t, f, DriverPostgres).CountByOutcome(context.Background(), time.Now().Add(-time.Hour))
+	if err != nil {
+		t.Fatalf("CountByOutcome: %s", err)
+	}
+
+	var want = []OutcomeCounts{
+		{Host: "", Total: 5, ValidTokens: 5},
+		{Host: "a.x.edu", Total: 100, ChallengesPresented: 20, ChallengesPassed: 15, ChallengesFailed: 5, ValidTokens: 80},
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestCountByOutcomeEmpty(t *testing.T) {
+	var got, err = newFakeStore(t, &fakeDB{}, DriverMySQL).CountByOutcome(context.Background(), time.Now())
+	if err != nil || got != nil {
+		t.Errorf("got %+v with error %v, want nothing", got, err)
+	}
+}
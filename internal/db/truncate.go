@@ -0,0 +1,34 @@
+package db
+
+import "unicode/utf8"
+
+// MaxURLLength is the longest URL we store in request_logs. Longer URLs are
+// truncated: they're almost always junk, and the column is indexed by
+// analysts far more often than it's read in full.
+const MaxURLLength = 2048
+
+// MaxUserAgentLength is the longest User-Agent we store in request_logs. Real
+// browsers stay well under this; anything longer is junk or an attack.
+const MaxUserAgentLength = 512
+
+// MaxRefererLength is the longest Referer we store in request_logs. A referer
+// is just another URL, so it gets the same limit.
+const MaxRefererLength = MaxURLLength
+
+// MaxHostLength is the longest hostname we store in request_logs, which is
+// the longest a valid DNS name can be
+const MaxHostLength = 253
+
+// truncate cuts s down to at most n bytes without splitting a multi-byte
+// character
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+
+	var end = n
+	for end > 0 && !utf8.RuneStart(s[end]) {
+		end--
+	}
+	return s[:end]
+}
@@ -0,0 +1,102 @@
+// Package geoip looks up the country and autonomous system of IP addresses in
+// local MaxMind-format (mmdb) databases
+package geoip
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+
+	"github.com/oschwald/maxminddb-golang/v2"
+)
+
+// Info is what's known about an IP. Fields are empty when no database has
+// them, e.g., a country database has no ASN.
+type Info struct {
+	Country string // ISO 3166-1 alpha-2 country code, e.g., "US"
+	ASN     uint   // autonomous system number
+}
+
+// record holds the fields we use from GeoIP2/GeoLite2 Country, City, and ASN
+// databases, and others (like DB-IP's) which follow the same layout
+type record struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	RegisteredCountry struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"registered_country"`
+	ASN uint `maxminddb:"autonomous_system_number"`
+}
+
+// DB looks IPs up in one or more databases, e.g., a country database and an
+// ASN database. It's safe for concurrent use.
+type DB struct {
+	readers []*maxminddb.Reader
+}
+
+// Open opens the mmdb files at paths. Lookups are served from memory-mapped
+// files, so they're fast enough to do on every request.
+func Open(paths ...string) (*DB, error) {
+	var d = &DB{}
+	for _, p := range paths {
+		var r, err = maxminddb.Open(p)
+		if err != nil {
+			d.Close()
+			return nil, fmt.Errorf("opening %q: %w", p, err)
+		}
+		d.readers = append(d.readers, r)
+	}
+	return d, nil
+}
+
+// Lookup returns what the databases know about ip. Each field comes from the
+// first database that has it. Errors (e.g., a corrupt record) are returned
+// alongside whatever was found in the other databases.
+func (d *DB) Lookup(ip netip.Addr) (Info, error) {
+	var info Info
+	var errs []error
+	ip = ip.Unmap()
+	for _, r := range d.readers {
+		// IPv4-only databases can't answer for IPv6 clients, which isn't an
+		// error worth reporting on every request
+		if ip.Is6() && r.Metadata.IPVersion == 4 {
+			continue
+		}
+
+		var rec record
+		var err = r.Lookup(ip).Decode(&rec)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if info.Country == "" {
+			info.Country = countryCode(rec.Country.ISOCode, rec.RegisteredCountry.ISOCode)
+		}
+		if info.ASN == 0 {
+			info.ASN = rec.ASN
+		}
+	}
+	return info, errors.Join(errs...)
+}
+
+// countryCode returns the first of codes which is a two-letter country code,
+// or "" if none are. The registered country stands in for IPs, like anycast
+// addresses, which have no physical location.
+func countryCode(codes ...string) string {
+	for _, c := range codes {
+		if len(c) == 2 {
+			return c
+		}
+	}
+	return ""
+}
+
+// Close closes all the databases
+func (d *DB) Close() error {
+	var errs []error
+	for _, r := range d.readers {
+		errs = append(errs, r.Close())
+	}
+	return errors.Join(errs...)
+}
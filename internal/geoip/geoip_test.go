@@ -0,0 +1,64 @@
+package geoip
+
+import (
+	"net/netip"
+	"testing"
+)
+
+// The fixtures are tiny IPv4 databases: country.mmdb maps 1.2.3.0/24 to "US",
+// and asn.mmdb maps 1.2.0.0/16 to AS64500
+const (
+	countryDB = "testdata/country.mmdb"
+	asnDB     = "testdata/asn.mmdb"
+)
+
+func TestLookup(t *testing.T) {
+	var d, err = Open(countryDB, asnDB)
+	if err != nil {
+		t.Fatalf("Open: %s", err)
+	}
+	defer d.Close()
+
+	var tests = map[string]struct {
+		ip   string
+		want Info
+	}{
+		"in both":          {"1.2.3.4", Info{Country: "US", ASN: 64500}},
+		"ASN only":         {"1.2.200.1", Info{ASN: 64500}},
+		"in neither":       {"192.0.2.1", Info{}},
+		"IPv4-mapped IPv6": {"::ffff:1.2.3.4", Info{Country: "US", ASN: 64500}},
+		"IPv6":             {"2001:db8::1", Info{}},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var got, err = d.Lookup(netip.MustParseAddr(tc.ip))
+			if err != nil {
+				t.Fatalf("Lookup: %s", err)
+			}
+			if got != tc.want {
+				t.Errorf("got %+v, want %+v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestOpenMissingFile(t *testing.T) {
+	var d, err = Open(countryDB, "testdata/missing.mmdb")
+	if err == nil {
+		d.Close()
+		t.Fatalf("Open succeeded with a missing database")
+	}
+}
+
+func TestOpenNothing(t *testing.T) {
+	var d, err = Open()
+	if err != nil {
+		t.Fatalf("Open: %s", err)
+	}
+	var got Info
+	got, err = d.Lookup(netip.MustParseAddr("1.2.3.4"))
+	if err != nil || got != (Info{}) {
+		t.Errorf("got %+v and error %v, want nothing", got, err)
+	}
+}
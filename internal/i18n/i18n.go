@@ -0,0 +1,184 @@
+// Package i18n holds the message catalogs for TPS's built-in pages, and picks
+// the best language for a request from its Accept-Language header
+package i18n
+
+import (
+	"cmp"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// FS is the embedded filesystem for the default message catalogs, one
+// "<language>.json" file per language
+//
+//go:embed *.json
+var FS embed.FS
+
+// Catalog holds the messages for each known language, keyed by lowercase
+// language tag (e.g., "en" or "es-mx"), and the language to fall back to when
+// a client accepts none of them
+type Catalog struct {
+	fallback string
+	langs    map[string]map[string]string
+}
+
+// Default returns the catalog of embedded messages, falling back to English
+func Default() *Catalog {
+	var c, err = Load("en", FS)
+	if err != nil {
+		panic("i18n: cannot load embedded messages: " + err.Error())
+	}
+	return c
+}
+
+// Load reads every "<language>.json" file in each filesystem, in order, into
+// a new catalog. Each file is a flat JSON object of message keys to strings.
+// Later filesystems add languages and override messages from earlier ones.
+// The fallback language must have a catalog.
+func Load(fallback string, fsyss ...fs.FS) (*Catalog, error) {
+	var c = &Catalog{fallback: strings.ToLower(fallback), langs: make(map[string]map[string]string)}
+	for _, fsys := range fsyss {
+		var files, err = fs.Glob(fsys, "*.json")
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			var lang = strings.ToLower(strings.TrimSuffix(path.Base(file), ".json"))
+			if !validTag(lang) {
+				return nil, fmt.Errorf("%s: %q is not a language tag", file, lang)
+			}
+
+			var data []byte
+			data, err = fs.ReadFile(fsys, file)
+			if err != nil {
+				return nil, err
+			}
+			var messages map[string]string
+			err = json.Unmarshal(data, &messages)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", file, err)
+			}
+
+			if c.langs[lang] == nil {
+				c.langs[lang] = make(map[string]string)
+			}
+			for key, msg := range messages {
+				c.langs[lang][key] = msg
+			}
+		}
+	}
+
+	if c.langs[c.fallback] == nil {
+		return nil, fmt.Errorf("no messages for default language %q", fallback)
+	}
+	return c, nil
+}
+
+// validTag returns true if tag looks like a language tag: letters, digits,
+// and hyphens, starting with a letter
+func validTag(tag string) bool {
+	if tag == "" || tag[0] < 'a' || tag[0] > 'z' {
+		return false
+	}
+	for _, r := range tag {
+		if (r < 'a' || r > 'z') && (r < '0' || r > '9') && r != '-' {
+			return false
+		}
+	}
+	return true
+}
+
+// Languages returns the catalog's language tags, sorted
+func (c *Catalog) Languages() []string {
+	var langs = make([]string, 0, len(c.langs))
+	for lang := range c.langs {
+		langs = append(langs, lang)
+	}
+	slices.Sort(langs)
+	return langs
+}
+
+// Fallback returns the language used when a client accepts none of ours
+func (c *Catalog) Fallback() string {
+	return c.fallback
+}
+
+// Negotiate returns the catalog language that best matches an Accept-Language
+// header. Languages are tried in order of preference ("q" value): an exact
+// match wins, and otherwise a regional tag like "es-MX" matches the base
+// language "es". If nothing matches, or the client accepts any language
+// ("*"), the fallback language is returned.
+func (c *Catalog) Negotiate(acceptLanguage string) string {
+	type choice struct {
+		tag string
+		q   float64
+	}
+
+	var choices []choice
+	for part := range strings.SplitSeq(acceptLanguage, ",") {
+		var tag, params, _ = strings.Cut(part, ";")
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" {
+			continue
+		}
+
+		var q = 1.0
+		for param := range strings.SplitSeq(params, ";") {
+			var k, v, _ = strings.Cut(param, "=")
+			if strings.TrimSpace(k) != "q" {
+				continue
+			}
+			var err error
+			q, err = strconv.ParseFloat(strings.TrimSpace(v), 64)
+			if err != nil {
+				q = 0
+			}
+		}
+		if q > 0 {
+			choices = append(choices, choice{tag, q})
+		}
+	}
+	slices.SortStableFunc(choices, func(a, b choice) int { return cmp.Compare(b.q, a.q) })
+
+	for _, ch := range choices {
+		if ch.tag == "*" {
+			return c.fallback
+		}
+		if c.langs[ch.tag] != nil {
+			return ch.tag
+		}
+		var base, _, _ = strings.Cut(ch.tag, "-")
+		if c.langs[base] != nil {
+			return base
+		}
+	}
+	return c.fallback
+}
+
+// Translate returns the message for key in lang, falling back to the default
+// language, and then to the key itself so a missing message is obvious
+// rather than blank
+func (c *Catalog) Translate(lang, key string) string {
+	var msg, ok = c.langs[lang][key]
+	if ok {
+		return msg
+	}
+	msg, ok = c.langs[c.fallback][key]
+	if ok {
+		return msg
+	}
+	return key
+}
+
+// Translator returns a function translating keys into lang, for templates
+func (c *Catalog) Translator(lang string) func(key string) string {
+	return func(key string) string {
+		return c.Translate(lang, key)
+	}
+}
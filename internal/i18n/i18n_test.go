@@ -0,0 +1,98 @@
+package i18n
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestNegotiate(t *testing.T) {
+	var c = Default()
+	var tests = map[string]string{
+		"":                          "en",
+		"es":                        "es",
+		"ES":                        "es",
+		"es-MX":                     "es",
+		"es-MX,en;q=0.5":            "es",
+		"en;q=0.2, es;q=0.9":        "es",
+		"fr, es;q=0.8, en;q=0.7":    "es",
+		"fr":                        "en",
+		"fr-CA, de":                 "en",
+		"*":                         "en",
+		"es;q=0":                    "en",
+		"es;q=junk":                 "en",
+		"es; q=0.5 , en ; q=0.6":    "en",
+		" , ;q=1, es":               "es",
+		"de;q=1, *;q=0.9, es;q=0.5": "en",
+	}
+	for header, want := range tests {
+		t.Run(header, func(t *testing.T) {
+			if got := c.Negotiate(header); got != want {
+				t.Errorf("Negotiate(%q) = %q, want %q", header, got, want)
+			}
+		})
+	}
+}
+
+func TestFallback(t *testing.T) {
+	var c, err = Load("es", FS)
+	if err != nil {
+		t.Fatalf("Load: %s", err)
+	}
+	if got := c.Fallback(); got != "es" {
+		t.Errorf("Fallback() = %q, want es", got)
+	}
+	if got := c.Negotiate("fr"); got != "es" {
+		t.Errorf("Negotiate(fr) = %q, want the default language", got)
+	}
+	if got := c.Negotiate("en"); got != "en" {
+		t.Errorf("Negotiate(en) = %q, want en", got)
+	}
+
+	_, err = Load("fr", FS)
+	if err == nil || !strings.Contains(err.Error(), `"fr"`) {
+		t.Errorf("got error %v loading without messages for the default language, want one about fr", err)
+	}
+}
+
+func TestLoadOverrides(t *testing.T) {
+	var custom = fstest.MapFS{
+		"en.json": {Data: []byte(`{"challenge.heading": "One moment..."}`)},
+		"fr.json": {Data: []byte(`{"challenge.heading": "Traitement..."}`)},
+	}
+	var c, err = Load("en", FS, custom)
+	if err != nil {
+		t.Fatalf("Load: %s", err)
+	}
+
+	if got := c.Languages(); !slices.Equal(got, []string{"en", "es", "fr"}) {
+		t.Errorf("Languages() = %q, want en, es, and fr", got)
+	}
+	var tests = []struct{ lang, key, want string }{
+		{"en", "challenge.heading", "One moment..."},
+		{"en", "challenge.title", "Verifying browser"},
+		{"fr", "challenge.heading", "Traitement..."},
+		{"fr", "challenge.title", "Verifying browser"},
+		{"es", "no.such.key", "no.such.key"},
+	}
+	for _, tc := range tests {
+		if got := c.Translate(tc.lang, tc.key); got != tc.want {
+			t.Errorf("Translate(%q, %q) = %q, want %q", tc.lang, tc.key, got, tc.want)
+		}
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	var tests = map[string]fstest.MapFS{
+		"bad tag":  {"en_US.json": {Data: []byte(`{}`)}},
+		"bad JSON": {"en.json": {Data: []byte(`{"a": 1}`)}},
+	}
+	for name, fsys := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := Load("en", FS, fsys); err == nil {
+				t.Errorf("Load succeeded, want an error")
+			}
+		})
+	}
+}
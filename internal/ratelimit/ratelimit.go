@@ -0,0 +1,86 @@
+// Package ratelimit is a simple per-key token bucket rate limiter, safe for
+// concurrent use
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// sweepInterval is how often idle buckets are cleared out
+const sweepInterval = time.Minute
+
+// bucket holds the tokens available for one key as of the last time it was
+// checked
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Limiter allows up to rate events per second per key, with bursts of up to
+// burst events. Each key gets its own token bucket, which starts full.
+type Limiter struct {
+	sync.Mutex
+	rate      float64
+	burst     float64
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+// New returns a limiter allowing rate events per second per key, with bursts
+// of up to burst events. rate and burst must both be positive.
+func New(rate float64, burst int) *Limiter {
+	if rate <= 0 || burst <= 0 {
+		panic("ratelimit: rate and burst must be positive")
+	}
+	return &Limiter{
+		rate:      rate,
+		burst:     float64(burst),
+		buckets:   make(map[string]*bucket),
+		lastSweep: time.Now(),
+	}
+}
+
+// Allow takes a token from key's bucket if one is available and returns true.
+// Otherwise it returns false and how long until a token will be available.
+func (l *Limiter) Allow(key string) (bool, time.Duration) {
+	l.Lock()
+	defer l.Unlock()
+
+	var now = time.Now()
+	l.sweep(now)
+
+	var b = l.buckets[key]
+	if b == nil {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+
+	var wait = (1 - b.tokens) / l.rate
+	return false, time.Duration(wait * float64(time.Second))
+}
+
+// sweep removes buckets which have been idle long enough to refill
+// completely, since a new bucket would be identical. It only does the work
+// once per [sweepInterval] so Allow stays cheap.
+func (l *Limiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < sweepInterval {
+		return
+	}
+	l.lastSweep = now
+
+	var full = time.Duration(l.burst / l.rate * float64(time.Second))
+	for key, b := range l.buckets {
+		if now.Sub(b.last) >= full {
+			delete(l.buckets, key)
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAllow(t *testing.T) {
+	var l = New(0.5, 3)
+
+	for i := range 3 {
+		if ok, _ := l.Allow("a"); !ok {
+			t.Fatalf("event %d within the burst was refused", i+1)
+		}
+	}
+
+	var ok, wait = l.Allow("a")
+	if ok {
+		t.Fatalf("event past the burst was allowed")
+	}
+	if wait <= time.Second || wait > 2*time.Second {
+		t.Errorf("got wait %s, want just under 2s at 0.5 events per second", wait)
+	}
+
+	// Every key has its own bucket
+	if ok, _ := l.Allow("b"); !ok {
+		t.Errorf("another key was refused")
+	}
+}
+
+func TestAllowRefills(t *testing.T) {
+	var l = New(1000, 1)
+	if ok, _ := l.Allow("a"); !ok {
+		t.Fatalf("first event was refused")
+	}
+	if ok, _ := l.Allow("a"); ok {
+		t.Fatalf("second event was allowed immediately")
+	}
+	time.Sleep(5 * time.Millisecond)
+	if ok, _ := l.Allow("a"); !ok {
+		t.Errorf("event was refused after the bucket refilled")
+	}
+}
@@ -0,0 +1,187 @@
+// Package reqcache holds challenged requests while their clients solve the
+// challenge. It wraps go-cache with an optional cap on the number of items,
+// evicting the oldest when full, and counts what happens to each item so
+// requests lost before they're verified don't go unnoticed. It is safe for
+// concurrent use.
+package reqcache
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+)
+
+// Item states. Each item leaves the cache exactly once: taken by its client,
+// expired, or evicted to make room, whichever happens first.
+const (
+	live int32 = iota
+	taken
+	expired
+	evicted
+)
+
+// item is a cached value along with what became of it
+type item struct {
+	value any
+	state atomic.Int32
+}
+
+// Stats is a snapshot of a cache's counters
+type Stats struct {
+	Items       int    `json:"items"`
+	MaxItems    int    `json:"max_items"`
+	Sets        uint64 `json:"sets"`
+	Hits        uint64 `json:"hits"`
+	Misses      uint64 `json:"misses"`
+	Expirations uint64 `json:"expirations"`
+	Evictions   uint64 `json:"evictions"`
+}
+
+// Cache holds values for a fixed TTL, and optionally up to a maximum number of
+// items. Every item has the same TTL, so the order items were added is also
+// the order they'll expire, and that's the order they're evicted in when the
+// cache is full.
+type Cache struct {
+	items    *cache.Cache
+	maxItems int
+	onRemove func(any)
+
+	mu    sync.Mutex
+	order *list.List
+	elems map[string]*list.Element
+
+	sets        atomic.Uint64
+	hits        atomic.Uint64
+	misses      atomic.Uint64
+	expirations atomic.Uint64
+	evictions   atomic.Uint64
+}
+
+// New returns a cache holding values for ttl. If maxItems is positive, adding
+// an item to a full cache evicts the oldest. onRemove, if not nil, is called
+// with each value once it leaves the cache, however it leaves.
+func New(ttl time.Duration, maxItems int, onRemove func(any)) *Cache {
+	var c = &Cache{
+		items:    cache.New(ttl, 2*ttl),
+		maxItems: maxItems,
+		onRemove: onRemove,
+		order:    list.New(),
+		elems:    make(map[string]*list.Element),
+	}
+	c.items.OnEvicted(c.removed)
+	return c
+}
+
+// Set adds v to the cache under key, evicting the oldest items if that would
+// put the cache over its maximum
+func (c *Cache) Set(key string, v any) {
+	var victims []string
+
+	c.mu.Lock()
+	c.forget(key)
+	for c.maxItems > 0 && c.order.Len() >= c.maxItems {
+		var oldest = c.order.Front()
+		var k = oldest.Value.(string)
+		c.order.Remove(oldest)
+		delete(c.elems, k)
+		victims = append(victims, k)
+	}
+	c.elems[key] = c.order.PushBack(key)
+	c.items.SetDefault(key, &item{value: v})
+	c.mu.Unlock()
+	c.sets.Add(1)
+
+	// Victims are deleted outside the lock, since deletion calls back into
+	// [Cache.removed]
+	for _, k := range victims {
+		var old, found = c.items.Get(k)
+		if found && old.(*item).state.CompareAndSwap(live, evicted) {
+			c.evictions.Add(1)
+		}
+		c.items.Delete(k)
+	}
+}
+
+// Take removes key's value from the cache and returns it. The boolean is
+// false if key isn't in the cache, whether it was never there, has expired,
+// or was evicted. An expired item the janitor hasn't swept yet is removed
+// right away, rather than holding onto its value until the next sweep.
+func (c *Cache) Take(key string) (any, bool) {
+	var v, found = c.items.Get(key)
+	if !found || !v.(*item).state.CompareAndSwap(live, taken) {
+		c.misses.Add(1)
+		c.items.Delete(key)
+		return nil, false
+	}
+
+	c.hits.Add(1)
+	c.items.Delete(key)
+	return v.(*item).value, true
+}
+
+// Peek returns key's value without taking it or counting a hit or miss. The
+// boolean is false if key isn't in the cache or has been taken. Like
+// [Cache.Take], it removes an expired item the janitor hasn't swept yet.
+func (c *Cache) Peek(key string) (any, bool) {
+	var v, found = c.items.Get(key)
+	if !found {
+		c.items.Delete(key)
+		return nil, false
+	}
+	if v.(*item).state.Load() != live {
+		return nil, false
+	}
+	return v.(*item).value, true
+}
+
+// DeleteExpired removes every expired item now, rather than waiting for the
+// janitor, which only sweeps every 2×TTL
+func (c *Cache) DeleteExpired() {
+	c.items.DeleteExpired()
+}
+
+// Stats returns the cache's current size and counters
+func (c *Cache) Stats() Stats {
+	c.mu.Lock()
+	var n = c.order.Len()
+	c.mu.Unlock()
+
+	return Stats{
+		Items:       n,
+		MaxItems:    c.maxItems,
+		Sets:        c.sets.Load(),
+		Hits:        c.hits.Load(),
+		Misses:      c.misses.Load(),
+		Expirations: c.expirations.Load(),
+		Evictions:   c.evictions.Load(),
+	}
+}
+
+// removed is go-cache's eviction hook, called whenever an item is deleted or
+// expires. Items nobody took or evicted must have expired.
+func (c *Cache) removed(key string, v any) {
+	var it = v.(*item)
+	if it.state.CompareAndSwap(live, expired) {
+		c.expirations.Add(1)
+	}
+
+	c.mu.Lock()
+	c.forget(key)
+	c.mu.Unlock()
+
+	if c.onRemove != nil {
+		c.onRemove(it.value)
+	}
+}
+
+// forget drops key from the eviction order. c.mu must be held.
+func (c *Cache) forget(key string) {
+	var e = c.elems[key]
+	if e != nil {
+		c.order.Remove(e)
+		delete(c.elems, key)
+	}
+}
@@ -0,0 +1,178 @@
+package reqcache
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// removals returns an onRemove hook and a counter of how many times it was
+// called
+func removals() (func(any), *atomic.Int64) {
+	var n = &atomic.Int64{}
+	return func(any) { n.Add(1) }, n
+}
+
+func TestSetAndTake(t *testing.T) {
+	var onRemove, removed = removals()
+	var c = New(time.Minute, 0, onRemove)
+
+	c.Set("a", "first")
+	var v, ok = c.Take("a")
+	if !ok || v != "first" {
+		t.Fatalf("Take(a) = %v, %t; want first, true", v, ok)
+	}
+
+	// Gone once it's been taken, as is anything never added
+	_, ok = c.Take("a")
+	if ok {
+		t.Errorf("took a twice")
+	}
+	_, ok = c.Take("b")
+	if ok {
+		t.Errorf("took b, which was never set")
+	}
+
+	var want = Stats{Sets: 1, Hits: 1, Misses: 2}
+	if got := c.Stats(); got != want {
+		t.Errorf("got stats %+v, want %+v", got, want)
+	}
+	if got := removed.Load(); got != 1 {
+		t.Errorf("onRemove was called %d times, want 1", got)
+	}
+}
+
+func TestEvictsOldestWhenFull(t *testing.T) {
+	var onRemove, removed = removals()
+	var c = New(time.Minute, 2, onRemove)
+
+	c.Set("a", 1)
+	c.Set("b", 2)
+	c.Set("c", 3)
+
+	if _, ok := c.Take("a"); ok {
+		t.Errorf("took a, which should have been evicted")
+	}
+	for _, k := range []string{"b", "c"} {
+		if _, ok := c.Take(k); !ok {
+			t.Errorf("couldn't take %s", k)
+		}
+	}
+
+	var want = Stats{MaxItems: 2, Sets: 3, Hits: 2, Misses: 1, Evictions: 1}
+	if got := c.Stats(); got != want {
+		t.Errorf("got stats %+v, want %+v", got, want)
+	}
+	if got := removed.Load(); got != 3 {
+		t.Errorf("onRemove was called %d times, want 3", got)
+	}
+}
+
+func TestExpires(t *testing.T) {
+	var onRemove, removed = removals()
+	var c = New(10*time.Millisecond, 0, onRemove)
+	c.Set("a", 1)
+
+	// The janitor runs every 2×TTL
+	var deadline = time.Now().Add(2 * time.Second)
+	for c.Stats().Expirations == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	var want = Stats{Sets: 1, Expirations: 1}
+	if got := c.Stats(); got != want {
+		t.Errorf("got stats %+v, want %+v", got, want)
+	}
+	if got := removed.Load(); got != 1 {
+		t.Errorf("onRemove was called %d times, want 1", got)
+	}
+}
+
+func TestCapHoldsUnderConcurrentSets(t *testing.T) {
+	const maxItems, workers, perWorker = 10, 8, 500
+	var onRemove, removed = removals()
+	var c = New(time.Minute, maxItems, onRemove)
+
+	var wg sync.WaitGroup
+	for w := range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range perWorker {
+				c.Set(fmt.Sprintf("%d-%d", w, i), i)
+				if n := c.Stats().Items; n > maxItems {
+					t.Errorf("cache holds %d items, over its cap of %d", n, maxItems)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	var st = c.Stats()
+	if st.Items != maxItems {
+		t.Errorf("cache holds %d items, want %d", st.Items, maxItems)
+	}
+	if st.Sets != workers*perWorker || st.Evictions != st.Sets-maxItems {
+		t.Errorf("got %d sets and %d evictions, want %d and %d", st.Sets, st.Evictions, workers*perWorker, workers*perWorker-maxItems)
+	}
+	if got := removed.Load(); uint64(got) != st.Evictions {
+		t.Errorf("onRemove was called %d times, want once per eviction (%d)", got, st.Evictions)
+	}
+}
+
+func TestExpiredItemsLeaveBeforeTheJanitor(t *testing.T) {
+	const ttl = 50 * time.Millisecond
+	var onRemove, removed = removals()
+	var c = New(ttl, 0, onRemove)
+	c.Set("a", 1)
+	c.Set("b", 2)
+
+	// Past the TTL, but well before the janitor's first sweep at 2×TTL
+	time.Sleep(ttl + ttl/5)
+
+	if _, ok := c.Take("a"); ok {
+		t.Errorf("took a after it expired")
+	}
+	if got := removed.Load(); got != 1 {
+		t.Errorf("onRemove was called %d times after taking an expired item, want 1", got)
+	}
+
+	c.DeleteExpired()
+	if got := removed.Load(); got != 2 {
+		t.Errorf("onRemove was called %d times after deleting expired items, want 2", got)
+	}
+
+	var want = Stats{Sets: 2, Misses: 1, Expirations: 2}
+	if got := c.Stats(); got != want {
+		t.Errorf("got stats %+v, want %+v", got, want)
+	}
+}
+
+func TestPeek(t *testing.T) {
+	var onRemove, removed = removals()
+	var c = New(time.Minute, 0, onRemove)
+	c.Set("a", 1)
+
+	for range 2 {
+		if v, ok := c.Peek("a"); !ok || v != 1 {
+			t.Fatalf("Peek(a) = %v, %t; want 1, true", v, ok)
+		}
+	}
+	if _, ok := c.Take("a"); !ok {
+		t.Fatalf("couldn't take a after peeking at it")
+	}
+	if _, ok := c.Peek("a"); ok {
+		t.Errorf("peeked at a after it was taken")
+	}
+
+	var want = Stats{Sets: 1, Hits: 1}
+	if got := c.Stats(); got != want {
+		t.Errorf("got stats %+v, want %+v", got, want)
+	}
+	if got := removed.Load(); got != 1 {
+		t.Errorf("onRemove was called %d times, want 1", got)
+	}
+}
@@ -7,13 +7,43 @@ import (
 	"encoding/hex"
 )
 
-// New generates a new random request ID.
+// DefaultBytes is how many random bytes [New] uses, giving 32-character IDs
+const DefaultBytes = 16
+
+// MaxLength is the longest ID [Valid] accepts, in characters. It's far longer
+// than any ID we generate, but keeps client-supplied junk out of cache keys.
+const MaxLength = 128
+
+// New generates a new random request ID of [DefaultBytes] random bytes.
+func New() string {
+	return NewN(DefaultBytes)
+}
+
+// NewN generates a new random request ID from n random bytes, hex-encoded, so
+// the ID is 2n characters long. n must be positive.
 //
 // Note: crypto's [rand.Read] will panic on errors, so it won't return an error
 // even if one happens. Because of that, this function doesn't need error
 // handling. See https://github.com/golang/go/issues/66821.
-func New() string {
-	var bytes = make([]byte, 16)
+func NewN(n int) string {
+	if n <= 0 {
+		panic("requestid: length must be positive")
+	}
+	var bytes = make([]byte, n)
 	rand.Read(bytes)
 	return hex.EncodeToString(bytes)
 }
+
+// Valid returns true if s could have come from [NewN]: a non-empty,
+// even-length string of lowercase hex digits, no longer than [MaxLength]
+func Valid(s string) bool {
+	if s == "" || len(s)%2 != 0 || len(s) > MaxLength {
+		return false
+	}
+	for _, c := range []byte(s) {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,30 @@
+package requestid
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValid(t *testing.T) {
+	var tests = map[string]struct {
+		id   string
+		want bool
+	}{
+		"generated":   {New(), true},
+		"short":       {NewN(1), true},
+		"max length":  {strings.Repeat("a", MaxLength), true},
+		"empty":       {"", false},
+		"odd length":  {"abc", false},
+		"overlong":    {strings.Repeat("a", MaxLength+2), false},
+		"non-hex":     {"zz", false},
+		"uppercase":   {"AB", false},
+		"punctuation": {"a/", false},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			if got := Valid(tc.id); got != tc.want {
+				t.Errorf("Valid(%q) = %t, want %t", tc.id, got, tc.want)
+			}
+		})
+	}
+}
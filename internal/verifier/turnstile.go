@@ -0,0 +1,199 @@
+package verifier
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// TurnstileName is the name the Cloudflare Turnstile provider is registered as
+const TurnstileName = "turnstile"
+
+// TurnstileSiteverifyURL is Cloudflare's endpoint for validating responses
+const TurnstileSiteverifyURL = "https://challenges.cloudflare.com/turnstile/v0/siteverify"
+
+// TurnstileTimeoutOrDuplicate is the error code Cloudflare returns for a
+// response that's expired or has already been verified once
+const TurnstileTimeoutOrDuplicate = "timeout-or-duplicate"
+
+// turnstileClientTimeout bounds a single siteverify request when the config
+// doesn't supply its own client
+const turnstileClientTimeout = 5 * time.Second
+
+// Retry settings for siteverify: up to turnstileAttempts tries, waiting
+// turnstileBackoff after the first failure and doubling each time after.
+// turnstileTotalTimeout bounds the whole thing, retries included, so a user
+// is never left hanging for long.
+const (
+	turnstileAttempts     = 3
+	turnstileBackoff      = 250 * time.Millisecond
+	turnstileTotalTimeout = 15 * time.Second
+)
+
+// turnstileSecretPattern matches Turnstile secret keys: a one-digit prefix
+// ("0x" for real keys, "1x" through "3x" for Cloudflare's test keys) and 33
+// more URL-safe characters
+var turnstileSecretPattern = regexp.MustCompile(`^[0-3]x[0-9A-Za-z_-]{33}$`)
+
+func init() {
+	Register(TurnstileName, NewTurnstile)
+}
+
+// ValidTurnstileSecret returns true if k looks like a Turnstile secret key.
+// This can't tell whether Cloudflare will accept the key, only whether it has
+// been mistyped or truncated.
+func ValidTurnstileSecret(k string) bool {
+	return turnstileSecretPattern.MatchString(k)
+}
+
+// Turnstile verifies responses with Cloudflare's Turnstile service
+type Turnstile struct {
+	siteKey   string
+	secretKey string
+	endpoint  string
+	client    *http.Client
+	logger    *slog.Logger
+
+	// Retry settings, which are always the turnstile* constants outside of
+	// tests
+	attempts     int
+	backoff      time.Duration
+	totalTimeout time.Duration
+}
+
+// NewTurnstile returns a Turnstile [Verifier] for the given keys
+func NewTurnstile(conf Config) Verifier {
+	var l = conf.Logger
+	if l == nil {
+		l = slog.Default()
+	}
+	var endpoint = conf.Endpoint
+	if endpoint == "" {
+		endpoint = TurnstileSiteverifyURL
+	}
+	var client = conf.Client
+	if client == nil {
+		client = &http.Client{Timeout: turnstileClientTimeout}
+	}
+	return &Turnstile{
+		siteKey:   conf.SiteKey,
+		secretKey: conf.SecretKey,
+		endpoint:  endpoint,
+		client:    client,
+		logger:    l,
+
+		attempts:     turnstileAttempts,
+		backoff:      turnstileBackoff,
+		totalTimeout: turnstileTotalTimeout,
+	}
+}
+
+// retryableError marks a failure worth retrying: a network error or a 5xx
+type retryableError struct {
+	err error
+}
+
+func (e retryableError) Error() string {
+	return e.err.Error()
+}
+
+func (e retryableError) Unwrap() error {
+	return e.err
+}
+
+// turnstileResponse is the structure of the JSON response from Cloudflare
+type turnstileResponse struct {
+	Success     bool     `json:"success"`
+	ErrorCodes  []string `json:"error-codes"`
+	ChallengeTS string   `json:"challenge_ts"`
+	Hostname    string   `json:"hostname"`
+	Action      string   `json:"action"`
+	CData       string   `json:"cdata"`
+}
+
+// Verify implements [Verifier]. Network errors and 5xx responses from
+// Cloudflare are retried with exponential backoff; a response Cloudflare
+// actually answered, successful or not, never is. Nothing is retried once ctx
+// is done, e.g., because the client went away.
+func (t *Turnstile) Verify(ctx context.Context, token, remoteIP string) (Result, error) {
+	var form = url.Values{"secret": {t.secretKey}, "response": {token}}
+	if remoteIP != "" {
+		form.Set("remoteip", remoteIP)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, t.totalTimeout)
+	defer cancel()
+
+	var backoff = t.backoff
+	for attempt := 1; ; attempt++ {
+		var result, err = t.siteverify(ctx, form)
+		var retryable retryableError
+		if err == nil || !errors.As(err, &retryable) || attempt == t.attempts || ctx.Err() != nil {
+			return result, err
+		}
+
+		t.logger.Warn("Siteverify failed, retrying", "attempt", attempt, "backoff", backoff, "error", err)
+		select {
+		case <-ctx.Done():
+			return Result{}, fmt.Errorf("giving up on siteverify: %w", err)
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// siteverify makes a single siteverify request
+func (t *Turnstile) siteverify(ctx context.Context, form url.Values) (Result, error) {
+	var req, err = http.NewRequestWithContext(ctx, http.MethodPost, t.endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return Result{}, fmt.Errorf("building siteverify request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return Result{}, retryableError{fmt.Errorf("posting to Cloudflare: %w", err)}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 500 {
+		return Result{}, retryableError{fmt.Errorf("cloudflare returned %s", resp.Status)}
+	}
+
+	var tr turnstileResponse
+	err = json.NewDecoder(resp.Body).Decode(&tr)
+	if err != nil {
+		return Result{}, fmt.Errorf("decoding Cloudflare response: %w", err)
+	}
+
+	return Result{
+		Success:     tr.Success,
+		ErrorCodes:  tr.ErrorCodes,
+		ChallengeTS: tr.ChallengeTS,
+		Hostname:    tr.Hostname,
+		Action:      tr.Action,
+		CData:       tr.CData,
+	}, nil
+}
+
+// SiteKey implements [Verifier]
+func (t *Turnstile) SiteKey() string {
+	return t.siteKey
+}
+
+// WidgetScriptURL implements [Verifier]
+func (t *Turnstile) WidgetScriptURL() string {
+	return "https://challenges.cloudflare.com/turnstile/v0/api.js"
+}
+
+// ResponseField implements [Verifier]
+func (t *Turnstile) ResponseField() string {
+	return "cf-turnstile-response"
+}
@@ -0,0 +1,110 @@
+package verifier
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// flakyStub starts a siteverify stub which fails its first failures calls
+// with a 500, then answers with success. It returns a verifier using the stub
+// with a negligible backoff, and a count of the calls the stub got.
+func flakyStub(t *testing.T, failures int64) (*Turnstile, *atomic.Int64) {
+	t.Helper()
+	var calls = &atomic.Int64{}
+	var srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		if calls.Add(1) <= failures {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]any{"success": true})
+	}))
+	t.Cleanup(srv.Close)
+
+	var tv = NewTurnstile(Config{Endpoint: srv.URL, Logger: slog.New(slog.DiscardHandler)}).(*Turnstile)
+	tv.backoff = time.Millisecond
+	return tv, calls
+}
+
+func TestVerifyRetries(t *testing.T) {
+	var tests = map[string]struct {
+		failures  int64
+		wantCalls int64
+		wantErr   bool
+	}{
+		"no failures":           {0, 1, false},
+		"one failure":           {1, 2, false},
+		"succeeds on last try":  {turnstileAttempts - 1, turnstileAttempts, false},
+		"fails every try":       {turnstileAttempts, turnstileAttempts, true},
+		"down for a long while": {100, turnstileAttempts, true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var tv, calls = flakyStub(t, tc.failures)
+			var res, err = tv.Verify(context.Background(), "token", "192.0.2.1")
+			if tc.wantErr && err == nil {
+				t.Errorf("got %+v, want an error", res)
+			}
+			if !tc.wantErr && (err != nil || !res.Success) {
+				t.Errorf("got %+v and error %v, want success", res, err)
+			}
+			if got := calls.Load(); got != tc.wantCalls {
+				t.Errorf("siteverify was called %d times, want %d", got, tc.wantCalls)
+			}
+		})
+	}
+}
+
+func TestVerifyDoesNotRetryAnswers(t *testing.T) {
+	var calls atomic.Int64
+	var srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		calls.Add(1)
+		json.NewEncoder(w).Encode(map[string]any{"success": false, "error-codes": []string{TurnstileTimeoutOrDuplicate}})
+	}))
+	t.Cleanup(srv.Close)
+
+	var tv = NewTurnstile(Config{Endpoint: srv.URL, Logger: slog.New(slog.DiscardHandler)})
+	var res, err = tv.Verify(context.Background(), "token", "")
+	if err != nil || res.Success {
+		t.Errorf("got %+v and error %v, want a failed verification", res, err)
+	}
+	if got := calls.Load(); got != 1 {
+		t.Errorf("siteverify was called %d times, want 1", got)
+	}
+}
+
+func TestVerifyTotalTimeout(t *testing.T) {
+	var tv = NewTurnstile(Config{}).(*Turnstile)
+	if tv.totalTimeout != 15*time.Second {
+		t.Errorf("total timeout is %s, want 15s", tv.totalTimeout)
+	}
+
+	// A siteverify which never answers would otherwise take every attempt's
+	// full client timeout, and then some
+	var release = make(chan struct{})
+	var srv = httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+		<-release
+	}))
+	t.Cleanup(srv.Close)
+	t.Cleanup(func() { close(release) })
+
+	tv, _ = flakyStub(t, 0)
+	tv.endpoint = srv.URL
+	tv.client = &http.Client{}
+	tv.totalTimeout = 100 * time.Millisecond
+
+	var start = time.Now()
+	var _, err = tv.Verify(context.Background(), "token", "")
+	if err == nil {
+		t.Errorf("Verify succeeded against a siteverify that never answers")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Verify took %s, want it to give up after about 100ms", elapsed)
+	}
+}
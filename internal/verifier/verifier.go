@@ -0,0 +1,113 @@
+// Package verifier defines the interface TPS uses to validate challenge
+// responses, and a registry so providers (Turnstile, and potentially others
+// like hCaptcha) can be chosen by name
+package verifier
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sort"
+	"sync"
+)
+
+// Result is a provider's verdict on a challenge response
+type Result struct {
+	Success     bool
+	ErrorCodes  []string
+	ChallengeTS string
+	Hostname    string
+
+	// Action and CData are echoed back from the widget, for tying a response
+	// to the challenge it was solved for
+	Action string
+	CData  string
+}
+
+// Verifier validates challenge responses with a provider, and knows what the
+// challenge page needs in order to render that provider's widget
+type Verifier interface {
+	// Verify asks the provider whether token is a valid challenge response.
+	// remoteIP is optional, and passed along to providers that use it.
+	Verify(ctx context.Context, token, remoteIP string) (Result, error)
+
+	// SiteKey returns the public key the widget is rendered with
+	SiteKey() string
+
+	// WidgetScriptURL returns the URL of the provider's widget JavaScript
+	WidgetScriptURL() string
+
+	// ResponseField returns the name of the form field the widget puts its
+	// response token in
+	ResponseField() string
+}
+
+// Config holds the settings a [Factory] needs to build a Verifier
+type Config struct {
+	SiteKey   string
+	SecretKey string
+
+	// Logger is used for non-fatal problems like retries. If nil,
+	// [slog.Default] is used.
+	Logger *slog.Logger
+
+	// Endpoint overrides the URL of the provider's verification API, e.g., to
+	// point at a stub in tests. If empty, the provider's real endpoint is used.
+	Endpoint string
+
+	// Client is the HTTP client used to reach the provider. If nil, a client
+	// with a short timeout is used.
+	Client *http.Client
+}
+
+// Factory builds a Verifier from the given config
+type Factory func(Config) Verifier
+
+var (
+	m        sync.RWMutex
+	registry = make(map[string]Factory)
+)
+
+// Register makes a provider available under the given name. Registering the
+// same name twice will panic.
+func Register(name string, f Factory) {
+	m.Lock()
+	defer m.Unlock()
+
+	if _, exists := registry[name]; exists {
+		panic(fmt.Sprintf("verifier: provider %q registered twice", name))
+	}
+	registry[name] = f
+}
+
+// New builds a Verifier using the provider registered under name
+func New(name string, conf Config) (Verifier, error) {
+	m.RLock()
+	var f, ok = registry[name]
+	m.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("unknown verification provider %q (available: %q)", name, Names())
+	}
+	return f(conf), nil
+}
+
+// Names returns the names of all registered providers, sorted
+func Names() []string {
+	m.RLock()
+	defer m.RUnlock()
+
+	var names = make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Registered returns true if a provider is registered under name
+func Registered(name string) bool {
+	return slices.Contains(Names(), name)
+}
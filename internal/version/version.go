@@ -5,3 +5,23 @@ package version
 // Version is the raw version string. This is set at compile time via a "make"
 // invocation.
 var Version = "<undefined>"
+
+// Commit is the git commit the binary was built from. This is set at compile
+// time via a "make" invocation.
+var Commit = "<undefined>"
+
+// BuildDate is when the binary was built, in RFC 3339 format. This is set at
+// compile time via a "make" invocation.
+var BuildDate = "<undefined>"
+
+// Info is all the build metadata in one place, ready for JSON encoding
+type Info struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildDate string `json:"buildDate"`
+}
+
+// Get returns the build metadata for the running binary
+func Get() Info {
+	return Info{Version: Version, Commit: Commit, BuildDate: BuildDate}
+}
@@ -0,0 +1,136 @@
+package session
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Context keys [Verify] sets on requests with a valid session
+const (
+	VerifiedKey = "tps.verified"
+	ClaimsKey   = "tps.claims"
+)
+
+// config holds the settings [Option]s adjust
+type config struct {
+	cookieName   string
+	maxAge       time.Duration
+	bindClient   bool
+	unauthorized gin.HandlerFunc
+}
+
+// Option adjusts how [Verify] checks tokens or handles requests without one
+type Option func(*config)
+
+// WithCookieName reads the token from the named cookie rather than
+// [DefaultCookieName]. It must match TPS's COOKIE_NAME.
+func WithCookieName(name string) Option {
+	return func(cfg *config) {
+		cfg.cookieName = name
+	}
+}
+
+// WithMaxSessionAge rejects tokens whose session began longer than d ago. It
+// should match TPS's SESSION_MAX_AGE.
+func WithMaxSessionAge(d time.Duration) Option {
+	return func(cfg *config) {
+		cfg.maxAge = d
+	}
+}
+
+// WithClientBinding requires tokens to be bound to the client presenting them,
+// as TPS does with BIND_SESSION. The client IP is gin's [gin.Context.ClientIP],
+// so the engine's trusted proxies must be set up to see the same IP TPS did.
+func WithClientBinding() Option {
+	return func(cfg *config) {
+		cfg.bindClient = true
+	}
+}
+
+// WithUnauthorized sets the handler for requests without a valid token, e.g.,
+// to redirect them to a page TPS protects. The request is aborted once h
+// returns. The default responds with a bare 401.
+func WithUnauthorized(h gin.HandlerFunc) Option {
+	return func(cfg *config) {
+		cfg.unauthorized = h
+	}
+}
+
+// Verify returns gin middleware which accepts requests carrying a valid TPS
+// session token, signed with signingKey, in the session cookie or
+// [TokenHeader]. Those requests have [VerifiedKey] set to true and
+// [ClaimsKey] set to the token's claims (see [Verified] and [Claims]). All
+// others go to the unauthorized handler (see [WithUnauthorized]) and are
+// aborted.
+//
+// Verify only checks tokens; it never issues or refreshes them, so clients
+// still need to pass a challenge at TPS to get one. An empty signingKey will
+// panic.
+func Verify(signingKey []byte, opts ...Option) gin.HandlerFunc {
+	if len(signingKey) == 0 {
+		panic("session: signing key must not be empty")
+	}
+
+	var cfg = &config{
+		cookieName: DefaultCookieName,
+		unauthorized: func(c *gin.Context) {
+			c.AbortWithStatus(http.StatusUnauthorized)
+		},
+	}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+
+	return func(c *gin.Context) {
+		var claims, err = cfg.validate(c, signingKey)
+		if err != nil {
+			cfg.unauthorized(c)
+			c.Abort()
+			return
+		}
+
+		c.Set(VerifiedKey, true)
+		c.Set(ClaimsKey, claims)
+		c.Next()
+	}
+}
+
+// validate returns the claims from c's session token, if it has a valid one
+func (cfg *config) validate(c *gin.Context, key []byte) (jwt.MapClaims, error) {
+	var token, err = c.Cookie(cfg.cookieName)
+	if err != nil || token == "" {
+		token = c.GetHeader(TokenHeader)
+	}
+	if token == "" {
+		return nil, http.ErrNoCookie
+	}
+
+	var claims jwt.MapClaims
+	claims, err = Parse(token, key, cfg.maxAge)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.bindClient {
+		err = CheckBinding(claims, c.ClientIP(), c.Request.UserAgent())
+		if err != nil {
+			return nil, err
+		}
+	}
+	return claims, nil
+}
+
+// Verified returns true if [Verify] found a valid session token on c
+func Verified(c *gin.Context) bool {
+	return c.GetBool(VerifiedKey)
+}
+
+// Claims returns the claims of the session token [Verify] found on c, or nil
+// if it found none
+func Claims(c *gin.Context) jwt.MapClaims {
+	var v, _ = c.Get(ClaimsKey)
+	var claims, _ = v.(jwt.MapClaims)
+	return claims
+}
@@ -0,0 +1,135 @@
+package session
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+var testKey = []byte("0123456789abcdef0123456789abcdef")
+
+// sign returns a token like TPS issues, for a session which began at start
+// and expires at exp
+func sign(t *testing.T, key []byte, start, exp time.Time) string {
+	t.Helper()
+	var token, err = jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"iss":             "tps",
+		"iat":             start.Unix(),
+		"nbf":             start.Unix(),
+		"exp":             exp.Unix(),
+		ClaimSessionStart: start.Unix(),
+	}).SignedString(key)
+	if err != nil {
+		t.Fatalf("signing token: %s", err)
+	}
+	return token
+}
+
+// newEngine returns an engine protecting "/" with Verify, which answers
+// verified requests with their claims' issuer
+func newEngine(opts ...Option) *gin.Engine {
+	gin.SetMode(gin.ReleaseMode)
+	var r = gin.New()
+	r.Use(Verify(testKey, opts...))
+	r.GET("/", func(c *gin.Context) {
+		if !Verified(c) {
+			c.String(http.StatusInternalServerError, "handler ran unverified")
+			return
+		}
+		c.String(http.StatusOK, Claims(c)["iss"].(string))
+	})
+	return r
+}
+
+func TestVerify(t *testing.T) {
+	var now = time.Now()
+	var valid = sign(t, testKey, now, now.Add(time.Hour))
+	// A token whose claims were edited to push out its expiry, keeping the
+	// original signature
+	var parts = strings.Split(valid, ".")
+	var tampered = parts[0] + "." + base64.RawURLEncoding.EncodeToString([]byte(`{"iss":"tps","exp":4102444800}`)) + "." + parts[2]
+
+	var tests = map[string]struct {
+		cookie string
+		header string
+		opts   []Option
+		want   int
+	}{
+		"valid cookie":         {cookie: valid, want: http.StatusOK},
+		"valid header":         {header: valid, want: http.StatusOK},
+		"missing":              {want: http.StatusUnauthorized},
+		"expired":              {cookie: sign(t, testKey, now.Add(-2*time.Hour), now.Add(-time.Hour)), want: http.StatusUnauthorized},
+		"tampered":             {cookie: tampered, want: http.StatusUnauthorized},
+		"wrong key":            {cookie: sign(t, []byte("some other key entirely, 32bytes"), now, now.Add(time.Hour)), want: http.StatusUnauthorized},
+		"past max session age": {cookie: sign(t, testKey, now.Add(-2*time.Hour), now.Add(time.Hour)), opts: []Option{WithMaxSessionAge(time.Hour)}, want: http.StatusUnauthorized},
+		"other cookie name":    {cookie: valid, opts: []Option{WithCookieName("other")}, want: http.StatusUnauthorized},
+		"unbound token":        {cookie: valid, opts: []Option{WithClientBinding()}, want: http.StatusUnauthorized},
+		"custom unauthorized": {opts: []Option{WithUnauthorized(func(c *gin.Context) {
+			c.Redirect(http.StatusFound, "/login")
+		})}, want: http.StatusFound},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var r = httptest.NewRequest(http.MethodGet, "/", nil)
+			if tc.cookie != "" {
+				r.AddCookie(&http.Cookie{Name: DefaultCookieName, Value: tc.cookie})
+			}
+			if tc.header != "" {
+				r.Header.Set(TokenHeader, tc.header)
+			}
+
+			var w = httptest.NewRecorder()
+			newEngine(tc.opts...).ServeHTTP(w, r)
+			if w.Code != tc.want {
+				t.Errorf("got status %d, want %d (body %q)", w.Code, tc.want, w.Body.String())
+			}
+			if tc.want == http.StatusOK && w.Body.String() != "tps" {
+				t.Errorf("got body %q, want the token's issuer", w.Body.String())
+			}
+		})
+	}
+}
+
+func TestVerifyClientBinding(t *testing.T) {
+	var now = time.Now()
+	var claims = jwt.MapClaims{
+		"iss":             "tps",
+		"iat":             now.Unix(),
+		"exp":             now.Add(time.Hour).Unix(),
+		ClaimSessionStart: now.Unix(),
+	}
+	BindClaims(claims, "192.0.2.1", "test-agent")
+	var token, err = jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(testKey)
+	if err != nil {
+		t.Fatalf("signing token: %s", err)
+	}
+
+	var tests = map[string]struct {
+		ua   string
+		want int
+	}{
+		"same client":  {"test-agent", http.StatusOK},
+		"other client": {"other-agent", http.StatusUnauthorized},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var r = httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = "192.0.2.1:1234"
+			r.Header.Set("User-Agent", tc.ua)
+			r.AddCookie(&http.Cookie{Name: DefaultCookieName, Value: token})
+
+			var w = httptest.NewRecorder()
+			newEngine(WithClientBinding()).ServeHTTP(w, r)
+			if w.Code != tc.want {
+				t.Errorf("got status %d, want %d", w.Code, tc.want)
+			}
+		})
+	}
+}
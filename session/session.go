@@ -0,0 +1,116 @@
+// Package session validates the session tokens TPS issues once a client passes
+// its challenge. TPS uses it for every proxied request, and services sharing
+// TPS's signing key can use [Verify] to accept the same tokens without
+// running the proxy themselves.
+package session
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// DefaultCookieName is the cookie TPS keeps its session token in unless it's
+// configured otherwise
+const DefaultCookieName = "tps-jwt"
+
+// TokenHeader is where client-side apps send a token they received via TPS's
+// post-verification redirect, in place of the cookie
+const TokenHeader = "X-TPS-Token"
+
+// Custom claims binding a token to the client it was issued to
+const (
+	ClaimClientIP = "cip"
+	ClaimUAHash   = "uah"
+)
+
+// ClaimSessionStart is when the client passed the challenge that started its
+// session. Refreshed tokens carry it forward, so a session can't be extended
+// past its max age.
+const ClaimSessionStart = "sst"
+
+// ClaimRequestID is the request ID of the challenge that started the session.
+// Like [ClaimSessionStart], refreshed tokens carry it forward.
+const ClaimRequestID = "rid"
+
+var (
+	// ErrClientMismatch means a token was bound to a different client than the
+	// one presenting it
+	ErrClientMismatch = errors.New("token is bound to a different client")
+
+	// ErrTooOld means a token's session began longer ago than the max session
+	// age allows
+	ErrTooOld = errors.New("session is older than the max session age")
+)
+
+// UAHash returns a short, stable hash of a User-Agent string. We only need to
+// compare it, and there's no reason to stuff the whole UA into every cookie.
+func UAHash(ua string) string {
+	var sum = sha256.Sum256([]byte(ua))
+	return hex.EncodeToString(sum[:8])
+}
+
+// BindClaims adds claims binding a token to the client with the given IP and
+// User-Agent
+func BindClaims(claims jwt.MapClaims, clientIP, userAgent string) {
+	claims[ClaimClientIP] = clientIP
+	claims[ClaimUAHash] = UAHash(userAgent)
+}
+
+// CheckBinding returns [ErrClientMismatch] unless claims are bound to the
+// client with the given IP and User-Agent
+func CheckBinding(claims jwt.MapClaims, clientIP, userAgent string) error {
+	var ip, _ = claims[ClaimClientIP].(string)
+	var ua, _ = claims[ClaimUAHash].(string)
+	if ip != clientIP || ua != UAHash(userAgent) {
+		return ErrClientMismatch
+	}
+	return nil
+}
+
+// Start returns when the session behind claims began. Tokens issued before
+// TPS recorded it fall back to their issue time.
+func Start(claims jwt.MapClaims) time.Time {
+	var sst, ok = claims[ClaimSessionStart].(float64)
+	if ok {
+		return time.Unix(int64(sst), 0)
+	}
+	var iat, err = claims.GetIssuedAt()
+	if err != nil || iat == nil {
+		return time.Time{}
+	}
+	return iat.Time
+}
+
+// RequestID returns the request ID of the challenge that started the session
+// behind claims, or an empty string for tokens issued before TPS recorded it
+func RequestID(claims jwt.MapClaims) string {
+	var rid, _ = claims[ClaimRequestID].(string)
+	return rid
+}
+
+// Parse verifies token's signature against key and its standard time claims,
+// returning its claims. If maxAge is positive, sessions which began longer ago
+// than that are rejected with [ErrTooOld]. Client binding is checked
+// separately, with [CheckBinding].
+func Parse(token string, key []byte, maxAge time.Duration) (jwt.MapClaims, error) {
+	var claims = jwt.MapClaims{}
+	var _, err = jwt.ParseWithClaims(token, claims, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		return key, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if maxAge > 0 && time.Since(Start(claims)) > maxAge {
+		return nil, ErrTooOld
+	}
+	return claims, nil
+}